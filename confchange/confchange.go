@@ -331,6 +331,13 @@ func checkInvariants(cfg tracker.Config, trk tracker.ProgressMap) error {
 	return nil
 }
 
+// CheckInvariants returns an error if the given configuration and progress map
+// are inconsistent with each other or violate the rules for joint
+// configurations, which Changer maintains on its inputs and outputs.
+func CheckInvariants(cfg tracker.Config, trk tracker.ProgressMap) error {
+	return checkInvariants(cfg, trk)
+}
+
 // checkAndCopy copies the tracker's config and progress map (deeply enough for
 // the purposes of the Changer) and returns those copies. It returns an error
 // if checkInvariants does.
@@ -83,6 +83,17 @@ func (rndConfChange) Generate(rand *rand.Rand, _ int) reflect.Value {
 	return reflect.ValueOf(rndConfChange(cs))
 }
 
+func TestCheckInvariants(t *testing.T) {
+	cs := pb.ConfState{Voters: []uint64{1, 2, 3}, Learners: []uint64{4}}
+	cfg, trk, err := Restore(Changer{Tracker: tracker.MakeProgressTracker(20, 0), LastIndex: 10}, cs)
+	assert.NoError(t, err)
+
+	assert.NoError(t, CheckInvariants(cfg, trk))
+
+	delete(trk, 4)
+	assert.Error(t, CheckInvariants(cfg, trk))
+}
+
 func TestRestore(t *testing.T) {
 	cfg := quick.Config{MaxCount: 1000}
 
@@ -0,0 +1,43 @@
+// Copyright 2026 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package confchange
+
+import (
+	"fmt"
+
+	pb "go.etcd.io/raft/v3/raftpb"
+	"go.etcd.io/raft/v3/tracker"
+)
+
+// Validate replays the given changes on top of the configuration described by
+// base, and returns an error if the result is not equivalent to target (see
+// ConfState.Equivalent). The changes are applied one by one, as simple config
+// changes, so base must not be a joint configuration. An error is also
+// returned if any of the changes can't be applied.
+func Validate(base pb.ConfState, ccs []pb.ConfChangeSingle, target pb.ConfState) error {
+	chg := Changer{Tracker: tracker.MakeProgressTracker(1, 0)}
+	cfg, trk, err := Restore(chg, base)
+	if err != nil {
+		return fmt.Errorf("restoring %+v: %w", base, err)
+	}
+	for i, cc := range ccs {
+		chg.Tracker.Config, chg.Tracker.Progress = cfg, trk
+		if cfg, trk, err = chg.Simple(cc); err != nil {
+			return fmt.Errorf("applying change %d (%s): %w", i, Describe(cc), err)
+		}
+	}
+	chg.Tracker.Config, chg.Tracker.Progress = cfg, trk
+	return chg.Tracker.ConfState().Equivalent(target)
+}
@@ -0,0 +1,41 @@
+// Copyright 2026 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package confchange
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	pb "go.etcd.io/raft/v3/raftpb"
+)
+
+func TestValidate(t *testing.T) {
+	base := pb.ConfState{Voters: []uint64{1, 2, 3}, Learners: []uint64{4}}
+	ccs := []pb.ConfChangeSingle{
+		{Type: pb.ConfChangeAddNode, NodeID: 4},
+		{Type: pb.ConfChangeRemoveNode, NodeID: 1},
+		{Type: pb.ConfChangeAddLearnerNode, NodeID: 5},
+	}
+
+	require.NoError(t, Validate(base, nil, base))
+	require.NoError(t, Validate(base, ccs, pb.ConfState{Voters: []uint64{4, 3, 2}, Learners: []uint64{5}}))
+	// The target doesn't match the result.
+	require.Error(t, Validate(base, ccs, pb.ConfState{Voters: []uint64{2, 3, 4}}))
+	require.Error(t, Validate(base, ccs[:2], pb.ConfState{Voters: []uint64{2, 3, 4}, Learners: []uint64{5}}))
+	// A change that can't be applied as a simple change.
+	err := Validate(pb.ConfState{Voters: []uint64{1, 2}, VotersOutgoing: []uint64{1}}, ccs, base)
+	require.ErrorContains(t, err, "applying change 0")
+}
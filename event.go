@@ -0,0 +1,98 @@
+// Copyright 2026 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"fmt"
+
+	pb "go.etcd.io/raft/v3/raftpb"
+)
+
+// EventType is the type of an Event.
+type EventType uint8
+
+const (
+	// EventLeaderChange is emitted when the leader known to the node changes,
+	// including to and from None. Uses Lead and PrevLead.
+	EventLeaderChange EventType = iota + 1
+	// EventCommitAdvance is emitted when the commit index advances. Index is
+	// the new commit index.
+	EventCommitAdvance
+	// EventConfChangeApplied is emitted when a configuration change is
+	// applied. ConfState is the resulting configuration.
+	EventConfChangeApplied
+	// EventSnapshotSent is emitted when the leader sends a snapshot. Peer is
+	// the recipient, and Index is the snapshot index.
+	EventSnapshotSent
+	// EventSnapshotReceived is emitted when a follower accepts a snapshot.
+	// Peer is the sender, and Index is the snapshot index.
+	EventSnapshotReceived
+	// EventProposalDropped is emitted when a proposal is dropped, i.e.
+	// ErrProposalDropped is returned for it. Entries is the number of entries
+	// in the proposal.
+	EventProposalDropped
+)
+
+var eventTypeNames = [...]string{
+	EventLeaderChange:      "LeaderChange",
+	EventCommitAdvance:     "CommitAdvance",
+	EventConfChangeApplied: "ConfChangeApplied",
+	EventSnapshotSent:      "SnapshotSent",
+	EventSnapshotReceived:  "SnapshotReceived",
+	EventProposalDropped:   "ProposalDropped",
+}
+
+func (t EventType) String() string {
+	if int(t) < len(eventTypeNames) && eventTypeNames[t] != "" {
+		return eventTypeNames[t]
+	}
+	return fmt.Sprintf("EventType(%d)", uint8(t))
+}
+
+// Event describes a significant state transition of a raft node. It is a
+// tagged union: Type determines which of the other fields are set, see
+// EventType. Term is always set to the node's term at the time of the event.
+type Event struct {
+	Type EventType
+	Term uint64
+
+	Lead     uint64
+	PrevLead uint64
+
+	Index uint64
+	Peer  uint64
+
+	ConfState *pb.ConfState
+
+	Entries int
+}
+
+// emit passes the event to Config.EventSink, if set.
+func (r *raft) emit(e Event) {
+	if r.eventSink == nil {
+		return
+	}
+	e.Term = r.Term
+	r.eventSink(e)
+}
+
+// emitCommitAdvance emits EventCommitAdvance if the commit index has advanced
+// since it was last emitted.
+func (r *raft) emitCommitAdvance() {
+	if committed := r.raftLog.committed; committed > r.emittedCommit {
+		r.emittedCommit = committed
+		r.emit(Event{Type: EventCommitAdvance, Index: committed})
+	}
+}
@@ -15,6 +15,10 @@
 package raft
 
 import (
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+
 	pb "go.etcd.io/raft/v3/raftpb"
 )
 
@@ -45,3 +49,17 @@ func ExampleNode() {
 		sendMessages(rd.Messages)
 	}
 }
+
+func ExampleProtoEntryFormatter() {
+	f := ProtoEntryFormatter(func(data []byte) (proto.Message, error) {
+		var hs pb.HardState
+		err := hs.Unmarshal(data)
+		return &hs, err
+	})
+	data, _ := (&pb.HardState{Term: 2, Vote: 1, Commit: 3}).Marshal()
+	fmt.Println(DescribeEntry(pb.Entry{Term: 2, Index: 5, Data: data}, f))
+	fmt.Println(DescribeEntry(pb.Entry{Term: 2, Index: 6, Data: []byte("\xff")}, f))
+	// Output:
+	// 2/5 EntryNormal term:2 vote:1 commit:3
+	// 2/6 EntryNormal "\xff"
+}
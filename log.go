@@ -59,6 +59,11 @@ type raftLog struct {
 	// applyingEntsPaused is true when entry application has been paused until
 	// enough progress is acknowledged.
 	applyingEntsPaused bool
+
+	// onEntriesOverwritten, if set, is called with the entries that are
+	// truncated from the log because they conflict with appended entries. See
+	// Config.OnEntriesOverwritten.
+	onEntriesOverwritten func(overwritten []pb.Entry)
 }
 
 // newLog returns log using the given storage and default options. It
@@ -122,7 +127,17 @@ func (l *raftLog) maybeAppend(a logSlice, committed uint64) (lastnewi uint64, ok
 		if ci-offset > uint64(len(a.entries)) {
 			l.logger.Panicf("index, %d, is out of range [%d]", ci-offset, len(a.entries))
 		}
+		var overwritten []pb.Entry
+		if l.onEntriesOverwritten != nil && ci <= l.lastIndex() {
+			var err error
+			if overwritten, err = l.slice(ci, l.lastIndex()+1, noLimit); err != nil {
+				l.logger.Panicf("unable to read entries [%d, %d] to be overwritten: %v", ci, l.lastIndex(), err)
+			}
+		}
 		l.append(a.entries[ci-offset:]...)
+		if len(overwritten) != 0 {
+			l.onEntriesOverwritten(overwritten)
+		}
 	}
 	l.commitTo(min(committed, lastnewi))
 	return lastnewi, true
@@ -174,23 +189,61 @@ func (l *raftLog) findConflict(ents []pb.Entry) uint64 {
 //
 // The second returned value is the term(guessIndex), or 0 if it is unknown.
 //
+// If maxScan is positive, at most maxScan entries are examined. If none of them
+// qualifies, the last examined index and its term are returned instead. This
+// is a less precise guess, which only moves the conflict resolution one
+// bounded step further.
+//
 // This function is used by a follower and leader to resolve log conflicts after
 // an unsuccessful append to a follower, and ultimately restore the steady flow
 // of appends.
-func (l *raftLog) findConflictByTerm(index uint64, term uint64) (uint64, uint64) {
-	for ; index > 0; index-- {
+func (l *raftLog) findConflictByTerm(index uint64, term uint64, maxScan uint64) (uint64, uint64) {
+	for scanned := uint64(1); index > 0; index, scanned = index-1, scanned+1 {
 		// If there is an error (likely ErrCompacted or ErrUnavailable), we don't
 		// know whether it's a match or not, so assume a possible match and return
 		// the index, with 0 term indicating an unknown term.
 		if ourTerm, err := l.term(index); err != nil {
 			return index, 0
-		} else if ourTerm <= term {
+		} else if ourTerm <= term || scanned == maxScan {
 			return index, ourTerm
 		}
 	}
 	return 0, 0
 }
 
+// searchConflictByTerm is like findConflictByTerm without a scan limit, but
+// binary searches the log for the guessIndex rather than scanning it, relying
+// on the terms of the log entries being non-decreasing. It examines O(log n)
+// entries for a log of n entries.
+func (l *raftLog) searchConflictByTerm(index uint64, term uint64) (uint64, uint64) {
+	hi := index
+	if ourTerm, err := l.term(hi); err != nil {
+		return hi, 0
+	} else if ourTerm <= term {
+		return hi, ourTerm
+	}
+	lo := l.firstIndex() - 1
+	loTerm, err := l.term(lo)
+	if err != nil || loTerm > term {
+		// The guessIndex is below the first known entry, if any.
+		return l.findConflictByTerm(lo, term, 0)
+	}
+	// Invariant: term(lo) <= term < term(hi).
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		midTerm, err := l.term(mid)
+		if err != nil {
+			return l.findConflictByTerm(hi, term, 0)
+		}
+		if midTerm <= term {
+			lo, loTerm = mid, midTerm
+		} else {
+			hi = mid
+		}
+	}
+	return lo, loTerm
+}
+
 // nextUnstableEnts returns all entries that are available to be written to the
 // local stable log and are not already in-progress.
 func (l *raftLog) nextUnstableEnts() []pb.Entry {
@@ -461,6 +514,35 @@ func (l *raftLog) maybeCommit(at entryID) bool {
 	return false
 }
 
+// truncateUnpersisted discards the suffix of the log that starts at the first
+// entry with an index > after and the given term, provided that this suffix
+// has not been handed over for persistence yet. Such entries have never been
+// written to stable storage, so dropping them is equivalent to losing them in a
+// crash. Returns the number of discarded entries.
+func (l *raftLog) truncateUnpersisted(after, term uint64) uint64 {
+	from := max(after+1, l.unstable.offsetInProgress)
+	last := l.lastIndex()
+	for ; from <= last; from++ {
+		if t, ok := l.unstable.maybeTerm(from); ok && t == term {
+			break
+		}
+	}
+	if from > last {
+		return 0
+	}
+	if from == l.unstable.offset {
+		// Truncating all unstable entries exposes the storage log. Make sure it
+		// does not contain entries at the truncated indexes.
+		if li, err := l.storage.LastIndex(); err != nil || li >= from {
+			return 0
+		}
+	}
+	if !l.unstable.truncateNotInProgress(from) {
+		return 0
+	}
+	return last + 1 - from
+}
+
 func (l *raftLog) restore(s pb.Snapshot) {
 	l.logger.Infof("log [%s] starts to restore snapshot [index: %d, term: %d]", l, s.Metadata.Index, s.Metadata.Term)
 	l.committed = s.Metadata.Index
@@ -60,6 +60,7 @@ func TestFindConflictByTerm(t *testing.T) {
 		ents  []pb.Entry // ents[0] contains the (index, term) of the snapshot
 		index uint64
 		term  uint64
+		scan  uint64
 		want  uint64
 	}{
 		// Log starts from index 1.
@@ -85,6 +86,14 @@ func TestFindConflictByTerm(t *testing.T) {
 		{ents: index(10).terms(3, 3, 3, 4, 4, 4), index: 9, term: 2, want: 9}, // ErrCompacted
 		{ents: index(10).terms(3, 3, 3, 4, 4, 4), index: 4, term: 2, want: 4}, // ErrCompacted
 		{ents: index(10).terms(3, 3, 3, 4, 4, 4), index: 0, term: 0, want: 0}, // ErrCompacted
+		// Bounded scan.
+		{ents: index(0).terms(0, 2, 2, 5, 5, 5), index: 5, term: 4, scan: 1, want: 5},
+		{ents: index(0).terms(0, 2, 2, 5, 5, 5), index: 5, term: 4, scan: 3, want: 3},
+		{ents: index(0).terms(0, 2, 2, 5, 5, 5), index: 5, term: 4, scan: 4, want: 2},
+		{ents: index(0).terms(0, 2, 2, 5, 5, 5), index: 5, term: 1, scan: 4, want: 2},
+		{ents: index(0).terms(0, 2, 2, 5, 5, 5), index: 5, term: 1, scan: 10, want: 0},
+		{ents: index(10).terms(3, 3, 3, 4, 4, 4), index: 14, term: 2, scan: 3, want: 12},
+		{ents: index(10).terms(3, 3, 3, 4, 4, 4), index: 14, term: 2, scan: 10, want: 9}, // ErrCompacted
 	} {
 		t.Run("", func(t *testing.T) {
 			st := NewMemoryStorage()
@@ -96,11 +105,17 @@ func TestFindConflictByTerm(t *testing.T) {
 			l := newLog(st, raftLogger)
 			l.append(tt.ents[1:]...)
 
-			index, term := l.findConflictByTerm(tt.index, tt.term)
+			index, term := l.findConflictByTerm(tt.index, tt.term, tt.scan)
 			require.Equal(t, tt.want, index)
 			wantTerm, err := l.term(index)
 			wantTerm = l.zeroTermOnOutOfBounds(wantTerm, err)
 			require.Equal(t, wantTerm, term)
+
+			if tt.scan == 0 {
+				index, term = l.searchConflictByTerm(tt.index, tt.term)
+				require.Equal(t, tt.want, index)
+				require.Equal(t, wantTerm, term)
+			}
 		})
 	}
 }
@@ -14,7 +14,11 @@
 
 package raft
 
-import pb "go.etcd.io/raft/v3/raftpb"
+import (
+	"unsafe"
+
+	pb "go.etcd.io/raft/v3/raftpb"
+)
 
 // unstable contains "unstable" log entries and snapshot state that has
 // not yet been written to Storage. The type serves two roles. First, it
@@ -49,6 +53,16 @@ type unstable struct {
 	logger Logger
 }
 
+// memoryFootprint returns an estimate of the number of bytes used by the
+// unstable entries and snapshot.
+func (u *unstable) memoryFootprint() uint64 {
+	n := entriesFootprint(u.entries)
+	if u.snapshot != nil {
+		n += uint64(unsafe.Sizeof(*u.snapshot)) + uint64(len(u.snapshot.Data))
+	}
+	return n
+}
+
 // maybeFirstIndex returns the index of the first possible entry in entries
 // if it has a snapshot.
 func (u *unstable) maybeFirstIndex() (uint64, bool) {
@@ -218,6 +232,21 @@ func (u *unstable) truncateAndAppend(ents []pb.Entry) {
 	}
 }
 
+// truncateNotInProgress discards the suffix of the unstable entries starting
+// at index from, provided that none of these entries are in the process of
+// being written to storage. Returns false and leaves the entries intact
+// otherwise.
+func (u *unstable) truncateNotInProgress(from uint64) bool {
+	end := u.offset + uint64(len(u.entries))
+	if from < u.offsetInProgress || from >= end {
+		return false
+	}
+	u.logger.Infof("truncate the unstable entries from index %d", from)
+	u.entries = u.entries[:from-u.offset]
+	u.shrinkEntriesArray()
+	return true
+}
+
 // slice returns the entries from the unstable log with indexes in the range
 // [lo, hi). The entire range must be stored in the unstable log or the method
 // will panic. The returned slice can be appended to, but the entries in it must
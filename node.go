@@ -17,6 +17,7 @@ package raft
 import (
 	"context"
 	"errors"
+	"io"
 
 	pb "go.etcd.io/raft/v3/raftpb"
 )
@@ -69,6 +70,8 @@ type Ready struct {
 	// when its applied index is greater than the index in ReadState.
 	// Note that the readState will be returned when raft receives msgReadIndex.
 	// The returned is only valid for the request that requested to read.
+	// If Config.DedupReadStates is set, ReadStates never contains two entries
+	// with the same RequestCtx.
 	ReadStates []ReadState
 
 	// Entries specifies entries to be saved to stable storage BEFORE
@@ -112,6 +115,36 @@ type Ready struct {
 	// MustSync indicates whether the HardState and Entries must be durably
 	// written to disk or if a non-durable write is permissible.
 	MustSync bool
+
+	// EmptyEntryIndexes lists, in increasing order, the indexes of the entries
+	// in CommittedEntries which are empty, i.e. normal entries without data,
+	// such as those appended by a new leader. They have no effect on the state
+	// machine other than advancing the applied index, so the application may
+	// skip them in bulk. Only populated if Config.ReportEmptyEntries is set.
+	EmptyEntryIndexes []uint64
+
+	// ProposalIDs lists, in increasing index order, the entries in
+	// CommittedEntries which were proposed on this node with
+	// RawNode.ProposeWithID, together with the ID they were proposed with.
+	ProposalIDs []ProposalID
+
+	// ShouldSnapshot is set if the size of the log entries in Storage exceeds
+	// Config.SnapshotOnLogBytes. The application should then create a snapshot
+	// and compact the log. It is only computed when a Ready is produced for
+	// other reasons, and stays set until the log shrinks.
+	ShouldSnapshot bool
+}
+
+// HasConfChange returns true if CommittedEntries contains a configuration
+// change entry, of either type. The application must call ApplyConfChange for
+// each such entry once it is applied.
+func (rd Ready) HasConfChange() bool {
+	for i := range rd.CommittedEntries {
+		if typ := rd.CommittedEntries[i].Type; typ == pb.EntryConfChange || typ == pb.EntryConfChangeV2 {
+			return true
+		}
+	}
+	return false
 }
 
 func isHardStateEqual(a, b pb.HardState) bool {
@@ -238,7 +271,8 @@ type Node interface {
 	// failure in snapshot sending is caught and reported back to the leader; so it can resume raft
 	// log probing in the follower.
 	ReportSnapshot(id uint64, status SnapshotStatus)
-	// Stop performs any necessary termination of the Node.
+	// Stop performs any necessary termination of the Node. If the Storage
+	// implements io.Closer, it is closed once the Node has stopped.
 	Stop()
 }
 
@@ -447,12 +481,32 @@ func (n *node) run() {
 		case c := <-n.status:
 			c <- getStatus(r)
 		case <-n.stop:
+			if c, ok := storageCloser(r.raftLog.storage); ok {
+				if err := c.Close(); err != nil {
+					r.logger.Warningf("%x failed to close the storage: %v", r.id, err)
+				}
+			}
 			close(n.done)
 			return
 		}
 	}
 }
 
+// storageCloser returns the given Storage, or the innermost Storage it wraps
+// which implements io.Closer, if any.
+func storageCloser(s Storage) (io.Closer, bool) {
+	for {
+		if c, ok := s.(io.Closer); ok {
+			return c, true
+		}
+		w, ok := s.(storageWrapper)
+		if !ok {
+			return nil, false
+		}
+		s = w.Unwrap()
+	}
+}
+
 // Tick increments the internal logical clock for this Node. Election timeouts
 // and heartbeat timeouts are in units of ticks.
 func (n *node) Tick() {
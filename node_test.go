@@ -476,6 +476,21 @@ func TestNodeStop(t *testing.T) {
 	n.Stop()
 }
 
+// TestNodeStopClosesStorage ensures that node.Stop() closes the Storage if it,
+// or the Storage it wraps, implements io.Closer.
+func TestNodeStopClosesStorage(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	rn := newTestRawNode(1, 10, 1, NewMeteredStorage(s))
+	n := newNode(rn)
+	go n.run()
+	_, err := s.LastIndex()
+	require.NoError(t, err)
+
+	n.Stop()
+	_, err = s.LastIndex()
+	require.Equal(t, ErrUnavailable, err)
+}
+
 // TestNodeStart ensures that a node can be started correctly. The node should
 // start with correct configuration change entries, and can accept and commit
 // proposals.
@@ -714,6 +729,25 @@ func TestIsHardStateEqual(t *testing.T) {
 	}
 }
 
+func TestReadyHasConfChange(t *testing.T) {
+	ents := index(1).terms(1, 1, 1)
+	for _, tt := range []struct {
+		rd   Ready
+		want bool
+	}{
+		{Ready{}, false},
+		{Ready{CommittedEntries: ents}, false},
+		// Uncommitted conf changes do not count.
+		{Ready{Entries: []raftpb.Entry{{Type: raftpb.EntryConfChange}}, CommittedEntries: ents}, false},
+		{Ready{CommittedEntries: append(ents[:2:2], raftpb.Entry{Type: raftpb.EntryConfChange})}, true},
+		{Ready{CommittedEntries: []raftpb.Entry{{Type: raftpb.EntryConfChangeV2}, ents[0]}}, true},
+	} {
+		t.Run("", func(t *testing.T) {
+			require.Equal(t, tt.want, tt.rd.HasConfChange())
+		})
+	}
+}
+
 func TestNodeProposeAddLearnerNode(t *testing.T) {
 	ticker := time.NewTicker(time.Millisecond * 100)
 	defer ticker.Stop()
@@ -172,6 +172,17 @@ func TestDataDriven(t *testing.T) {
 					if aIdx := alternativeMajorityCommittedIndex(c, l); aIdx != idx {
 						fmt.Fprintf(&buf, "%s <-- via alternative computation\n", aIdx)
 					}
+					// The detailed computation should agree, and only report voters
+					// below the committed index.
+					if aIdx, laggards := c.CommittedIndexWithDetail(l); aIdx != idx {
+						fmt.Fprintf(&buf, "%s <-- via detailed computation\n", aIdx)
+					} else {
+						for _, tup := range laggards {
+							if Index(tup.Idx) >= idx {
+								fmt.Fprintf(&buf, "%d <-- laggard id=%d not below committed index\n", tup.Idx, tup.ID)
+							}
+						}
+					}
 					// Joining a majority with the empty majority should give same result.
 					if aIdx := JointConfig([2]MajorityConfig{c, {}}).CommittedIndex(l); aIdx != idx {
 						fmt.Fprintf(&buf, "%s <-- via zero-joint quorum\n", aIdx)
@@ -14,6 +14,11 @@
 
 package quorum
 
+import (
+	"fmt"
+	"strings"
+)
+
 // JointConfig is a configuration of two groups of (possibly overlapping)
 // majority configurations. Decisions require the support of both majorities.
 type JointConfig [2]MajorityConfig
@@ -44,6 +49,38 @@ func (c JointConfig) Describe(l AckedIndexer) string {
 	return MajorityConfig(c.IDs()).Describe(l)
 }
 
+// DescribeSideBySide is like Describe, but renders the incoming and the
+// outgoing majority config next to each other, followed by the committed
+// index of each majority and the resulting joint committed index. This makes
+// it easy to see which of the two majorities holds back the commit.
+func (c JointConfig) DescribeSideBySide(l AckedIndexer) string {
+	var cols [2][]string
+	width := 0
+	for i, name := range []string{"incoming", "outgoing"} {
+		desc := strings.TrimSuffix(c[i].Describe(l), "\n")
+		cols[i] = append([]string{name + " " + c[i].String()}, strings.Split(desc, "\n")...)
+	}
+	for _, line := range cols[0] {
+		width = max(width, len(line))
+	}
+
+	var buf strings.Builder
+	for i := 0; i < max(len(cols[0]), len(cols[1])); i++ {
+		var left, right string
+		if i < len(cols[0]) {
+			left = cols[0][i]
+		}
+		if i < len(cols[1]) {
+			right = cols[1][i]
+		}
+		buf.WriteString(strings.TrimRight(fmt.Sprintf("%-*s    %s", width, left, right), " "))
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&buf, "committed: incoming=%s outgoing=%s joint=%s\n",
+		c[0].CommittedIndex(l), c[1].CommittedIndex(l), c.CommittedIndex(l))
+	return buf.String()
+}
+
 // CommittedIndex returns the largest committed index for the given joint
 // quorum. An index is jointly committed if it is committed in both constituent
 // majorities.
@@ -56,6 +93,18 @@ func (c JointConfig) CommittedIndex(l AckedIndexer) Index {
 	return idx1
 }
 
+// DescribeVotes returns a (multi-line) representation of the given votes in
+// the incoming and the outgoing majority config, followed by the joint result.
+// See MajorityConfig.DescribeVotes.
+func (c JointConfig) DescribeVotes(votes map[uint64]bool) string {
+	var buf strings.Builder
+	for i, name := range []string{"incoming", "outgoing"} {
+		fmt.Fprintf(&buf, "%s %s:\n%s", name, c[i], c[i].DescribeVotes(votes))
+	}
+	fmt.Fprintf(&buf, "joint result=%s\n", c.VoteResult(votes))
+	return buf.String()
+}
+
 // VoteResult takes a mapping of voters to yes/no (true/false) votes and returns
 // a result indicating whether the vote is pending, lost, or won. A joint quorum
 // requires both majority quorums to vote in favor.
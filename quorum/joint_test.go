@@ -0,0 +1,66 @@
+// Copyright 2026 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quorum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJointDescribeSideBySide(t *testing.T) {
+	c := JointConfig{
+		MajorityConfig{1: {}, 2: {}, 3: {}},
+		MajorityConfig{1: {}, 4: {}},
+	}
+	l := mapAckIndexer{1: 100, 2: 101, 3: 99, 4: 50}
+	require.Equal(t, `incoming (1 2 3)        outgoing (1 4)
+       idx                    idx
+x>     100    (id=1)    x>    100    (id=1)
+xx>    101    (id=2)    >      50    (id=4)
+>       99    (id=3)
+committed: incoming=100 outgoing=50 joint=50
+`, c.DescribeSideBySide(l))
+
+	// Outside of a joint config, the outgoing majority is empty.
+	c[1] = MajorityConfig{}
+	require.Equal(t, `incoming (1 2 3)        outgoing ()
+       idx              <empty majority quorum>
+x>     100    (id=1)
+xx>    101    (id=2)
+>       99    (id=3)
+committed: incoming=100 outgoing=∞ joint=100
+`, c.DescribeSideBySide(l))
+}
+
+func TestJointDescribeVotes(t *testing.T) {
+	c := JointConfig{
+		MajorityConfig{1: {}, 2: {}, 3: {}},
+		MajorityConfig{1: {}, 4: {}, 5: {}},
+	}
+	votes := map[uint64]bool{1: true, 2: true, 4: false}
+	require.Equal(t, `incoming (1 2 3):
+1: granted
+2: granted
+3: pending
+granted=2 rejected=0 pending=1 quorum=2 result=VoteWon
+outgoing (1 4 5):
+1: granted
+4: rejected
+5: pending
+granted=1 rejected=1 pending=1 quorum=2 result=VotePending
+joint result=VotePending
+`, c.DescribeVotes(votes))
+}
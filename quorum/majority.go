@@ -154,6 +154,65 @@ func (c MajorityConfig) CommittedIndex(l AckedIndexer) Index {
 	return Index(srt[pos])
 }
 
+// CommittedIndexWithDetail is like CommittedIndex, but additionally returns
+// the voters whose acked index is below the committed index, i.e. the voters
+// that held back the commit. The voters are sorted by index, then by ID. Tup.Ok
+// is false for voters which haven't reported an index.
+func (c MajorityConfig) CommittedIndexWithDetail(l AckedIndexer) (Index, []slices.Tup) {
+	n := len(c)
+	if n == 0 {
+		return math.MaxUint64, nil
+	}
+
+	info := make([]slices.Tup, 0, n)
+	for id := range c {
+		idx, ok := l.AckedIndex(id)
+		info = append(info, slices.Tup{ID: id, Idx: uint64(idx), Ok: ok})
+	}
+	slices.SortFuncTup(info, func(a, b slices.Tup) int {
+		if n := slices.CompareUint64(a.Idx, b.Idx); n != 0 {
+			return n
+		}
+		return slices.CompareUint64(a.ID, b.ID)
+	})
+
+	// See CommittedIndex.
+	committed := info[n-(n/2+1)].Idx
+	i := 0
+	for i < n && info[i].Idx < committed {
+		i++
+	}
+	return Index(committed), info[:i:i]
+}
+
+// DescribeVotes returns a (multi-line) representation of the given votes, as
+// passed to VoteResult: one line per voter with its vote (granted, rejected or
+// pending), followed by the tally and the result.
+func (c MajorityConfig) DescribeVotes(votes map[uint64]bool) string {
+	if len(c) == 0 {
+		return fmt.Sprintf("<empty majority quorum>\nresult=%s\n", c.VoteResult(votes))
+	}
+	var buf strings.Builder
+	var granted, rejected, pending int
+	for _, id := range c.Slice() {
+		v, ok := votes[id]
+		switch {
+		case !ok:
+			pending++
+			fmt.Fprintf(&buf, "%d: pending\n", id)
+		case v:
+			granted++
+			fmt.Fprintf(&buf, "%d: granted\n", id)
+		default:
+			rejected++
+			fmt.Fprintf(&buf, "%d: rejected\n", id)
+		}
+	}
+	fmt.Fprintf(&buf, "granted=%d rejected=%d pending=%d quorum=%d result=%s\n",
+		granted, rejected, pending, len(c)/2+1, c.VoteResult(votes))
+	return buf.String()
+}
+
 // VoteResult takes a mapping of voters to yes/no (true/false) votes and returns
 // a result indicating whether the vote is pending (i.e. neither a quorum of
 // yes/no has been reached), won (a quorum of yes has been reached), or lost (a
@@ -0,0 +1,56 @@
+// Copyright 2026 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quorum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.etcd.io/raft/v3/quorum/slices"
+)
+
+func TestMajorityCommittedIndexWithDetail(t *testing.T) {
+	c := MajorityConfig{1: {}, 2: {}, 3: {}, 4: {}, 5: {}}
+	l := mapAckIndexer{1: 10, 2: 7, 3: 12, 4: 10}
+
+	idx, laggards := c.CommittedIndexWithDetail(l)
+	require.Equal(t, Index(10), idx)
+	require.Equal(t, []slices.Tup{
+		{ID: 5, Idx: 0, Ok: false},
+		{ID: 2, Idx: 7, Ok: true},
+	}, laggards)
+
+	idx, laggards = MajorityConfig{}.CommittedIndexWithDetail(l)
+	require.Equal(t, MajorityConfig{}.CommittedIndex(l), idx)
+	require.Empty(t, laggards)
+}
+
+func TestMajorityDescribeVotes(t *testing.T) {
+	c := MajorityConfig{1: {}, 2: {}, 3: {}, 4: {}, 5: {}}
+	// A split vote: two votes each way, and one missing.
+	votes := map[uint64]bool{1: true, 2: false, 3: true, 5: false, 6: true}
+	require.Equal(t, `1: granted
+2: rejected
+3: granted
+4: pending
+5: rejected
+granted=2 rejected=2 pending=1 quorum=3 result=VotePending
+`, c.DescribeVotes(votes))
+
+	votes[4] = false
+	require.Contains(t, c.DescribeVotes(votes), "granted=2 rejected=3 pending=0 quorum=3 result=VoteLost\n")
+	require.Equal(t, "<empty majority quorum>\nresult=VoteWon\n", MajorityConfig{}.DescribeVotes(votes))
+}
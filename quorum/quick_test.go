@@ -41,6 +41,17 @@ func TestQuick(t *testing.T) {
 		}
 		require.NoError(t, quick.CheckEqual(fn1, fn2, cfg))
 	})
+
+	t.Run("majority_commit_detail", func(t *testing.T) {
+		fn1 := func(c memberMap, l idxMap) uint64 {
+			return uint64(MajorityConfig(c).CommittedIndex(mapAckIndexer(l)))
+		}
+		fn2 := func(c memberMap, l idxMap) uint64 {
+			idx, _ := MajorityConfig(c).CommittedIndexWithDetail(mapAckIndexer(l))
+			return uint64(idx)
+		}
+		require.NoError(t, quick.CheckEqual(fn1, fn2, cfg))
+	})
 }
 
 // smallRandIdxMap returns a reasonably sized map of ids to commit indexes.
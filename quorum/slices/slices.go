@@ -18,3 +18,60 @@ type Tup struct {
 func SortFuncTup(x []Tup, f func(a, b Tup) int) {
 	slices.SortFunc(x, f)
 }
+
+// DedupUint64 sorts a and removes duplicates in place, returning the
+// shortened slice.
+func DedupUint64(a []uint64) []uint64 {
+	if len(a) < 2 {
+		return a
+	}
+	slices.Sort(a)
+	return slices.Compact(a)
+}
+
+// DedupStableUint64 removes duplicates from a in place, keeping the first
+// occurrence of each element in its original position relative to the others,
+// and returns the shortened slice.
+func DedupStableUint64(a []uint64) []uint64 {
+	if len(a) < 2 {
+		return a
+	}
+	n := 0
+	if len(a) <= 16 {
+		// Voter lists are small, a quadratic scan beats allocating a set.
+		for _, v := range a {
+			if !slices.Contains(a[:n], v) {
+				a[n] = v
+				n++
+			}
+		}
+	} else {
+		seen := make(map[uint64]struct{}, len(a))
+		for _, v := range a {
+			if _, ok := seen[v]; !ok {
+				seen[v] = struct{}{}
+				a[n] = v
+				n++
+			}
+		}
+	}
+	clear(a[n:])
+	return a[:n]
+}
+
+// BinarySearchUint64 searches for target in the sorted slice a, and returns
+// the position where target is found, or where it would be inserted, and
+// whether it was found. It is equivalent to slices.BinarySearch, but
+// specialized for uint64 so that it is cheap on hot paths.
+func BinarySearchUint64(a []uint64, target uint64) (int, bool) {
+	i, j := 0, len(a)
+	for i < j {
+		h := int(uint(i+j) >> 1) // avoid overflow when computing h
+		if a[h] < target {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	return i, i < len(a) && a[i] == target
+}
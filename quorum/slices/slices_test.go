@@ -0,0 +1,88 @@
+package slices
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupUint64(t *testing.T) {
+	long := make([]uint64, 40)
+	for i := range long {
+		long[i] = uint64(i % 20)
+	}
+	for _, tt := range []struct {
+		in         []uint64
+		want       []uint64
+		wantStable []uint64
+	}{
+		{nil, nil, nil},
+		{[]uint64{}, []uint64{}, []uint64{}},
+		{[]uint64{7}, []uint64{7}, []uint64{7}},
+		{[]uint64{1, 2, 2, 3, 3, 3}, []uint64{1, 2, 3}, []uint64{1, 2, 3}},
+		{[]uint64{3, 3, 2, 1, 1}, []uint64{1, 2, 3}, []uint64{3, 2, 1}},
+		{[]uint64{5, 5, 5, 5}, []uint64{5}, []uint64{5}},
+		{[]uint64{2, 1, 3, 1, 2}, []uint64{1, 2, 3}, []uint64{2, 1, 3}},
+		{long, long[:20], long[:20]},
+	} {
+		t.Run(fmt.Sprint(tt.in), func(t *testing.T) {
+			require.Equal(t, tt.want, DedupUint64(slices.Clone(tt.in)))
+			require.Equal(t, tt.wantStable, DedupStableUint64(slices.Clone(tt.in)))
+		})
+	}
+}
+
+func TestDedupUint64NoAlloc(t *testing.T) {
+	for _, a := range [][]uint64{nil, {1}, {1, 1, 2}} {
+		require.Zero(t, testing.AllocsPerRun(10, func() { DedupUint64(a) }))
+		require.Zero(t, testing.AllocsPerRun(10, func() { DedupStableUint64(a) }))
+	}
+}
+
+func TestBinarySearchUint64(t *testing.T) {
+	for _, a := range [][]uint64{nil, {5}, {1, 3, 5}, {1, 1, 2, 4, 4, 4, 9}} {
+		for target := uint64(0); target <= 10; target++ {
+			wantPos, wantOk := slices.BinarySearch(a, target)
+			pos, ok := BinarySearchUint64(a, target)
+			require.Equal(t, wantPos, pos, "%v %d", a, target)
+			require.Equal(t, wantOk, ok, "%v %d", a, target)
+		}
+	}
+}
+
+// linearSearchUint64 is the linear scan equivalent of BinarySearchUint64.
+func linearSearchUint64(a []uint64, target uint64) (int, bool) {
+	for i, v := range a {
+		if v >= target {
+			return i, v == target
+		}
+	}
+	return len(a), false
+}
+
+// BenchmarkSearchUint64 compares BinarySearchUint64 against a linear scan on
+// slices of the sizes of typical voter sets. When written, the linear scan
+// was faster up to about 32 elements on amd64, and the binary search beyond.
+func BenchmarkSearchUint64(b *testing.B) {
+	for _, n := range []int{1, 3, 5, 7, 9, 16, 32, 64} {
+		a := make([]uint64, n)
+		for i := range a {
+			a[i] = uint64(2 * i)
+		}
+		for _, bb := range []struct {
+			name   string
+			search func([]uint64, uint64) (int, bool)
+		}{
+			{"binary", BinarySearchUint64},
+			{"linear", linearSearchUint64},
+		} {
+			b.Run(fmt.Sprintf("%s/n=%d", bb.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					bb.search(a, uint64(i%(2*n+1)))
+				}
+			})
+		}
+	}
+}
@@ -21,8 +21,10 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	mathrand "math/rand"
 	"strings"
 	"sync"
+	"time"
 
 	"go.etcd.io/raft/v3/confchange"
 	"go.etcd.io/raft/v3/quorum"
@@ -67,6 +69,21 @@ const (
 	ReadOnlyLeaseBased
 )
 
+// VoteTieBreak selects which of several competing candidates a node votes
+// for, see Config.VoteTieBreak.
+type VoteTieBreak int
+
+const (
+	// VoteTieBreakNone votes for the first eligible candidate to ask.
+	VoteTieBreakNone VoteTieBreak = iota
+	// VoteTieBreakLowerID prefers the candidate with the lower ID among
+	// candidates with equally up-to-date logs.
+	VoteTieBreakLowerID
+	// VoteTieBreakHigherID prefers the candidate with the higher ID among
+	// candidates with equally up-to-date logs.
+	VoteTieBreakHigherID
+)
+
 // Possible values for CampaignType
 const (
 	// campaignPreElection represents the first phase of a normal election when
@@ -85,6 +102,10 @@ const noLimit = math.MaxUint64
 // so that the proposer can be notified and fail fast.
 var ErrProposalDropped = errors.New("raft proposal dropped")
 
+// ErrEmptyProposal is returned when a proposal contains a normal entry with
+// empty data, and Config.RejectEmptyProposals is set.
+var ErrEmptyProposal = errors.New("raft: proposal data must not be empty")
+
 // lockedRand is a small wrapper around rand.Rand to provide
 // synchronization among multiple raft groups. Only the methods needed
 // by the code are exposed (e.g. Intn).
@@ -136,6 +157,37 @@ type Config struct {
 	// heartbeats. That is, a leader sends heartbeat messages to maintain its
 	// leadership every HeartbeatTick ticks.
 	HeartbeatTick int
+	// ElectionTimeoutOffset is a number of ticks added to the base election
+	// timeout of this raft group. With the offset, the randomized election
+	// timeout falls in [ElectionTick+ElectionTimeoutOffset,
+	// 2*ElectionTick+ElectionTimeoutOffset-1].
+	//
+	// Processes hosting many raft groups with identical ElectionTick can use
+	// a deterministic per-group offset (for example, derived from the group
+	// ID) to stagger elections across groups after a node failure, avoiding a
+	// thundering herd of simultaneous campaigns. Must be non-negative; 0
+	// preserves the default behavior.
+	ElectionTimeoutOffset int
+	// RandSource, if set, is the source of randomness for the election
+	// timeouts, in place of a global, locked random number generator. A seeded
+	// source makes the timeouts reproducible, e.g. in simulations. It is only
+	// used from the goroutine driving the node, so a source that is not safe
+	// for concurrent use must not be shared with other nodes.
+	RandSource mathrand.Source
+
+	// MaxRejectHintScan, if positive, limits the number of log entries the
+	// leader and followers examine when computing the hint of an MsgApp
+	// rejection. Beyond the limit, the hint only moves the probe back by that
+	// many entries, so resolving a long log conflict may take more round trips.
+	// 0 means no limit.
+	MaxRejectHintScan uint64
+	// OptimalRejectHint makes the leader and followers compute the hint of an
+	// MsgApp rejection by binary searching the terms of their log entries,
+	// rather than scanning the entries one by one. The hint is then exact
+	// regardless of MaxRejectHintScan, so that a log conflict or a gap in the
+	// follower's log is resolved in a single round trip, at the cost of
+	// O(log n) term lookups for a log of n entries.
+	OptimalRejectHint bool
 
 	// Storage is the storage for raft. raft generates entries and states to be
 	// stored in storage. raft reads the persisted entries and states out of
@@ -183,6 +235,13 @@ type Config struct {
 	// for delivering them to the correct target after performing the storage
 	// write.
 	AsyncStorageWrites bool
+	// MaxResponsesPerMessage, if positive, limits the number of responses
+	// attached to a single MsgStorageAppend message with AsyncStorageWrites.
+	// Excess responses are attached, in order, to additional MsgStorageAppend
+	// messages following the first one, which carry nothing else to write.
+	// Since local storage messages are processed in order, the responses are
+	// delivered as without the limit. 0 means no limit.
+	MaxResponsesPerMessage int
 
 	// MaxSizePerMsg limits the max byte size of each append message. Smaller
 	// value lowers the raft recovery cost(initial probing and message lost
@@ -218,6 +277,19 @@ type Config struct {
 	// throughput limit of 10 MB/s for this group. With RTT of 400ms, this drops
 	// to 2.5 MB/s. See Little's law to understand the maths behind.
 	MaxInflightBytes uint64
+	// MaxBytesPerSecondPerPeer, if positive, limits the rate at which the
+	// leader sends entry bytes to each follower. The budget of each follower
+	// is refilled on every tick by the share of TickInterval, up to one second
+	// worth of bytes, and entries are only sent while it is positive. A
+	// message may exceed the remaining budget, which is then paid off by the
+	// following ticks. Throttled entries are sent once the budget refills.
+	// Appends without entries, which convey the commit index and probe the
+	// follower's log, are not throttled.
+	MaxBytesPerSecondPerPeer uint64
+	// TickInterval is the interval at which the application calls Tick. It is
+	// only used to convert MaxBytesPerSecondPerPeer into ticks, and required
+	// if the latter is set.
+	TickInterval time.Duration
 
 	// CheckQuorum specifies if the leader should check quorum activity. Leader
 	// steps down when quorum is not active for an electionTimeout.
@@ -227,6 +299,12 @@ type Config struct {
 	// 9.6. This prevents disruption when a node that has been partitioned away
 	// rejoins the cluster.
 	PreVote bool
+	// PreVoteTick is the base number of ticks a pre-candidate waits for the
+	// outcome of a pre-vote before starting a new one. As with elections, the
+	// actual timeout is randomized, in [PreVoteTick, 2*PreVoteTick-1]. If 0,
+	// the pre-candidate uses the randomized election timeout, see ElectionTick.
+	// Must be non-negative.
+	PreVoteTick int
 
 	// ReadOnlyOption specifies how the read only request is processed.
 	//
@@ -284,6 +362,224 @@ type Config struct {
 	// https://github.com/etcd-io/raft/issues/83
 	StepDownOnRemoval bool
 
+	// TruncateUncommittedOnStepDown makes a leader that steps down discard the
+	// uncommitted entries it appended during its term, to release the memory
+	// held by them. Such entries would eventually be overwritten by the next
+	// leader anyway.
+	//
+	// Only entries which have not been acknowledged by any follower and have
+	// not yet been handed over to the application for persistence (via Ready
+	// or MsgStorageAppend) are discarded. Dropping them is thus equivalent to
+	// the node losing them in a crash, which raft tolerates.
+	TruncateUncommittedOnStepDown bool
+
+	// SyncPolicy, if set, overrides the computation of Ready.MustSync. It is
+	// called with a Ready whose MustSync field holds the default value, and
+	// returns the value to use instead. This allows the application to relax
+	// durability, e.g. for Readys that carry only advisory entries, at the risk
+	// of violating raft's safety guarantees if the relaxed state is lost.
+	SyncPolicy func(rd Ready) bool
+
+	// ReadContextWindow is the number of most recent read contexts remembered
+	// by RawNode.ReadIndexWithContext to detect contexts that are reused. 0,
+	// the default, disables the detection.
+	ReadContextWindow int
+
+	// DedupReadStates makes a ReadIndex request whose context equals that of a
+	// ReadState not yet handed to the application in a Ready produce no
+	// additional ReadState, as is typical for retried reads. The pending
+	// ReadState is kept, as it has the lowest index, which is sufficient for
+	// the retried read as well.
+	DedupReadStates bool
+
+	// AcceptOverlappingAppends makes a follower accept a MsgApp whose entries
+	// start at or below its commit index, as is the case for a slightly stale
+	// MsgApp received right after installing a snapshot. The entries at or
+	// below the commit index are treated as already present, and the rest are
+	// appended. By default, such a MsgApp is only answered with the commit
+	// index, and the leader has to send the entries above it again.
+	AcceptOverlappingAppends bool
+
+	// ReportEmptyEntries makes Ready.EmptyEntryIndexes list the empty entries
+	// among Ready.CommittedEntries, such as those appended by new leaders.
+	ReportEmptyEntries bool
+
+	// SnapshotOnLogBytes, if positive, makes Ready.ShouldSnapshot signal that
+	// the size of the log entries in Storage exceeds this many bytes, as a hint
+	// for the application to create a snapshot and compact the log. The
+	// Storage, or the Storage wrapped by it (see MeteredStorage.Unwrap), must
+	// implement a SizeInBytes() uint64 method, like MemoryStorage does, which
+	// is called for every Ready.
+	SnapshotOnLogBytes uint64
+
+	// MaxMessagesPerReady, if positive, limits the number of messages to other
+	// nodes that a single Ready carries. The excess messages are kept, in
+	// order, for the following Readys. Messages that must be sent after the
+	// Ready's entries are persisted, and messages to the local storage threads
+	// with AsyncStorageWrites, are not limited.
+	MaxMessagesPerReady int
+
+	// OnCommitRegressionAttempt, if set, is called with the sender's ID when a
+	// follower receives an MsgApp whose Commit index is below the follower's
+	// own commit index. The follower never regresses its commit index, so this
+	// is purely informational. Note that delayed or reordered messages from the
+	// leader can legitimately trigger this.
+	OnCommitRegressionAttempt func(from uint64)
+
+	// AutoPromoteLearners makes the leader periodically propose the promotion
+	// of all learners that have caught up with its log. The check runs every
+	// PromotionCheckInterval ticks, and considers a learner caught up if its
+	// Match index is within PromotionLag entries of the leader's last index.
+	// No promotion is proposed while a configuration change is pending or the
+	// configuration is joint. Promoting several learners at once is done via a
+	// joint configuration which is left automatically.
+	AutoPromoteLearners bool
+	// PromotionCheckInterval is the number of ticks between two checks for
+	// learners to promote. Defaults to ElectionTick if AutoPromoteLearners is
+	// set.
+	PromotionCheckInterval int
+	// PromotionLag is the max number of entries a learner's log can lag
+	// behind the leader's last index for it to be promoted.
+	PromotionLag uint64
+
+	// OnEntriesOverwritten, if set, is called on a follower with the entries
+	// that are truncated from its log because they conflict with entries
+	// appended by the leader. The entries must not be mutated.
+	OnEntriesOverwritten func(overwritten []pb.Entry)
+
+	// ReadIndexTimeoutTicks, if positive, is the number of ticks after which
+	// the leader abandons a pending ReadIndex request that it failed to
+	// confirm, e.g. because it can't reach a quorum. Abandoned requests never
+	// produce a ReadState. Only used with ReadOnlySafe.
+	ReadIndexTimeoutTicks int
+	// OnReadIndexTimeout, if set, is called on the leader with the request
+	// context of each ReadIndex request abandoned due to ReadIndexTimeoutTicks.
+	// This includes requests forwarded by followers.
+	OnReadIndexTimeout func(ctx []byte)
+
+	// ForwardReadIndexOnStepDown makes a leader which steps down hand its
+	// pending ReadIndex requests on to the new leader, if known, instead of
+	// dropping them. Requests which cannot be forwarded for lack of a known
+	// leader, whether pending at step down or received later, are answered
+	// with a ReadState with Rejected set if they were made on this node, and
+	// dropped otherwise.
+	ForwardReadIndexOnStepDown bool
+
+	// OnLeaderChange, if set, is called whenever the leader known to this node
+	// changes, including to and from None. It is passed the old and new leader
+	// IDs, and the term at which the new leader is known.
+	OnLeaderChange func(oldLead, newLead uint64, term uint64)
+
+	// SnapshotProvider, if set, is called by the leader to obtain a snapshot
+	// for a follower when the Storage has none available, i.e. returns an
+	// empty snapshot or ErrSnapshotTemporarilyUnavailable. It is passed the
+	// applied index, and must return a snapshot of the state at an index no
+	// lower than Storage.FirstIndex()-1. The result is cached and reused for
+	// other followers while any follower is still receiving a snapshot, as
+	// long as the log is not compacted past it. The cache is dropped when the
+	// node steps down. If the provider returns an error, sending the snapshot
+	// is retried later.
+	SnapshotProvider func(index uint64) (pb.Snapshot, error)
+
+	// SnapshotReadRateTicks, if positive, is the minimum number of ticks
+	// between two snapshot reads by the leader, i.e. calls to
+	// Storage.Snapshot or SnapshotProvider for followers that need a snapshot.
+	// Followers which need a snapshot while reads are throttled are probed
+	// again later, and are sent a snapshot once the interval has elapsed. This
+	// spreads out the I/O when several followers need snapshots at once.
+	SnapshotReadRateTicks int
+
+	// RejectEmptyProposals makes proposals containing a normal entry with
+	// empty data fail with ErrEmptyProposal. By default, such an entry is
+	// appended to the log, where it cannot be told apart from the empty
+	// entries appended by new leaders.
+	RejectEmptyProposals bool
+
+	// LargeEntryWarnBytes, if positive, makes the leader log a warning for
+	// each entry it appends whose payload exceeds this many bytes. The entry
+	// is appended regardless; the warning only points operators at oversized
+	// writes, which can hurt replication latency.
+	LargeEntryWarnBytes uint64
+
+	// VoteTieBreak, if not VoteTieBreakNone, reduces split votes between
+	// candidates that campaign at the same time. A node which has not voted
+	// yet in the term holds back an eligible vote request until its next
+	// tick, rather than granting it right away. Of the requests received in
+	// the meantime, the one from the candidate with the most up-to-date log,
+	// and among equally up-to-date candidates the one with the lower (or
+	// higher) ID, is granted on the tick; the others are rejected. Since all
+	// nodes apply the same rule, they tend to vote for the same candidate.
+	//
+	// This does not affect safety: the node still casts at most one vote per
+	// term, and only for candidates whose log is at least as up-to-date as its
+	// own. Granting a vote is delayed by at most one tick. Pre-votes and votes
+	// for leadership transfers are not held back.
+	VoteTieBreak VoteTieBreak
+
+	// TransferAbortOnElectionTimeout makes a leadership transfer run on the
+	// leader's election timer rather than restarting it: a transfer which has
+	// not completed when the leader's current election timeout fires is
+	// aborted, and the leader resumes accepting proposals. By default, starting
+	// a transfer restarts the election timer, so that the transfer is given a
+	// full election timeout; this also postpones the CheckQuorum check, which
+	// repeated transfer requests can then hold off indefinitely.
+	TransferAbortOnElectionTimeout bool
+
+	// RecordVoteHistory makes the node record the votes it casts, including
+	// for itself, in a bounded history returned by RawNode.VoteHistory.
+	RecordVoteHistory bool
+
+	// SnapshotProgress, if set, is called with the values passed to
+	// RawNode.ReportSnapshotProgress, by which the application reports its
+	// progress applying a snapshot from Ready.Snapshot. Raft does not
+	// interpret the values.
+	SnapshotProgress func(applied, total uint64)
+
+	// CompactionSafetyMargin is the number of entries by which
+	// RawNode.SafeCompactIndex stays below the index that would be needed by
+	// the slowest follower.
+	CompactionSafetyMargin uint64
+
+	// ReproposeUncommittedOnReelection makes a leader that steps down remember
+	// the uncommitted entries it appended during its term, and re-append those
+	// of them that are no longer in its log once it is elected leader again.
+	// Without it, such entries are lost when they are overwritten by another
+	// leader or discarded due to TruncateUncommittedOnStepDown.
+	//
+	// The re-proposed entries are appended under the new term, in their
+	// original order, directly after the empty entry of the new term and thus
+	// before any proposal received by the new leader. Entries that are still
+	// in the log (and may thus still commit at their original index) are not
+	// re-proposed, and neither are entries preceding them. Entries rejected by
+	// MaxUncommittedEntriesSize are dropped. Configuration changes are not
+	// re-proposed, since they may no longer be valid against the current
+	// configuration. Note that an application which retried such a proposal
+	// through another leader may see it applied twice.
+	ReproposeUncommittedOnReelection bool
+
+	// ConfStateMismatchNonFatal makes the node log an error instead of
+	// panicking when the configuration it restores (on startup or from a
+	// snapshot) does not match the ConfState it was given. The node then
+	// continues with the configuration it derived. For a snapshot received in
+	// a MsgSnap, the mismatch is also returned by Step. A mismatch indicates a bug
+	// or corrupted state, and continuing risks acting on an incorrect view of
+	// the membership, e.g. counting the wrong quorum. Only enable this where
+	// crashing the process is worse than that risk.
+	ConfStateMismatchNonFatal bool
+
+	// LeaderNoopData, if set, is called with the new term when this node
+	// becomes leader, and its result is used as the Data of the empty entry
+	// the leader appends at the start of its term. The application sees this
+	// entry as a regular EntryNormal entry and must be able to recognize it.
+	// The data counts against MaxUncommittedEntriesSize like any proposal, but
+	// the entry is never dropped.
+	LeaderNoopData func(term uint64) []byte
+
+	// EventSink, if set, is called synchronously with an Event for every
+	// significant state transition of the node. See EventType for the kinds of
+	// events. It must not call back into the node.
+	EventSink func(Event)
+
 	// raft state tracer
 	TraceLogger TraceLogger
 }
@@ -304,9 +600,47 @@ func (c *Config) validate() error {
 		return errors.New("election tick must be greater than heartbeat tick")
 	}
 
+	if c.ElectionTimeoutOffset < 0 {
+		return errors.New("election timeout offset must be non-negative")
+	}
+
+	if c.PreVoteTick < 0 {
+		return errors.New("pre-vote tick must be non-negative")
+	}
+
+	if c.ReadContextWindow < 0 {
+		return errors.New("read context window must be non-negative")
+	}
+
+	if c.MaxResponsesPerMessage < 0 {
+		return errors.New("max responses per message must be non-negative")
+	}
+
+	if c.MaxMessagesPerReady < 0 {
+		return errors.New("max messages per ready must be non-negative")
+	}
+
 	if c.Storage == nil {
 		return errors.New("storage cannot be nil")
 	}
+	if _, ok := storageLogSizer(c.Storage); c.SnapshotOnLogBytes > 0 && !ok {
+		return errors.New("snapshot on log bytes requires a storage implementing SizeInBytes")
+	}
+
+	if c.ReadIndexTimeoutTicks < 0 {
+		return errors.New("read index timeout ticks must be non-negative")
+	}
+
+	if c.SnapshotReadRateTicks < 0 {
+		return errors.New("snapshot read rate ticks must be non-negative")
+	}
+
+	if c.PromotionCheckInterval < 0 {
+		return errors.New("promotion check interval must be non-negative")
+	}
+	if c.AutoPromoteLearners && c.PromotionCheckInterval == 0 {
+		c.PromotionCheckInterval = c.ElectionTick
+	}
 
 	if c.MaxUncommittedEntriesSize == 0 {
 		c.MaxUncommittedEntriesSize = noLimit
@@ -327,10 +661,18 @@ func (c *Config) validate() error {
 		return errors.New("max inflight bytes must be >= max message size")
 	}
 
+	if c.MaxBytesPerSecondPerPeer > 0 && c.TickInterval <= 0 {
+		return errors.New("tick interval must be positive if max bytes per second per peer is set")
+	}
+
 	if c.Logger == nil {
 		c.Logger = getLogger()
 	}
 
+	if c.PreVoteTick > c.ElectionTick {
+		c.Logger.Warningf("pre-vote tick %d exceeds election tick %d", c.PreVoteTick, c.ElectionTick)
+	}
+
 	if c.ReadOnlyOption == ReadOnlyLeaseBased && !c.CheckQuorum {
 		return errors.New("CheckQuorum must be enabled when ReadOnlyOption is ReadOnlyLeaseBased")
 	}
@@ -351,6 +693,11 @@ type raft struct {
 
 	maxMsgSize         entryEncodingSize
 	maxUncommittedSize entryPayloadSize
+	// maxBytesPerTick and maxSendBudget are the refill per tick and the
+	// capacity of the per-follower send budgets, see
+	// Config.MaxBytesPerSecondPerPeer. Both are zero if it is unset.
+	maxBytesPerTick int64
+	maxSendBudget   int64
 
 	trk tracker.ProgressTracker
 
@@ -376,11 +723,23 @@ type raft struct {
 	// MsgPreVoteResp. See the comment in raft.send for details.
 	msgsAfterAppend []pb.Message
 
+	// msgsSent and msgsRecv count the messages this node has sent to and
+	// received from other nodes, for traffic accounting. Local messages (e.g.
+	// MsgHup, or those exchanged with the storage threads) are not counted.
+	msgsSent uint64
+	msgsRecv uint64
+	// droppedProposals counts the MsgProp messages stepped into this node
+	// that were dropped with ErrProposalDropped.
+	droppedProposals uint64
+
 	// the leader id
 	lead uint64
 	// leadTransferee is id of the leader transfer target when its value is not zero.
 	// Follow the procedure defined in raft thesis 3.10.
 	leadTransferee uint64
+	// transferAbortOnElectionTimeout is set from
+	// Config.TransferAbortOnElectionTimeout.
+	transferAbortOnElectionTimeout bool
 	// Only one conf change may be pending (in the log, but not yet
 	// applied) at a time. This is enforced via pendingConfIndex, which
 	// is set to a value >= the log index of the latest pending
@@ -407,18 +766,91 @@ type raft struct {
 	// number of ticks since it reached last heartbeatTimeout.
 	// only leader keeps heartbeatElapsed.
 	heartbeatElapsed int
+	// number of ticks since the last check for learners to promote. Only
+	// leader keeps promotionElapsed. See Config.AutoPromoteLearners.
+	promotionElapsed int
 
 	checkQuorum bool
 	preVote     bool
 
 	heartbeatTimeout int
 	electionTimeout  int
+	// electionTimeoutOffset is Config.ElectionTimeoutOffset, see there for
+	// details.
+	electionTimeoutOffset int
 	// randomizedElectionTimeout is a random number between
-	// [electiontimeout, 2 * electiontimeout - 1]. It gets reset
-	// when raft changes its state to follower or candidate.
+	// [electiontimeout, 2 * electiontimeout - 1], shifted by
+	// electionTimeoutOffset. It gets reset when raft changes its state to
+	// follower or candidate.
 	randomizedElectionTimeout int
+	// preVoteTimeout is Config.PreVoteTick. If non-zero, it replaces
+	// electionTimeout in randomizedElectionTimeout while in
+	// StatePreCandidate.
+	preVoteTimeout            int
 	disableProposalForwarding bool
 	stepDownOnRemoval         bool
+	// truncateUncommittedOnStepDown is Config.TruncateUncommittedOnStepDown,
+	// see there for details.
+	truncateUncommittedOnStepDown bool
+	dedupReadStates               bool
+	acceptOverlappingAppends      bool
+	confStateMismatchNonFatal     bool
+	maxRejectHintScan             uint64
+	optimalRejectHint             bool
+	leaderNoopData                func(term uint64) []byte
+	// reproposeUncommittedOnReelection is
+	// Config.ReproposeUncommittedOnReelection, see there for details.
+	reproposeUncommittedOnReelection bool
+	// steppedDownUncommitted holds the uncommitted entries appended by this
+	// node during its last term as leader, to be re-proposed when it is
+	// elected again.
+	steppedDownUncommitted []pb.Entry
+	// onCommitRegressionAttempt is Config.OnCommitRegressionAttempt.
+	onCommitRegressionAttempt func(from uint64)
+
+	autoPromoteLearners    bool
+	promotionCheckInterval int
+	promotionLag           uint64
+
+	readIndexTimeoutTicks      int
+	onReadIndexTimeout         func(ctx []byte)
+	forwardReadIndexOnStepDown bool
+
+	onLeaderChange func(oldLead, newLead uint64, term uint64)
+
+	snapshotProvider func(index uint64) (pb.Snapshot, error)
+	// providedSnapshot caches the last snapshot returned by snapshotProvider.
+	// It is dropped on the first heartbeat tick without a follower in
+	// StateSnapshot, and on a term or state change, see reset.
+	providedSnapshot *pb.Snapshot
+
+	snapshotReadRateTicks int
+	rejectEmptyProposals  bool
+	largeEntryWarnBytes   entryPayloadSize
+
+	voteTieBreak VoteTieBreak
+	// deferredVote is the MsgVote held back until the next tick due to
+	// Config.VoteTieBreak, if any.
+	deferredVote *pb.Message
+
+	// voteHistory is a ring buffer of the most recent votes cast by this node,
+	// non-nil only if Config.RecordVoteHistory is set. voteHistoryNext is the
+	// position of the next record in it.
+	voteHistory     []VoteRecord
+	voteHistoryNext int
+	// snapshotReadElapsed is the number of ticks since the leader last read a
+	// snapshot, capped at snapshotReadRateTicks.
+	snapshotReadElapsed int
+
+	compactionSafetyMargin uint64
+
+	eventSink func(Event)
+	// emittedCommit is the commit index last passed to eventSink.
+	emittedCommit uint64
+
+	// rand randomizes the election timeouts. It is globalRand unless
+	// Config.RandSource is set.
+	rand interface{ Intn(n int) int }
 
 	tick func()
 	step stepFunc
@@ -439,29 +871,70 @@ func newRaft(c *Config) *raft {
 		panic(err.Error())
 	}
 	raftlog := newLogWithSize(c.Storage, c.Logger, entryEncodingSize(c.MaxCommittedSizePerReady))
+	raftlog.onEntriesOverwritten = c.OnEntriesOverwritten
 	hs, cs, err := c.Storage.InitialState()
 	if err != nil {
 		panic(err) // TODO(bdarnell)
 	}
 
 	r := &raft{
-		id:                          c.ID,
-		lead:                        None,
-		isLearner:                   false,
-		raftLog:                     raftlog,
-		maxMsgSize:                  entryEncodingSize(c.MaxSizePerMsg),
-		maxUncommittedSize:          entryPayloadSize(c.MaxUncommittedEntriesSize),
-		trk:                         tracker.MakeProgressTracker(c.MaxInflightMsgs, c.MaxInflightBytes),
-		electionTimeout:             c.ElectionTick,
-		heartbeatTimeout:            c.HeartbeatTick,
-		logger:                      c.Logger,
-		checkQuorum:                 c.CheckQuorum,
-		preVote:                     c.PreVote,
-		readOnly:                    newReadOnly(c.ReadOnlyOption),
-		disableProposalForwarding:   c.DisableProposalForwarding,
-		disableConfChangeValidation: c.DisableConfChangeValidation,
-		stepDownOnRemoval:           c.StepDownOnRemoval,
-		traceLogger:                 c.TraceLogger,
+		id:                               c.ID,
+		lead:                             None,
+		isLearner:                        false,
+		raftLog:                          raftlog,
+		maxMsgSize:                       entryEncodingSize(c.MaxSizePerMsg),
+		maxUncommittedSize:               entryPayloadSize(c.MaxUncommittedEntriesSize),
+		trk:                              tracker.MakeProgressTracker(c.MaxInflightMsgs, c.MaxInflightBytes),
+		electionTimeout:                  c.ElectionTick,
+		electionTimeoutOffset:            c.ElectionTimeoutOffset,
+		preVoteTimeout:                   c.PreVoteTick,
+		heartbeatTimeout:                 c.HeartbeatTick,
+		logger:                           c.Logger,
+		checkQuorum:                      c.CheckQuorum,
+		preVote:                          c.PreVote,
+		readOnly:                         newReadOnly(c.ReadOnlyOption),
+		disableProposalForwarding:        c.DisableProposalForwarding,
+		disableConfChangeValidation:      c.DisableConfChangeValidation,
+		stepDownOnRemoval:                c.StepDownOnRemoval,
+		truncateUncommittedOnStepDown:    c.TruncateUncommittedOnStepDown,
+		reproposeUncommittedOnReelection: c.ReproposeUncommittedOnReelection,
+		dedupReadStates:                  c.DedupReadStates,
+		acceptOverlappingAppends:         c.AcceptOverlappingAppends,
+		confStateMismatchNonFatal:        c.ConfStateMismatchNonFatal,
+		maxRejectHintScan:                c.MaxRejectHintScan,
+		optimalRejectHint:                c.OptimalRejectHint,
+		leaderNoopData:                   c.LeaderNoopData,
+		onCommitRegressionAttempt:        c.OnCommitRegressionAttempt,
+		autoPromoteLearners:              c.AutoPromoteLearners,
+		promotionCheckInterval:           c.PromotionCheckInterval,
+		promotionLag:                     c.PromotionLag,
+		readIndexTimeoutTicks:            c.ReadIndexTimeoutTicks,
+		onReadIndexTimeout:               c.OnReadIndexTimeout,
+		forwardReadIndexOnStepDown:       c.ForwardReadIndexOnStepDown,
+		onLeaderChange:                   c.OnLeaderChange,
+		snapshotProvider:                 c.SnapshotProvider,
+		snapshotReadRateTicks:            c.SnapshotReadRateTicks,
+		snapshotReadElapsed:              c.SnapshotReadRateTicks,
+		rejectEmptyProposals:             c.RejectEmptyProposals,
+		largeEntryWarnBytes:              entryPayloadSize(c.LargeEntryWarnBytes),
+		voteTieBreak:                     c.VoteTieBreak,
+		transferAbortOnElectionTimeout:   c.TransferAbortOnElectionTimeout,
+		compactionSafetyMargin:           c.CompactionSafetyMargin,
+		eventSink:                        c.EventSink,
+		traceLogger:                      c.TraceLogger,
+	}
+
+	if c.MaxBytesPerSecondPerPeer > 0 {
+		r.maxSendBudget = int64(c.MaxBytesPerSecondPerPeer)
+		r.maxBytesPerTick = max(int64(c.MaxBytesPerSecondPerPeer*uint64(c.TickInterval)/uint64(time.Second)), 1)
+	}
+	if c.RecordVoteHistory {
+		r.voteHistory = make([]VoteRecord, 0, voteHistorySize)
+	}
+	if c.RandSource != nil {
+		r.rand = mathrand.New(c.RandSource)
+	} else {
+		r.rand = globalRand
 	}
 
 	traceInitState(r)
@@ -474,7 +947,11 @@ func newRaft(c *Config) *raft {
 	if err != nil {
 		panic(err)
 	}
-	assertConfStatesEquivalent(r.logger, cs, r.switchToConfig(cfg, trk))
+	if err := assertConfStatesEquivalent(r.logger, cs, r.switchToConfig(cfg, trk), r.confStateMismatchNonFatal); err != nil {
+		// See Config.ConfStateMismatchNonFatal.
+		r.logger.Errorf("%x continuing with configuration %s restored from mismatching ConfState: %v",
+			r.id, r.trk.Config, err)
+	}
 
 	if !IsEmptyHardState(hs) {
 		r.loadState(hs)
@@ -482,6 +959,7 @@ func newRaft(c *Config) *raft {
 	if c.Applied > 0 {
 		raftlog.appliedTo(c.Applied, 0 /* size */)
 	}
+	r.emittedCommit = r.raftLog.committed
 	r.becomeFollower(r.Term, None)
 
 	var nodesStrs []string
@@ -588,12 +1066,16 @@ func (r *raft) send(m pb.Message) {
 		// we err on the side of safety and omit a `&& !m.Reject` condition
 		// above.
 		r.msgsAfterAppend = append(r.msgsAfterAppend, m)
+		if m.To != r.id {
+			r.msgsSent++
+		}
 		traceSendMessage(r, &m)
 	} else {
 		if m.To == r.id {
 			r.logger.Panicf("message should not be self-addressed when sending %s", m.Type)
 		}
 		r.msgs = append(r.msgs, m)
+		r.msgsSent++
 		traceSendMessage(r, &m)
 	}
 }
@@ -634,8 +1116,17 @@ func (r *raft) maybeSendAppend(to uint64, sendIfEmpty bool) bool {
 	// MsgApp will eventually reach the follower (heartbeats responses prompt the
 	// leader to send an append), allowing it to be acked or rejected, both of
 	// which will clear out Inflights.
-	if pr.State != tracker.StateReplicate || !pr.Inflights.Full() {
-		ents, err = r.raftLog.entries(pr.Next, r.maxMsgSize)
+	//
+	// Likewise, with a used up send budget only empty MsgApp are sent, which
+	// convey the commit index and let probing proceed. The entries are sent
+	// once the budget is refilled on a tick, see refillSendBudgets.
+	throttled := r.maxBytesPerTick > 0 && pr.SendBudget <= 0
+	if (pr.State != tracker.StateReplicate || !pr.Inflights.Full()) && !throttled {
+		maxSize := r.maxMsgSize
+		if r.maxBytesPerTick > 0 {
+			maxSize = min(maxSize, entryEncodingSize(pr.SendBudget))
+		}
+		ents, err = r.raftLog.entries(pr.Next, maxSize)
 	}
 	if len(ents) == 0 && !sendIfEmpty {
 		return false
@@ -656,9 +1147,26 @@ func (r *raft) maybeSendAppend(to uint64, sendIfEmpty bool) bool {
 	})
 	pr.SentEntries(len(ents), uint64(payloadsSize(ents)))
 	pr.SentCommit(r.raftLog.committed)
+	if r.maxBytesPerTick > 0 {
+		pr.SendBudget -= int64(entsSize(ents))
+	}
 	return true
 }
 
+// refillSendBudgets refills the send budgets of the followers by one tick's
+// worth, and sends pending entries within the new budgets.
+func (r *raft) refillSendBudgets() {
+	r.trk.Visit(func(id uint64, pr *tracker.Progress) {
+		if id == r.id {
+			return
+		}
+		pr.SendBudget = min(pr.SendBudget+r.maxBytesPerTick, r.maxSendBudget)
+		if pr.SendBudget > 0 {
+			r.maybeSendAppend(id, false /* sendIfEmpty */)
+		}
+	})
+}
+
 // maybeSendSnapshot fetches a snapshot from Storage, and sends it to the given
 // node. Returns true iff the snapshot message has been emitted successfully.
 func (r *raft) maybeSendSnapshot(to uint64, pr *tracker.Progress) bool {
@@ -666,8 +1174,18 @@ func (r *raft) maybeSendSnapshot(to uint64, pr *tracker.Progress) bool {
 		r.logger.Debugf("ignore sending snapshot to %x since it is not recently active", to)
 		return false
 	}
+	if r.snapshotReadElapsed < r.snapshotReadRateTicks {
+		r.logger.Debugf("%x delays sending snapshot to %x since snapshot reads are throttled", r.id, to)
+		return false
+	}
 
 	snapshot, err := r.raftLog.snapshot()
+	if r.snapshotProvider != nil && (err == ErrSnapshotTemporarilyUnavailable || err == nil && IsEmptySnap(snapshot)) {
+		if snapshot, err = r.provideSnapshot(); err != nil {
+			r.logger.Debugf("%x failed to send snapshot to %x because snapshot provider failed: %v", r.id, to, err)
+			return false
+		}
+	}
 	if err != nil {
 		if err == ErrSnapshotTemporarilyUnavailable {
 			r.logger.Debugf("%x failed to send snapshot to %x because snapshot is temporarily unavailable", r.id, to)
@@ -678,6 +1196,9 @@ func (r *raft) maybeSendSnapshot(to uint64, pr *tracker.Progress) bool {
 	if IsEmptySnap(snapshot) {
 		panic("need non-empty snapshot")
 	}
+	// Only a snapshot actually read delays the next one, so that a failed read
+	// is retried as soon as possible.
+	r.snapshotReadElapsed = 0
 	sindex, sterm := snapshot.Metadata.Index, snapshot.Metadata.Term
 	r.logger.Debugf("%x [firstindex: %d, commit: %d] sent snapshot[index: %d, term: %d] to %x [%s]",
 		r.id, r.raftLog.firstIndex(), r.raftLog.committed, sindex, sterm, to, pr)
@@ -685,9 +1206,34 @@ func (r *raft) maybeSendSnapshot(to uint64, pr *tracker.Progress) bool {
 	r.logger.Debugf("%x paused sending replication messages to %x [%s]", r.id, to, pr)
 
 	r.send(pb.Message{To: to, Type: pb.MsgSnap, Snapshot: &snapshot})
+	r.emit(Event{Type: EventSnapshotSent, Peer: to, Index: sindex})
 	return true
 }
 
+// provideSnapshot returns a snapshot obtained from Config.SnapshotProvider,
+// reusing the cached one if the log has not been compacted past it.
+func (r *raft) provideSnapshot() (pb.Snapshot, error) {
+	if s := r.providedSnapshot; s != nil && s.Metadata.Index+1 >= r.raftLog.firstIndex() {
+		return *s, nil
+	}
+	snapshot, err := r.snapshotProvider(r.raftLog.applied)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	r.providedSnapshot = &snapshot
+	return snapshot, nil
+}
+
+// sendingSnapshot returns true if any follower is in StateSnapshot.
+func (r *raft) sendingSnapshot() bool {
+	for _, pr := range r.trk.Progress {
+		if pr.State == tracker.StateSnapshot {
+			return true
+		}
+	}
+	return false
+}
+
 // sendHeartbeat sends a heartbeat RPC to the given peer.
 func (r *raft) sendHeartbeat(to uint64, ctx []byte) {
 	pr := r.trk.Progress[to]
@@ -786,10 +1332,12 @@ func (r *raft) reset(term uint64) {
 		r.Term = term
 		r.Vote = None
 	}
-	r.lead = None
 
+	r.deferredVote = nil
+	r.providedSnapshot = nil
 	r.electionElapsed = 0
 	r.heartbeatElapsed = 0
+	r.promotionElapsed = 0
 	r.resetRandomizedElectionTimeout()
 
 	r.abortLeaderTransfer()
@@ -827,6 +1375,14 @@ func (r *raft) appendEntry(es ...pb.Entry) (accepted bool) {
 		// Drop the proposal.
 		return false
 	}
+	if r.largeEntryWarnBytes > 0 {
+		for i := range es {
+			if s := payloadSize(es[i]); s > r.largeEntryWarnBytes {
+				r.logger.Warningf("%x appending large entry at index %d term %d: %d bytes (warn threshold %d)",
+					r.id, es[i].Index, es[i].Term, s, r.largeEntryWarnBytes)
+			}
+		}
+	}
 
 	traceReplicate(r, es...)
 
@@ -848,6 +1404,7 @@ func (r *raft) appendEntry(es ...pb.Entry) (accepted bool) {
 
 // tickElection is run by followers and candidates after r.electionTimeout.
 func (r *raft) tickElection() {
+	r.resolveDeferredVote()
 	r.electionElapsed++
 
 	if r.promotable() && r.pastElectionTimeout() {
@@ -862,6 +1419,9 @@ func (r *raft) tickElection() {
 func (r *raft) tickHeartbeat() {
 	r.heartbeatElapsed++
 	r.electionElapsed++
+	if r.snapshotReadElapsed < r.snapshotReadRateTicks {
+		r.snapshotReadElapsed++
+	}
 
 	if r.electionElapsed >= r.electionTimeout {
 		r.electionElapsed = 0
@@ -880,23 +1440,181 @@ func (r *raft) tickHeartbeat() {
 		return
 	}
 
+	if r.maxBytesPerTick > 0 {
+		r.refillSendBudgets()
+	}
+	if r.providedSnapshot != nil && !r.sendingSnapshot() {
+		r.providedSnapshot = nil
+	}
+
 	if r.heartbeatElapsed >= r.heartbeatTimeout {
 		r.heartbeatElapsed = 0
 		if err := r.Step(pb.Message{From: r.id, Type: pb.MsgBeat}); err != nil {
 			r.logger.Debugf("error occurred during checking sending heartbeat: %v", err)
 		}
 	}
+
+	if r.readIndexTimeoutTicks > 0 {
+		r.readOnly.tick()
+		for _, rs := range r.readOnly.expire(r.readIndexTimeoutTicks) {
+			r.logger.Debugf("%x abandoned read index request from %x at index %d after %d ticks",
+				r.id, rs.req.From, rs.index, r.readIndexTimeoutTicks)
+			if r.onReadIndexTimeout != nil {
+				r.onReadIndexTimeout(rs.req.Entries[0].Data)
+			}
+		}
+	}
+
+	if r.autoPromoteLearners {
+		r.promotionElapsed++
+		if r.promotionElapsed >= r.promotionCheckInterval {
+			r.promotionElapsed = 0
+			r.maybePromoteLearners()
+		}
+	}
+}
+
+// maybePromoteLearners proposes the promotion of all learners whose logs are
+// within promotionLag entries of the leader's log, unless a configuration
+// change is pending or the configuration is joint. See
+// Config.AutoPromoteLearners.
+func (r *raft) maybePromoteLearners() {
+	if r.pendingConfIndex > r.raftLog.applied || len(r.trk.Config.Voters[1]) > 0 {
+		return
+	}
+	lastIndex := r.raftLog.lastIndex()
+	var cc pb.ConfChangeV2
+	for _, id := range r.trk.LearnerNodes() {
+		if pr := r.trk.Progress[id]; pr.Match+r.promotionLag >= lastIndex {
+			cc.Changes = append(cc.Changes, pb.ConfChangeSingle{Type: pb.ConfChangeAddNode, NodeID: id})
+		}
+	}
+	if len(cc.Changes) == 0 {
+		return
+	}
+	m, err := confChangeToMsg(cc)
+	if err != nil {
+		panic(err)
+	}
+	if err := r.Step(m); err != nil {
+		r.logger.Debugf("%x not promoting caught-up learners %v: %v", r.id, cc.Changes, err)
+		return
+	}
+	r.logger.Infof("%x proposed promotion of caught-up learners %v", r.id, cc.Changes)
+}
+
+// setLead updates the known leader, and notifies Config.OnLeaderChange if it
+// has changed.
+func (r *raft) setLead(lead uint64) {
+	if r.lead == lead {
+		return
+	}
+	old := r.lead
+	r.lead = lead
+	if r.onLeaderChange != nil {
+		r.onLeaderChange(old, lead, r.Term)
+	}
+	r.emit(Event{Type: EventLeaderChange, Lead: lead, PrevLead: old})
 }
 
 func (r *raft) becomeFollower(term uint64, lead uint64) {
+	if r.state == StateLeader && r.reproposeUncommittedOnReelection {
+		r.stashUncommitted()
+	}
+	if r.state == StateLeader && r.truncateUncommittedOnStepDown {
+		r.truncateUncommittedTail()
+	}
+	var reads []pb.Message
+	if r.state == StateLeader && r.forwardReadIndexOnStepDown {
+		reads = append(r.readOnly.pendingRequests(), r.pendingReadIndexMessages...)
+	}
 	r.step = stepFollower
 	r.reset(term)
 	r.tick = r.tickElection
-	r.lead = lead
+	r.setLead(lead)
 	r.state = StateFollower
 	r.logger.Infof("%x became follower at term %d", r.id, r.Term)
 
 	traceBecomeFollower(r)
+	for _, m := range reads {
+		r.forwardReadIndex(m)
+	}
+}
+
+// truncateUncommittedTail discards the uncommitted entries appended by this
+// leader that no follower has acknowledged and that have not been handed over
+// for persistence yet. Must be called in StateLeader, before the progress is
+// reset. See Config.TruncateUncommittedOnStepDown.
+func (r *raft) truncateUncommittedTail() {
+	acked := r.raftLog.committed
+	r.trk.Visit(func(id uint64, pr *tracker.Progress) {
+		if id != r.id {
+			acked = max(acked, pr.Match)
+		}
+	})
+	if n := r.raftLog.truncateUnpersisted(acked, r.Term); n > 0 {
+		r.logger.Infof("%x discarded %d uncommitted entries after index %d on stepping down at term %d",
+			r.id, n, acked, r.Term)
+	}
+}
+
+// stashUncommitted remembers the uncommitted non-empty normal entries appended
+// by this leader in its current term. Must be called in StateLeader. See
+// Config.ReproposeUncommittedOnReelection.
+func (r *raft) stashUncommitted() {
+	r.steppedDownUncommitted = nil
+	ents, err := r.raftLog.slice(r.raftLog.committed+1, r.raftLog.lastIndex()+1, noLimit)
+	if err != nil {
+		r.logger.Panicf("%x unexpected error getting uncommitted entries (%v)", r.id, err)
+	}
+	prevTerm := r.raftLog.zeroTermOnOutOfBounds(r.raftLog.term(r.raftLog.committed))
+	for _, e := range ents {
+		// The first entry of the term is the leader's empty entry, which may
+		// carry Config.LeaderNoopData.
+		noop := e.Term == r.Term && prevTerm != r.Term
+		prevTerm = e.Term
+		// Configuration changes are not re-proposed: they would bypass the
+		// checks in stepLeader, and may not apply to the configuration in
+		// effect when the node is re-elected.
+		if e.Term != r.Term || noop || e.Type != pb.EntryNormal || len(e.Data) == 0 {
+			continue
+		}
+		r.steppedDownUncommitted = append(r.steppedDownUncommitted, e)
+	}
+}
+
+// reproposeUncommitted re-appends the entries remembered by stashUncommitted
+// that are no longer in the log. Must be called in StateLeader, after the
+// empty entry of the new term has been appended.
+func (r *raft) reproposeUncommitted() {
+	stashed := r.steppedDownUncommitted
+	r.steppedDownUncommitted = nil
+	// By the Log Matching Property, once a stashed entry is missing from the
+	// log, all the following ones are missing as well. An entry that can't be
+	// looked up because the log was compacted past it is treated as present,
+	// since it may have been committed.
+	for len(stashed) > 0 {
+		t, err := r.raftLog.term(stashed[0].Index)
+		if err == ErrUnavailable || (err == nil && t != stashed[0].Term) {
+			break
+		} else if err != nil && err != ErrCompacted {
+			r.logger.Panicf("%x unexpected error getting term at index %d (%v)", r.id, stashed[0].Index, err)
+		}
+		stashed = stashed[1:]
+	}
+	if len(stashed) == 0 {
+		return
+	}
+	ents := make([]pb.Entry, len(stashed))
+	for i := range stashed {
+		ents[i] = pb.Entry{Type: stashed[i].Type, Data: stashed[i].Data}
+	}
+	if !r.appendEntry(ents...) {
+		r.logger.Warningf("%x dropped %d uncommitted entries of a previous term", r.id, len(ents))
+		return
+	}
+	r.logger.Infof("%x re-proposed %d uncommitted entries of a previous term at index %d",
+		r.id, len(ents), ents[0].Index)
 }
 
 func (r *raft) becomeCandidate() {
@@ -907,7 +1625,9 @@ func (r *raft) becomeCandidate() {
 	r.step = stepCandidate
 	r.reset(r.Term + 1)
 	r.tick = r.tickElection
+	r.setLead(None)
 	r.Vote = r.id
+	r.recordVote()
 	r.state = StateCandidate
 	r.logger.Infof("%x became candidate at term %d", r.id, r.Term)
 
@@ -925,7 +1645,11 @@ func (r *raft) becomePreCandidate() {
 	r.step = stepCandidate
 	r.trk.ResetVotes()
 	r.tick = r.tickElection
-	r.lead = None
+	if r.preVoteTimeout > 0 {
+		r.electionElapsed = 0
+		r.randomizedElectionTimeout = r.preVoteTimeout + r.rand.Intn(r.preVoteTimeout)
+	}
+	r.setLead(None)
 	r.state = StatePreCandidate
 	r.logger.Infof("%x became pre-candidate at term %d", r.id, r.Term)
 }
@@ -938,7 +1662,7 @@ func (r *raft) becomeLeader() {
 	r.step = stepLeader
 	r.reset(r.Term)
 	r.tick = r.tickHeartbeat
-	r.lead = r.id
+	r.setLead(r.id)
 	r.state = StateLeader
 	// Followers enter replicate mode when they've been successfully probed
 	// (perhaps after having received a snapshot as a result). The leader is
@@ -949,6 +1673,8 @@ func (r *raft) becomeLeader() {
 	// The leader always has RecentActive == true; MsgCheckQuorum makes sure to
 	// preserve this.
 	pr.RecentActive = true
+	// Snapshot reads are not throttled until the new leader makes one.
+	r.snapshotReadElapsed = r.snapshotReadRateTicks
 
 	// Conservatively set the pendingConfIndex to the last index in the
 	// log. There may or may not be a pending config change, but it's
@@ -959,6 +1685,9 @@ func (r *raft) becomeLeader() {
 
 	traceBecomeLeader(r)
 	emptyEnt := pb.Entry{Data: nil}
+	if r.leaderNoopData != nil {
+		emptyEnt.Data = r.leaderNoopData(r.Term)
+	}
 	if !r.appendEntry(emptyEnt) {
 		// This won't happen because we just called reset() above.
 		r.logger.Panic("empty entry was dropped")
@@ -966,7 +1695,12 @@ func (r *raft) becomeLeader() {
 	// The payloadSize of an empty entry is 0 (see TestPayloadSizeOfEmptyEntry),
 	// so the preceding log append does not count against the uncommitted log
 	// quota of the new leader. In other words, after the call to appendEntry,
-	// r.uncommittedSize is still 0.
+	// r.uncommittedSize is still 0. With Config.LeaderNoopData, the entry may
+	// be non-empty, but appendEntry accepts any size while r.uncommittedSize
+	// is 0.
+	if len(r.steppedDownUncommitted) > 0 {
+		r.reproposeUncommitted()
+	}
 	r.logger.Infof("%x became leader at term %d", r.id, r.Term)
 }
 
@@ -989,17 +1723,54 @@ func (r *raft) hup(t CampaignType) {
 	r.campaign(t)
 }
 
+// voteHistorySize is the number of votes kept with Config.RecordVoteHistory.
+const voteHistorySize = 64
+
+// VoteRecord is a vote cast by a node, see Config.RecordVoteHistory.
+type VoteRecord struct {
+	Term     uint64
+	VotedFor uint64
+}
+
+// recordVote adds the current vote to the vote history, if it is enabled. A
+// repeated vote for the same node in the same term is not recorded again.
+func (r *raft) recordVote() {
+	if r.voteHistory == nil {
+		return
+	}
+	rec := VoteRecord{Term: r.Term, VotedFor: r.Vote}
+	if n := len(r.voteHistory); n > 0 && r.lastVoteRecord() == rec {
+		return
+	} else if n < cap(r.voteHistory) {
+		r.voteHistory = append(r.voteHistory, rec)
+	} else {
+		r.voteHistory[r.voteHistoryNext] = rec
+	}
+	r.voteHistoryNext = (r.voteHistoryNext + 1) % cap(r.voteHistory)
+}
+
+// lastVoteRecord returns the most recent record of a non-empty vote history.
+func (r *raft) lastVoteRecord() VoteRecord {
+	return r.voteHistory[(r.voteHistoryNext+cap(r.voteHistory)-1)%cap(r.voteHistory)]
+}
+
 // errBreak is a sentinel error used to break a callback-based loop.
 var errBreak = errors.New("break")
 
 func (r *raft) hasUnappliedConfChanges() bool {
-	if r.raftLog.applied >= r.raftLog.committed { // in fact applied == committed
+	return r.hasConfChangesAfterApplied(r.raftLog.committed)
+}
+
+// hasConfChangesAfterApplied returns true if there is a config change entry
+// in the log in (applied, last].
+func (r *raft) hasConfChangesAfterApplied(last uint64) bool {
+	if r.raftLog.applied >= last {
 		return false
 	}
 	found := false
-	// Scan all unapplied committed entries to find a config change. Paginate the
-	// scan, to avoid a potentially unlimited memory spike.
-	lo, hi := r.raftLog.applied+1, r.raftLog.committed+1
+	// Scan all unapplied entries up to last to find a config change. Paginate
+	// the scan, to avoid a potentially unlimited memory spike.
+	lo, hi := r.raftLog.applied+1, last+1
 	// Reuse the maxApplyingEntsSize limit because it is used for similar purposes
 	// (limiting the read of unapplied committed entries) when raft sends entries
 	// via the Ready struct for application.
@@ -1082,8 +1853,23 @@ func (r *raft) poll(id uint64, t pb.MessageType, v bool) (granted int, rejected
 	return r.trk.TallyVotes()
 }
 
-func (r *raft) Step(m pb.Message) error {
+func (r *raft) Step(m pb.Message) (err error) {
 	traceReceiveMessage(r, &m)
+	if r.eventSink != nil || m.Type == pb.MsgProp {
+		defer func() {
+			if m.Type == pb.MsgProp && err == ErrProposalDropped {
+				r.droppedProposals++
+				r.emit(Event{Type: EventProposalDropped, Entries: len(m.Entries)})
+			}
+			r.emitCommitAdvance()
+		}()
+	}
+	if m.From != None && m.From != r.id && !IsLocalMsg(m.Type) {
+		r.msgsRecv++
+	}
+	if m.Type == pb.MsgProp && r.rejectEmptyProposals && hasEmptyNormalEntry(m.Entries) {
+		return ErrEmptyProposal
+	}
 
 	// Handle the message term, which may result in our stepping down to a follower.
 	switch {
@@ -1202,55 +1988,10 @@ func (r *raft) Step(m pb.Message) error {
 		}
 
 	case pb.MsgVote, pb.MsgPreVote:
-		// We can vote if this is a repeat of a vote we've already cast...
-		canVote := r.Vote == m.From ||
-			// ...we haven't voted and we don't think there's a leader yet in this term...
-			(r.Vote == None && r.lead == None) ||
-			// ...or this is a PreVote for a future term...
-			(m.Type == pb.MsgPreVote && m.Term > r.Term)
-		// ...and we believe the candidate is up to date.
-		lastID := r.raftLog.lastEntryID()
-		candLastID := entryID{term: m.LogTerm, index: m.Index}
-		if canVote && r.raftLog.isUpToDate(candLastID) {
-			// Note: it turns out that that learners must be allowed to cast votes.
-			// This seems counter- intuitive but is necessary in the situation in which
-			// a learner has been promoted (i.e. is now a voter) but has not learned
-			// about this yet.
-			// For example, consider a group in which id=1 is a learner and id=2 and
-			// id=3 are voters. A configuration change promoting 1 can be committed on
-			// the quorum `{2,3}` without the config change being appended to the
-			// learner's log. If the leader (say 2) fails, there are de facto two
-			// voters remaining. Only 3 can win an election (due to its log containing
-			// all committed entries), but to do so it will need 1 to vote. But 1
-			// considers itself a learner and will continue to do so until 3 has
-			// stepped up as leader, replicates the conf change to 1, and 1 applies it.
-			// Ultimately, by receiving a request to vote, the learner realizes that
-			// the candidate believes it to be a voter, and that it should act
-			// accordingly. The candidate's config may be stale, too; but in that case
-			// it won't win the election, at least in the absence of the bug discussed
-			// in:
-			// https://github.com/etcd-io/etcd/issues/7625#issuecomment-488798263.
-			r.logger.Infof("%x [logterm: %d, index: %d, vote: %x] cast %s for %x [logterm: %d, index: %d] at term %d",
-				r.id, lastID.term, lastID.index, r.Vote, m.Type, m.From, candLastID.term, candLastID.index, r.Term)
-			// When responding to Msg{Pre,}Vote messages we include the term
-			// from the message, not the local term. To see why, consider the
-			// case where a single node was previously partitioned away and
-			// it's local term is now out of date. If we include the local term
-			// (recall that for pre-votes we don't update the local term), the
-			// (pre-)campaigning node on the other end will proceed to ignore
-			// the message (it ignores all out of date messages).
-			// The term in the original message and current local term are the
-			// same in the case of regular votes, but different for pre-votes.
-			r.send(pb.Message{To: m.From, Term: m.Term, Type: voteRespMsgType(m.Type)})
-			if m.Type == pb.MsgVote {
-				// Only record real votes.
-				r.electionElapsed = 0
-				r.Vote = m.From
-			}
+		if r.shouldDeferVote(m) {
+			r.deferVote(m)
 		} else {
-			r.logger.Infof("%x [logterm: %d, index: %d, vote: %x] rejected %s from %x [logterm: %d, index: %d] at term %d",
-				r.id, lastID.term, lastID.index, r.Vote, m.Type, m.From, candLastID.term, candLastID.index, r.Term)
-			r.send(pb.Message{To: m.From, Term: r.Term, Type: voteRespMsgType(m.Type), Reject: true})
+			r.grantOrRejectVote(m)
 		}
 
 	default:
@@ -1262,6 +2003,132 @@ func (r *raft) Step(m pb.Message) error {
 	return nil
 }
 
+// canGrantVote returns true if the node is able to grant the given vote
+// request.
+func (r *raft) canGrantVote(m pb.Message) bool {
+	// We can vote if this is a repeat of a vote we've already cast...
+	canVote := r.Vote == m.From ||
+		// ...we haven't voted and we don't think there's a leader yet in this term...
+		(r.Vote == None && r.lead == None) ||
+		// ...or this is a PreVote for a future term...
+		(m.Type == pb.MsgPreVote && m.Term > r.Term)
+	// ...and we believe the candidate is up to date.
+	return canVote && r.raftLog.isUpToDate(entryID{term: m.LogTerm, index: m.Index})
+}
+
+// grantOrRejectVote responds to the given MsgVote or MsgPreVote, granting the
+// vote if the node is able to.
+func (r *raft) grantOrRejectVote(m pb.Message) {
+	lastID := r.raftLog.lastEntryID()
+	candLastID := entryID{term: m.LogTerm, index: m.Index}
+	if r.canGrantVote(m) {
+		// Note: it turns out that that learners must be allowed to cast votes.
+		// This seems counter- intuitive but is necessary in the situation in which
+		// a learner has been promoted (i.e. is now a voter) but has not learned
+		// about this yet.
+		// For example, consider a group in which id=1 is a learner and id=2 and
+		// id=3 are voters. A configuration change promoting 1 can be committed on
+		// the quorum `{2,3}` without the config change being appended to the
+		// learner's log. If the leader (say 2) fails, there are de facto two
+		// voters remaining. Only 3 can win an election (due to its log containing
+		// all committed entries), but to do so it will need 1 to vote. But 1
+		// considers itself a learner and will continue to do so until 3 has
+		// stepped up as leader, replicates the conf change to 1, and 1 applies it.
+		// Ultimately, by receiving a request to vote, the learner realizes that
+		// the candidate believes it to be a voter, and that it should act
+		// accordingly. The candidate's config may be stale, too; but in that case
+		// it won't win the election, at least in the absence of the bug discussed
+		// in:
+		// https://github.com/etcd-io/etcd/issues/7625#issuecomment-488798263.
+		r.logger.Infof("%x [logterm: %d, index: %d, vote: %x] cast %s for %x [logterm: %d, index: %d] at term %d",
+			r.id, lastID.term, lastID.index, r.Vote, m.Type, m.From, candLastID.term, candLastID.index, r.Term)
+		// When responding to Msg{Pre,}Vote messages we include the term
+		// from the message, not the local term. To see why, consider the
+		// case where a single node was previously partitioned away and
+		// it's local term is now out of date. If we include the local term
+		// (recall that for pre-votes we don't update the local term), the
+		// (pre-)campaigning node on the other end will proceed to ignore
+		// the message (it ignores all out of date messages).
+		// The term in the original message and current local term are the
+		// same in the case of regular votes, but different for pre-votes.
+		r.send(pb.Message{To: m.From, Term: m.Term, Type: voteRespMsgType(m.Type)})
+		if m.Type == pb.MsgVote {
+			// Only record real votes.
+			r.electionElapsed = 0
+			r.Vote = m.From
+			r.recordVote()
+		}
+	} else {
+		r.logger.Infof("%x [logterm: %d, index: %d, vote: %x] rejected %s from %x [logterm: %d, index: %d] at term %d",
+			r.id, lastID.term, lastID.index, r.Vote, m.Type, m.From, candLastID.term, candLastID.index, r.Term)
+		r.send(pb.Message{To: m.From, Term: r.Term, Type: voteRespMsgType(m.Type), Reject: true})
+	}
+}
+
+// shouldDeferVote returns true if the given eligible vote request is to be held
+// back until the next tick due to Config.VoteTieBreak.
+func (r *raft) shouldDeferVote(m pb.Message) bool {
+	return r.voteTieBreak != VoteTieBreakNone && m.Type == pb.MsgVote && r.Vote == None &&
+		!bytes.Equal(m.Context, []byte(campaignTransfer)) && r.canGrantVote(m)
+}
+
+// deferVote holds back the given vote request, unless a request from a
+// preferred candidate is already held back. The request which is not held back
+// is rejected.
+func (r *raft) deferVote(m pb.Message) {
+	if d := r.deferredVote; d != nil && d.From != m.From {
+		rejected := *d
+		if !r.prefersCandidate(m, rejected) {
+			rejected, m = m, rejected
+		}
+		r.logger.Infof("%x rejected %s from %x [logterm: %d, index: %d] at term %d in favor of %x",
+			r.id, rejected.Type, rejected.From, rejected.LogTerm, rejected.Index, r.Term, m.From)
+		r.send(pb.Message{To: rejected.From, Term: r.Term, Type: voteRespMsgType(rejected.Type), Reject: true})
+	}
+	r.deferredVote = &m
+}
+
+// prefersCandidate returns true if the candidate of vote request a is to be
+// preferred over that of vote request b.
+func (r *raft) prefersCandidate(a, b pb.Message) bool {
+	if a.LogTerm != b.LogTerm {
+		return a.LogTerm > b.LogTerm
+	}
+	if a.Index != b.Index {
+		return a.Index > b.Index
+	}
+	if r.voteTieBreak == VoteTieBreakHigherID {
+		return a.From > b.From
+	}
+	return a.From < b.From
+}
+
+// resolveDeferredVote responds to the vote request held back by deferVote, if
+// it is still for the current term. The request is now granted if the node is
+// still able to vote for the candidate.
+func (r *raft) resolveDeferredVote() {
+	m := r.deferredVote
+	if m == nil {
+		return
+	}
+	r.deferredVote = nil
+	if m.Term != r.Term {
+		return
+	}
+	r.grantOrRejectVote(*m)
+}
+
+// hasEmptyNormalEntry returns true if any of the given entries is a normal
+// entry with empty data.
+func hasEmptyNormalEntry(ents []pb.Entry) bool {
+	for i := range ents {
+		if ents[i].Type == pb.EntryNormal && len(ents[i].Data) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 type stepFunc func(r *raft, m pb.Message) error
 
 func stepLeader(r *raft, m pb.Message) error {
@@ -1498,7 +2365,7 @@ func stepLeader(r *raft, m pb.Message) error {
 				//    7, the rejection points it at the end of the follower's log
 				//    which is at a higher log term than the actually committed
 				//    log.
-				nextProbeIdx, _ = r.raftLog.findConflictByTerm(m.RejectHint, m.LogTerm)
+				nextProbeIdx, _ = r.findConflictByTerm(m.RejectHint, m.LogTerm)
 			}
 			if pr.MaybeDecrTo(m.Index, nextProbeIdx) {
 				r.logger.Debugf("%x decreased progress of %x to [%s]", r.id, m.From, pr)
@@ -1650,8 +2517,12 @@ func stepLeader(r *raft, m pb.Message) error {
 		}
 		// Transfer leadership to third party.
 		r.logger.Infof("%x [term %d] starts to transfer leadership to %x", r.id, r.Term, leadTransferee)
-		// Transfer leadership should be finished in one electionTimeout, so reset r.electionElapsed.
-		r.electionElapsed = 0
+		// Transfer leadership should be finished in one electionTimeout, so reset
+		// r.electionElapsed, unless the transfer is to be aborted when the current
+		// election timeout fires.
+		if !r.transferAbortOnElectionTimeout {
+			r.electionElapsed = 0
+		}
 		r.leadTransferee = leadTransferee
 		if pr.Match == r.raftLog.lastIndex() {
 			r.sendTimeoutNow(leadTransferee)
@@ -1687,7 +2558,7 @@ func stepCandidate(r *raft, m pb.Message) error {
 		r.handleHeartbeat(m)
 	case pb.MsgSnap:
 		r.becomeFollower(m.Term, m.From) // always m.Term == r.Term
-		r.handleSnapshot(m)
+		return r.handleSnapshot(m)
 	case myVoteRespType:
 		gr, rj, res := r.poll(m.From, m.Type, !m.Reject)
 		r.logger.Infof("%x has received %d %s votes and %d vote rejections", r.id, gr, m.Type, rj)
@@ -1724,16 +2595,16 @@ func stepFollower(r *raft, m pb.Message) error {
 		r.send(m)
 	case pb.MsgApp:
 		r.electionElapsed = 0
-		r.lead = m.From
+		r.setLead(m.From)
 		r.handleAppendEntries(m)
 	case pb.MsgHeartbeat:
 		r.electionElapsed = 0
-		r.lead = m.From
+		r.setLead(m.From)
 		r.handleHeartbeat(m)
 	case pb.MsgSnap:
 		r.electionElapsed = 0
-		r.lead = m.From
-		r.handleSnapshot(m)
+		r.setLead(m.From)
+		return r.handleSnapshot(m)
 	case pb.MsgTransferLeader:
 		if r.lead == None {
 			r.logger.Infof("%x no leader at term %d; dropping leader transfer msg", r.id, r.Term)
@@ -1748,7 +2619,7 @@ func stepFollower(r *raft, m pb.Message) error {
 		}
 		if r.lead != None {
 			r.logger.Infof("%x forgetting leader %x at term %d", r.id, r.lead, r.Term)
-			r.lead = None
+			r.setLead(None)
 		}
 	case pb.MsgTimeoutNow:
 		r.logger.Infof("%x [term %d] received MsgTimeoutNow from %x and starts an election to get leadership.", r.id, r.Term, m.From)
@@ -1757,22 +2628,34 @@ func stepFollower(r *raft, m pb.Message) error {
 		// extra round trip.
 		r.hup(campaignTransfer)
 	case pb.MsgReadIndex:
-		if r.lead == None {
-			r.logger.Infof("%x no leader at term %d; dropping index reading msg", r.id, r.Term)
-			return nil
-		}
-		m.To = r.lead
-		r.send(m)
+		r.forwardReadIndex(m)
 	case pb.MsgReadIndexResp:
 		if len(m.Entries) != 1 {
 			r.logger.Errorf("%x invalid format of MsgReadIndexResp from %x, entries count: %d", r.id, m.From, len(m.Entries))
 			return nil
 		}
-		r.readStates = append(r.readStates, ReadState{Index: m.Index, RequestCtx: m.Entries[0].Data})
+		r.addReadState(ReadState{Index: m.Index, RequestCtx: m.Entries[0].Data})
 	}
 	return nil
 }
 
+// forwardReadIndex forwards the MsgReadIndex m to the leader. Without a known
+// leader, m is dropped, or rejected with Config.ForwardReadIndexOnStepDown if
+// it was made on this node.
+func (r *raft) forwardReadIndex(m pb.Message) {
+	if r.lead == None {
+		if r.forwardReadIndexOnStepDown && (m.From == None || m.From == r.id) {
+			r.logger.Infof("%x no leader at term %d; rejecting index reading msg", r.id, r.Term)
+			r.addReadState(ReadState{RequestCtx: m.Entries[0].Data, Rejected: true})
+			return
+		}
+		r.logger.Infof("%x no leader at term %d; dropping index reading msg", r.id, r.Term)
+		return
+	}
+	m.To = r.lead
+	r.send(m)
+}
+
 // logSliceFromMsgApp extracts the appended logSlice from a MsgApp message.
 func logSliceFromMsgApp(m *pb.Message) logSlice {
 	// TODO(pav-kv): consider also validating the logSlice here.
@@ -1788,9 +2671,24 @@ func (r *raft) handleAppendEntries(m pb.Message) {
 	// message, and validate it before taking any action (e.g. bumping term).
 	a := logSliceFromMsgApp(&m)
 
+	if m.Commit < r.raftLog.committed {
+		r.logger.Debugf("%x [commit: %d] ignored lower commit %d in MsgApp from %x",
+			r.id, r.raftLog.committed, m.Commit, m.From)
+		if r.onCommitRegressionAttempt != nil {
+			r.onCommitRegressionAttempt(m.From)
+		}
+	}
 	if a.prev.index < r.raftLog.committed {
-		r.send(pb.Message{To: m.From, Type: pb.MsgAppResp, Index: r.raftLog.committed})
-		return
+		if !r.acceptOverlappingAppends || a.lastIndex() <= r.raftLog.committed {
+			r.send(pb.Message{To: m.From, Type: pb.MsgAppResp, Index: r.raftLog.committed})
+			return
+		}
+		// The leader's log contains all committed entries, so the entries at
+		// or below the commit index are already present.
+		if a = a.forward(r.raftLog.committed); !r.raftLog.matchTerm(a.prev) {
+			r.logger.Panicf("%x [commit: %d] MsgApp from %x conflicts with committed entry %+v",
+				r.id, r.raftLog.committed, m.From, a.prev)
+		}
 	}
 	if mlastIndex, ok := r.raftLog.maybeAppend(a, m.Commit); ok {
 		r.send(pb.Message{To: m.From, Type: pb.MsgAppResp, Index: mlastIndex})
@@ -1816,7 +2714,7 @@ func (r *raft) handleAppendEntries(m pb.Message) {
 	// a non-zero term (unless the log is empty). However, it is safe to send a zero
 	// LogTerm in this response in any case, so we don't verify it here.
 	hintIndex := min(m.Index, r.raftLog.lastIndex())
-	hintIndex, hintTerm := r.raftLog.findConflictByTerm(hintIndex, m.LogTerm)
+	hintIndex, hintTerm := r.findConflictByTerm(hintIndex, m.LogTerm)
 	r.send(pb.Message{
 		To:         m.From,
 		Type:       pb.MsgAppResp,
@@ -1827,12 +2725,22 @@ func (r *raft) handleAppendEntries(m pb.Message) {
 	})
 }
 
+// findConflictByTerm returns a best guess on where the log ends matching another
+// log, see raftLog.findConflictByTerm. The guess is computed as configured by
+// Config.MaxRejectHintScan and Config.OptimalRejectHint.
+func (r *raft) findConflictByTerm(index uint64, term uint64) (uint64, uint64) {
+	if r.optimalRejectHint {
+		return r.raftLog.searchConflictByTerm(index, term)
+	}
+	return r.raftLog.findConflictByTerm(index, term, r.maxRejectHintScan)
+}
+
 func (r *raft) handleHeartbeat(m pb.Message) {
 	r.raftLog.commitTo(m.Commit)
 	r.send(pb.Message{To: m.From, Type: pb.MsgHeartbeatResp, Context: m.Context})
 }
 
-func (r *raft) handleSnapshot(m pb.Message) {
+func (r *raft) handleSnapshot(m pb.Message) error {
 	// MsgSnap messages should always carry a non-nil Snapshot, but err on the
 	// side of safety and treat a nil Snapshot as a zero-valued Snapshot.
 	var s pb.Snapshot
@@ -1840,23 +2748,43 @@ func (r *raft) handleSnapshot(m pb.Message) {
 		s = *m.Snapshot
 	}
 	sindex, sterm := s.Metadata.Index, s.Metadata.Term
-	if r.restore(s) {
+	// A snapshot with a term below that of our own entry at the snapshot index
+	// can't describe the committed state (all leaders after the one that
+	// committed this index would have had the same entry), so it must be
+	// coming from a stale leader. Reject it without changing any state.
+	if t, err := r.raftLog.term(sindex); err == nil && t > sterm {
+		r.logger.Warningf("%x [commit: %d, term at %d: %d] rejected stale snapshot [index: %d, term: %d] from %x",
+			r.id, r.raftLog.committed, sindex, t, sindex, sterm, m.From)
+		r.send(pb.Message{To: m.From, Type: pb.MsgAppResp, Index: r.raftLog.committed})
+		return nil
+	}
+	ok, err := r.restore(s)
+	if err != nil {
+		// See Config.ConfStateMismatchNonFatal.
+		r.logger.Errorf("%x continuing with configuration %s restored from mismatching ConfState: %v",
+			r.id, r.trk.Config, err)
+	}
+	if ok {
 		r.logger.Infof("%x [commit: %d] restored snapshot [index: %d, term: %d]",
 			r.id, r.raftLog.committed, sindex, sterm)
+		r.emit(Event{Type: EventSnapshotReceived, Peer: m.From, Index: sindex})
 		r.send(pb.Message{To: m.From, Type: pb.MsgAppResp, Index: r.raftLog.lastIndex()})
 	} else {
 		r.logger.Infof("%x [commit: %d] ignored snapshot [index: %d, term: %d]",
 			r.id, r.raftLog.committed, sindex, sterm)
 		r.send(pb.Message{To: m.From, Type: pb.MsgAppResp, Index: r.raftLog.committed})
 	}
+	return err
 }
 
 // restore recovers the state machine from a snapshot. It restores the log and the
 // configuration of state machine. If this method returns false, the snapshot was
-// ignored, either because it was obsolete or because of an error.
-func (r *raft) restore(s pb.Snapshot) bool {
+// ignored, either because it was obsolete or because of an error. The returned
+// error is a mismatch between the snapshot's ConfState and the restored
+// configuration, only returned with Config.ConfStateMismatchNonFatal.
+func (r *raft) restore(s pb.Snapshot) (bool, error) {
 	if s.Metadata.Index <= r.raftLog.committed {
-		return false
+		return false, nil
 	}
 	if r.state != StateFollower {
 		// This is defense-in-depth: if the leader somehow ended up applying a
@@ -1868,7 +2796,7 @@ func (r *raft) restore(s pb.Snapshot) bool {
 		// state when this method is called.
 		r.logger.Warningf("%x attempted to restore snapshot as leader; should never happen", r.id)
 		r.becomeFollower(r.Term+1, None)
-		return false
+		return false, nil
 	}
 
 	// More defense-in-depth: throw away snapshot if recipient is not in the
@@ -1899,7 +2827,7 @@ func (r *raft) restore(s pb.Snapshot) bool {
 			"%x attempted to restore snapshot but it is not in the ConfState %v; should never happen",
 			r.id, cs,
 		)
-		return false
+		return false, nil
 	}
 
 	// Now go ahead and actually restore.
@@ -1911,7 +2839,7 @@ func (r *raft) restore(s pb.Snapshot) bool {
 		r.logger.Infof("%x [commit: %d, lastindex: %d, lastterm: %d] fast-forwarded commit to snapshot [index: %d, term: %d]",
 			r.id, r.raftLog.committed, last.index, last.term, id.index, id.term)
 		r.raftLog.commitTo(s.Metadata.Index)
-		return false
+		return false, nil
 	}
 
 	r.raftLog.restore(s)
@@ -1929,12 +2857,14 @@ func (r *raft) restore(s pb.Snapshot) bool {
 		panic(fmt.Sprintf("unable to restore config %+v: %s", cs, err))
 	}
 
-	assertConfStatesEquivalent(r.logger, cs, r.switchToConfig(cfg, trk))
+	// With Config.ConfStateMismatchNonFatal, a mismatch is returned to the
+	// caller, and the snapshot is restored with the derived configuration.
+	mismatch := assertConfStatesEquivalent(r.logger, cs, r.switchToConfig(cfg, trk), r.confStateMismatchNonFatal)
 
 	last := r.raftLog.lastEntryID()
 	r.logger.Infof("%x [commit: %d, lastindex: %d, lastterm: %d] restored snapshot [index: %d, term: %d]",
 		r.id, r.raftLog.committed, last.index, last.term, id.index, id.term)
-	return true
+	return true, mismatch
 }
 
 // promotable indicates whether state machine can be promoted to leader,
@@ -1963,7 +2893,9 @@ func (r *raft) applyConfChange(cc pb.ConfChangeV2) pb.ConfState {
 		panic(err)
 	}
 
-	return r.switchToConfig(cfg, trk)
+	cs := r.switchToConfig(cfg, trk)
+	r.emit(Event{Type: EventConfChangeApplied, ConfState: &cs})
+	return cs
 }
 
 // switchToConfig reconfigures this node to use the provided configuration. It
@@ -2041,13 +2973,14 @@ func (r *raft) loadState(state pb.HardState) {
 
 // pastElectionTimeout returns true if r.electionElapsed is greater
 // than or equal to the randomized election timeout in
-// [electiontimeout, 2 * electiontimeout - 1].
+// [electiontimeout, 2 * electiontimeout - 1], shifted by the configured
+// election timeout offset.
 func (r *raft) pastElectionTimeout() bool {
 	return r.electionElapsed >= r.randomizedElectionTimeout
 }
 
 func (r *raft) resetRandomizedElectionTimeout() {
-	r.randomizedElectionTimeout = r.electionTimeout + globalRand.Intn(r.electionTimeout)
+	r.randomizedElectionTimeout = r.electionTimeout + r.electionTimeoutOffset + r.rand.Intn(r.electionTimeout)
 }
 
 func (r *raft) sendTimeoutNow(to uint64) {
@@ -2069,7 +3002,7 @@ func (r *raft) committedEntryInCurrentTerm() bool {
 // itself, a blank value will be returned.
 func (r *raft) responseToReadIndexReq(req pb.Message, readIndex uint64) pb.Message {
 	if req.From == None || req.From == r.id {
-		r.readStates = append(r.readStates, ReadState{
+		r.addReadState(ReadState{
 			Index:      readIndex,
 			RequestCtx: req.Entries[0].Data,
 		})
@@ -2083,6 +3016,18 @@ func (r *raft) responseToReadIndexReq(req pb.Message, readIndex uint64) pb.Messa
 	}
 }
 
+// addReadState adds rs to the ReadStates of the next Ready. With
+// Config.DedupReadStates, it is dropped if a ReadState with the same
+// RequestCtx is already pending.
+func (r *raft) addReadState(rs ReadState) {
+	for i := 0; r.dedupReadStates && i < len(r.readStates); i++ {
+		if bytes.Equal(r.readStates[i].RequestCtx, rs.RequestCtx) {
+			return
+		}
+	}
+	r.readStates = append(r.readStates, rs)
+}
+
 // increaseUncommittedSize computes the size of the proposed entries and
 // determines whether they would push leader over its maxUncommittedSize limit.
 // If the new entries would exceed the limit, the method returns false. If not,
@@ -16,10 +16,12 @@ package raft
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	pb "go.etcd.io/raft/v3/raftpb"
+	"go.etcd.io/raft/v3/tracker"
 )
 
 // TestMsgAppFlowControlFull ensures:
@@ -136,3 +138,77 @@ func TestMsgAppFlowControlRecvHeartbeat(t *testing.T) {
 		r.readMessages()
 	}
 }
+
+// TestMsgAppRateLimitPerPeer ensures that with Config.MaxBytesPerSecondPerPeer
+// the leader keeps the entry bytes sent to a follower under the limit, using
+// ticks as the clock, and sends the throttled entries later, in order.
+func TestMsgAppRateLimitPerPeer(t *testing.T) {
+	cfg := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2)))
+	cfg.MaxBytesPerSecondPerPeer = 1000
+	cfg.TickInterval = 100 * time.Millisecond // 100 bytes per tick
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.trk.Progress[2].BecomeReplicate()
+	r.readMessages()
+
+	const entries, size = 100, 40
+	for i := 0; i < entries; i++ {
+		require.NoError(t, r.Step(pb.Message{From: 1, To: 1, Type: pb.MsgProp,
+			Entries: []pb.Entry{{Data: make([]byte, size)}}}))
+	}
+	// The budget starts empty, so only empty MsgApp are sent.
+	for _, m := range r.readMessages() {
+		require.Equal(t, pb.MsgApp, m.Type)
+		require.Empty(t, m.Entries)
+	}
+
+	var sent, next uint64 = 0, 1
+	for tick := 1; tick <= 50; tick++ {
+		r.tick()
+		for _, m := range r.readMessages() {
+			if m.Type != pb.MsgApp {
+				continue
+			}
+			for _, e := range m.Entries {
+				require.Equal(t, next, e.Index)
+				next++
+				sent += uint64(len(e.Data))
+			}
+		}
+		// A message can exceed the remaining budget by at most one entry.
+		require.LessOrEqual(t, sent, uint64(100*tick+size), "tick %d", tick)
+	}
+	require.Equal(t, uint64(entries*size), sent)
+	require.Equal(t, r.raftLog.lastIndex()+1, next)
+}
+
+// TestMsgAppRateLimitSendsEmpty ensures that with Config.MaxBytesPerSecondPerPeer
+// the leader still probes a follower whose budget is used up, and keeps it
+// informed of the commit index.
+func TestMsgAppRateLimitSendsEmpty(t *testing.T) {
+	cfg := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+	cfg.MaxBytesPerSecondPerPeer = 1000
+	cfg.TickInterval = 100 * time.Millisecond
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	require.NoError(t, r.Step(pb.Message{From: 3, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	require.Equal(t, uint64(1), r.raftLog.committed)
+	pr := r.trk.Progress[2]
+	require.Equal(t, tracker.StateProbe, pr.State)
+	require.LessOrEqual(t, pr.SendBudget, int64(0))
+	r.readMessages()
+
+	// The follower's heartbeat response prompts an empty probe carrying the
+	// commit index, and its acknowledgement moves it to StateReplicate.
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgHeartbeatResp}))
+	msgs := r.readMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, pb.MsgApp, msgs[0].Type)
+	require.Empty(t, msgs[0].Entries)
+	require.Equal(t, uint64(1), msgs[0].Commit)
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: msgs[0].Index}))
+	require.Equal(t, tracker.StateReplicate, pr.State)
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"slices"
 	"strings"
 	"testing"
 
@@ -283,6 +284,38 @@ func TestUncommittedEntryLimit(t *testing.T) {
 	require.Zero(t, r.uncommittedSize)
 }
 
+// warningRecordingLogger records the messages logged through Warningf.
+type warningRecordingLogger struct {
+	*DefaultLogger
+	warnings []string
+}
+
+func (l *warningRecordingLogger) Warningf(format string, v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+}
+
+// TestLargeEntryWarnBytes ensures that the leader warns once about each
+// appended entry larger than Config.LargeEntryWarnBytes, and still appends it.
+func TestLargeEntryWarnBytes(t *testing.T) {
+	l := &warningRecordingLogger{DefaultLogger: discardLogger}
+	cfg := newTestConfig(1, 5, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+	cfg.LargeEntryWarnBytes = 10
+	cfg.Logger = l
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	require.Empty(t, l.warnings)
+
+	require.NoError(t, r.Step(pb.Message{From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{
+		{Data: make([]byte, 10)}, {Data: make([]byte, 11)}, {Data: []byte("small")}, {Data: make([]byte, 100)},
+	}}))
+	require.Equal(t, uint64(5), r.raftLog.lastIndex())
+	require.Equal(t, []string{
+		"1 appending large entry at index 3 term 1: 11 bytes (warn threshold 10)",
+		"1 appending large entry at index 5 term 1: 100 bytes (warn threshold 10)",
+	}, l.warnings)
+}
+
 func TestLeaderElection(t *testing.T) {
 	testLeaderElection(t, false)
 }
@@ -498,6 +531,83 @@ func testLeaderElectionOverwriteNewerLogs(t *testing.T, preVote bool) {
 	}
 }
 
+// TestVoteTieBreak ensures that with Config.VoteTieBreak a node votes for the
+// preferred one of the candidates that asked for its vote since its last tick,
+// regardless of the order in which they asked.
+func TestVoteTieBreak(t *testing.T) {
+	vote := func(from, logTerm, index uint64) pb.Message {
+		return pb.Message{From: from, To: 1, Term: 2, Type: pb.MsgVote, LogTerm: logTerm, Index: index}
+	}
+	for i, tt := range []struct {
+		tieBreak VoteTieBreak
+		votes    []pb.Message
+		want     uint64
+	}{
+		{VoteTieBreakLowerID, []pb.Message{vote(3, 1, 1), vote(2, 1, 1)}, 2},
+		{VoteTieBreakLowerID, []pb.Message{vote(2, 1, 1), vote(3, 1, 1)}, 2},
+		{VoteTieBreakHigherID, []pb.Message{vote(3, 1, 1), vote(2, 1, 1)}, 3},
+		{VoteTieBreakHigherID, []pb.Message{vote(2, 1, 1), vote(3, 1, 1)}, 3},
+		// A retransmitted request does not change the outcome.
+		{VoteTieBreakLowerID, []pb.Message{vote(2, 1, 1), vote(3, 1, 1), vote(3, 1, 1)}, 2},
+		// The most up-to-date log wins regardless of the ID.
+		{VoteTieBreakLowerID, []pb.Message{vote(2, 1, 1), vote(3, 1, 2)}, 3},
+		{VoteTieBreakLowerID, []pb.Message{vote(3, 2, 1), vote(2, 1, 2)}, 3},
+		{VoteTieBreakHigherID, []pb.Message{vote(2, 1, 2), vote(3, 1, 1)}, 2},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			cfg := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+			cfg.VoteTieBreak = tt.tieBreak
+			r := newRaft(cfg)
+			r.becomeFollower(1, None)
+			r.appendEntry(pb.Entry{})
+
+			for _, m := range tt.votes {
+				require.NoError(t, r.Step(m))
+			}
+			require.Equal(t, None, r.Vote)
+			for _, m := range r.readMessages() {
+				require.True(t, m.Reject)
+				require.NotEqual(t, tt.want, m.To)
+			}
+
+			r.tick()
+			require.Equal(t, tt.want, r.Vote)
+			msgs := r.readMessages()
+			require.Len(t, msgs, 1)
+			require.Equal(t, pb.Message{From: 1, To: tt.want, Term: 2, Type: pb.MsgVoteResp}, msgs[0])
+			// The request held back is not received again on the tick.
+			require.Equal(t, uint64(len(tt.votes)), r.msgsRecv)
+		})
+	}
+}
+
+// TestVoteTieBreakNotDeferred ensures that Config.VoteTieBreak does not hold
+// back votes once the node has voted in the term, and votes for leadership
+// transfers.
+func TestVoteTieBreakNotDeferred(t *testing.T) {
+	cfg := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+	cfg.VoteTieBreak = VoteTieBreakLowerID
+	r := newRaft(cfg)
+
+	require.NoError(t, r.Step(pb.Message{From: 3, To: 1, Term: 2, Type: pb.MsgVote,
+		Context: []byte(campaignTransfer)}))
+	require.Equal(t, uint64(3), r.Vote)
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgVote}))
+	require.Equal(t, uint64(3), r.Vote)
+	require.Equal(t, []pb.Message{
+		{From: 1, To: 3, Term: 2, Type: pb.MsgVoteResp},
+		{From: 1, To: 2, Term: 2, Type: pb.MsgVoteResp, Reject: true},
+	}, r.readMessages())
+
+	// A request held back for an earlier term is dropped on the tick.
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: 3, Type: pb.MsgVote}))
+	require.NoError(t, r.Step(pb.Message{From: 3, To: 1, Term: 4, Type: pb.MsgApp}))
+	r.readMessages()
+	r.tick()
+	require.Equal(t, None, r.Vote)
+	require.Empty(t, r.readMessages())
+}
+
 func TestVoteFromAnyState(t *testing.T) {
 	testVoteFromAnyState(t, pb.MsgVote)
 }
@@ -1069,6 +1179,678 @@ func TestPastElectionTimeout(t *testing.T) {
 	}
 }
 
+// TestElectionTimeoutOffset ensures that Config.ElectionTimeoutOffset shifts
+// the randomized election timeout window, so that groups configured with
+// different offsets have staggered election timeouts.
+func TestElectionTimeoutOffset(t *testing.T) {
+	for _, offset := range []int{0, 3, 10, 25} {
+		t.Run(fmt.Sprint(offset), func(t *testing.T) {
+			c := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1)))
+			c.ElectionTimeoutOffset = offset
+			sm := newRaft(c)
+			for i := 0; i < 1000; i++ {
+				sm.resetRandomizedElectionTimeout()
+				require.GreaterOrEqual(t, sm.randomizedElectionTimeout, 10+offset)
+				require.Less(t, sm.randomizedElectionTimeout, 20+offset)
+			}
+		})
+	}
+
+	// Two groups whose offsets differ by at least ElectionTick never time out
+	// at the same tick.
+	s1 := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1)))
+	s2 := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1)))
+	s2.ElectionTimeoutOffset = 10
+	r1, r2 := newRaft(s1), newRaft(s2)
+	for i := 0; i < 1000; i++ {
+		r1.resetRandomizedElectionTimeout()
+		r2.resetRandomizedElectionTimeout()
+		require.Less(t, r1.randomizedElectionTimeout, r2.randomizedElectionTimeout)
+	}
+
+	c := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1)))
+	c.ElectionTimeoutOffset = -1
+	require.Error(t, c.validate())
+}
+
+// TestRandSource ensures that the election timeouts are drawn from
+// Config.RandSource, so that nodes with identically seeded sources produce
+// identical timeouts.
+func TestRandSource(t *testing.T) {
+	newNode := func(seed int64) *raft {
+		c := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+		c.PreVote = true
+		c.PreVoteTick = 5
+		c.RandSource = rand.NewSource(seed)
+		return newRaft(c)
+	}
+	timeouts := func(r *raft) []int {
+		var res []int
+		for i := 0; i < 100; i++ {
+			res = append(res, r.randomizedElectionTimeout)
+			if i%2 == 0 {
+				r.becomePreCandidate()
+			} else {
+				r.becomeFollower(r.Term+1, None)
+			}
+		}
+		return res
+	}
+	want := timeouts(newNode(1))
+	require.Equal(t, want, timeouts(newNode(1)))
+	require.NotEqual(t, want, timeouts(newNode(2)))
+}
+
+// TestTruncateUncommittedOnStepDown ensures that a leader configured with
+// TruncateUncommittedOnStepDown discards its unacknowledged and unpersisted
+// uncommitted tail when stepping down, and keeps everything else.
+func TestTruncateUncommittedOnStepDown(t *testing.T) {
+	for _, tt := range []struct {
+		enabled    bool
+		inProgress bool
+		wantLast   uint64
+	}{
+		{enabled: false, wantLast: 5},
+		{enabled: true, wantLast: 3},
+		// Entries handed over for persistence are never discarded.
+		{enabled: true, inProgress: true, wantLast: 5},
+	} {
+		t.Run(fmt.Sprintf("enabled=%t,inProgress=%t", tt.enabled, tt.inProgress), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1, 2, 3))
+			cfg := newTestConfig(1, 10, 1, s)
+			cfg.TruncateUncommittedOnStepDown = tt.enabled
+			r := newRaft(cfg)
+			r.becomeCandidate()
+			r.becomeLeader()
+			// Persist the empty entry, and get it committed.
+			nextEnts(r, s)
+			r.readMessages()
+			require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Type: pb.MsgAppResp, Index: 1}))
+			require.Equal(t, uint64(1), r.raftLog.committed)
+
+			// Append entries 2-5, of which only 2-3 are acked by a follower.
+			for i := 0; i < 4; i++ {
+				mustAppendEntry(r, pb.Entry{Data: []byte("foo")})
+			}
+			require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Type: pb.MsgAppResp, Index: 3}))
+			require.Equal(t, uint64(1), r.raftLog.committed)
+			if tt.inProgress {
+				r.raftLog.acceptUnstable()
+			}
+
+			r.becomeFollower(r.Term+1, None)
+			assert.Equal(t, tt.wantLast, r.raftLog.lastIndex())
+			assert.Equal(t, uint64(1), r.raftLog.committed)
+		})
+	}
+}
+
+// TestOnCommitRegressionAttempt ensures that a follower does not regress its
+// commit index when receiving an MsgApp with a lower Commit, and that
+// Config.OnCommitRegressionAttempt is notified about it.
+func TestOnCommitRegressionAttempt(t *testing.T) {
+	var calls []uint64
+	cfg := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2)))
+	cfg.OnCommitRegressionAttempt = func(from uint64) { calls = append(calls, from) }
+	r := newRaft(cfg)
+	r.becomeFollower(2, 2)
+
+	ents := index(1).terms(1, 2, 2)
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgApp, Entries: ents, Commit: 3}))
+	require.Equal(t, uint64(3), r.raftLog.committed)
+	require.Empty(t, calls)
+
+	for _, m := range []pb.Message{
+		{From: 2, To: 1, Term: 2, Type: pb.MsgApp, Index: 3, LogTerm: 2, Commit: 1},
+		{From: 2, To: 1, Term: 2, Type: pb.MsgApp, Index: 1, LogTerm: 1, Entries: ents[1:], Commit: 2},
+	} {
+		require.NoError(t, r.Step(m))
+		assert.Equal(t, uint64(3), r.raftLog.committed)
+	}
+	assert.Equal(t, []uint64{2, 2}, calls)
+}
+
+// TestAutoPromoteLearners ensures that a leader configured with
+// AutoPromoteLearners proposes the promotion of a learner once it catches up,
+// on the next periodic check.
+func TestAutoPromoteLearners(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2), withLearners(3))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.AutoPromoteLearners = true
+	cfg.PromotionCheckInterval = 5
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	nextEnts(r, s)
+	require.Equal(t, uint64(1), r.raftLog.applied)
+
+	tick := func(n int) {
+		for i := 0; i < n; i++ {
+			r.tick()
+		}
+	}
+	// The learner has not caught up yet, so it is not promoted.
+	tick(5)
+	require.Equal(t, uint64(1), r.raftLog.lastIndex())
+
+	// The learner catches up, but the promotion is proposed only on the next
+	// check.
+	require.NoError(t, r.Step(pb.Message{From: 3, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	tick(4)
+	require.Equal(t, uint64(1), r.raftLog.lastIndex())
+	tick(1)
+	require.Equal(t, uint64(2), r.raftLog.lastIndex())
+
+	ents := r.raftLog.nextUnstableEnts()
+	require.Len(t, ents, 1)
+	require.Equal(t, pb.EntryConfChangeV2, ents[0].Type)
+	var cc pb.ConfChangeV2
+	require.NoError(t, cc.Unmarshal(ents[0].Data))
+	assert.Equal(t, []pb.ConfChangeSingle{{Type: pb.ConfChangeAddNode, NodeID: 3}}, cc.Changes)
+
+	// No other promotion is proposed while this one is pending.
+	tick(5)
+	assert.Equal(t, uint64(2), r.raftLog.lastIndex())
+}
+
+// TestOnEntriesOverwritten ensures that Config.OnEntriesOverwritten receives
+// the entries truncated from a follower's log due to a conflicting MsgApp.
+func TestOnEntriesOverwritten(t *testing.T) {
+	var overwritten [][]pb.Entry
+	s := newTestMemoryStorage(withPeers(1, 2))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.OnEntriesOverwritten = func(ents []pb.Entry) { overwritten = append(overwritten, ents) }
+	r := newRaft(cfg)
+	r.becomeFollower(2, 2)
+
+	ents := index(1).terms(1, 2, 2, 2)
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgApp, Entries: ents, Commit: 1}))
+	// Persist some of the entries, so that the overwritten ones span both the
+	// storage and the unstable log.
+	require.NoError(t, s.Append(ents[:2]))
+	r.raftLog.stableTo(pbEntryID(&ents[1]))
+	// Appending already present entries overwrites nothing.
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgApp, Entries: ents, Commit: 1}))
+	require.Empty(t, overwritten)
+
+	r.becomeFollower(3, 2)
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: 3, Type: pb.MsgApp,
+		Index: 1, LogTerm: 1, Entries: index(2).terms(3, 3), Commit: 1}))
+	require.Equal(t, [][]pb.Entry{ents[1:]}, overwritten)
+	assert.Equal(t, uint64(3), r.raftLog.lastIndex())
+}
+
+// TestReadIndexTimeout ensures that a leader configured with
+// ReadIndexTimeoutTicks abandons a ReadIndex request it can't confirm, and
+// reports it via OnReadIndexTimeout.
+func TestReadIndexTimeout(t *testing.T) {
+	var abandoned [][]byte
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.ReadIndexTimeoutTicks = 5
+	cfg.OnReadIndexTimeout = func(ctx []byte) { abandoned = append(abandoned, ctx) }
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	nextEnts(r, s)
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	require.Equal(t, uint64(1), r.raftLog.committed)
+
+	require.NoError(t, r.Step(pb.Message{From: 1, To: 1, Type: pb.MsgReadIndex, Entries: []pb.Entry{{Data: []byte("ctx1")}}}))
+	r.tick()
+	require.NoError(t, r.Step(pb.Message{From: 1, To: 1, Type: pb.MsgReadIndex, Entries: []pb.Entry{{Data: []byte("ctx2")}}}))
+	// No heartbeat responses are delivered, so the reads are never confirmed.
+	for i := 0; i < 4; i++ {
+		r.tick()
+	}
+	assert.Equal(t, [][]byte{[]byte("ctx1")}, abandoned)
+	r.tick()
+	assert.Equal(t, [][]byte{[]byte("ctx1"), []byte("ctx2")}, abandoned)
+	assert.Empty(t, r.readOnly.pendingReadIndex)
+	assert.Empty(t, r.readOnly.readIndexQueue)
+	assert.Empty(t, r.readStates)
+}
+
+// TestForwardReadIndexOnStepDown ensures that with
+// Config.ForwardReadIndexOnStepDown a leader stepping down forwards its
+// pending reads to the new leader, or rejects the local ones if there is none.
+func TestForwardReadIndexOnStepDown(t *testing.T) {
+	for _, tt := range []struct {
+		forward bool
+		lead    bool
+	}{{false, true}, {false, false}, {true, true}, {true, false}} {
+		t.Run(fmt.Sprintf("forward=%t,lead=%t", tt.forward, tt.lead), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1, 2, 3))
+			cfg := newTestConfig(1, 10, 1, s)
+			cfg.ForwardReadIndexOnStepDown = tt.forward
+			r := newRaft(cfg)
+			r.becomeCandidate()
+			r.becomeLeader()
+			nextEnts(r, s)
+			read := func(from uint64, ctx string) {
+				require.NoError(t, r.Step(pb.Message{From: from, To: 1, Type: pb.MsgReadIndex,
+					Entries: []pb.Entry{{Data: []byte(ctx)}}}))
+			}
+			// The first read waits for the leader to commit an entry in its term.
+			read(1, "a")
+			require.Len(t, r.pendingReadIndexMessages, 1)
+			require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+			read(3, "b")
+			read(1, "c")
+			require.Len(t, r.readOnly.readIndexQueue, 3)
+			r.readMessages()
+
+			if tt.lead {
+				require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term + 1, Type: pb.MsgHeartbeat}))
+				require.Equal(t, uint64(2), r.lead)
+			} else {
+				require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term + 1, Type: pb.MsgVote,
+					LogTerm: r.Term, Index: r.raftLog.lastIndex()}))
+				require.Equal(t, None, r.lead)
+			}
+			require.Equal(t, StateFollower, r.state)
+			var forwarded []string
+			for _, m := range r.readMessages() {
+				if m.Type == pb.MsgReadIndex {
+					require.Equal(t, uint64(2), m.To)
+					forwarded = append(forwarded, fmt.Sprintf("%d:%s", m.From, m.Entries[0].Data))
+				}
+			}
+			var rejected []string
+			for _, rs := range r.readStates {
+				require.True(t, rs.Rejected)
+				rejected = append(rejected, string(rs.RequestCtx))
+			}
+
+			switch {
+			case !tt.forward:
+				require.Empty(t, forwarded)
+				require.Empty(t, rejected)
+			case tt.lead:
+				require.Equal(t, []string{"1:a", "3:b", "1:c"}, forwarded)
+				require.Empty(t, rejected)
+			default:
+				// The read from node 3 is dropped.
+				require.Empty(t, forwarded)
+				require.Equal(t, []string{"a", "c"}, rejected)
+				// Local reads made while leaderless are rejected too.
+				read(1, "d")
+				require.Equal(t, "d", string(r.readStates[2].RequestCtx))
+				require.True(t, r.readStates[2].Rejected)
+			}
+		})
+	}
+}
+
+// TestOnLeaderChange ensures that Config.OnLeaderChange is called whenever the
+// leader known to a node changes.
+func TestOnLeaderChange(t *testing.T) {
+	type change struct{ oldLead, newLead, term uint64 }
+	changes := map[uint64][]change{}
+	nt := newNetworkWithConfig(func(c *Config) {
+		id := c.ID
+		c.OnLeaderChange = func(oldLead, newLead, term uint64) {
+			changes[id] = append(changes[id], change{oldLead, newLead, term})
+		}
+	}, nil, nil, nil)
+
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+	assert.Equal(t, []change{{None, 1, 1}}, changes[1])
+	assert.Equal(t, []change{{None, 1, 1}}, changes[2])
+	// Heartbeats from the same leader don't cause notifications.
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgBeat})
+	assert.Len(t, changes[2], 1)
+
+	// Node 1 steps down when node 3 is elected.
+	nt.send(pb.Message{From: 3, To: 3, Type: pb.MsgHup})
+	assert.Equal(t, []change{{None, 1, 1}, {1, None, 2}, {None, 3, 2}}, changes[1])
+	assert.Equal(t, []change{{None, 1, 1}, {1, None, 2}, {None, 3, 2}}, changes[2])
+	assert.Equal(t, []change{{None, 1, 1}, {1, None, 2}, {None, 3, 2}}, changes[3])
+}
+
+// TestEventSink tests that Config.EventSink observes leader changes, commit
+// advances, conf changes and dropped proposals in the order they occur.
+func TestEventSink(t *testing.T) {
+	var events []Event
+	nt := newNetworkWithConfig(func(c *Config) {
+		if c.ID == 1 {
+			c.EventSink = func(e Event) { events = append(events, e) }
+		}
+	}, nil, nil, nil)
+
+	// No leader yet, so the proposal is dropped.
+	require.Equal(t, ErrProposalDropped, nt.peers[1].Step(pb.Message{
+		From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{{Data: []byte("a")}}}))
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{{Data: []byte("b")}}})
+
+	r := nt.peers[1].(*raft)
+	cs := r.applyConfChange(pb.ConfChange{Type: pb.ConfChangeAddLearnerNode, NodeID: 4}.AsV2())
+
+	require.Equal(t, []Event{
+		{Type: EventProposalDropped, Entries: 1},
+		{Type: EventLeaderChange, Term: 1, Lead: 1},
+		{Type: EventCommitAdvance, Term: 1, Index: 1},
+		{Type: EventCommitAdvance, Term: 1, Index: 2},
+		{Type: EventConfChangeApplied, Term: 1, ConfState: &cs},
+	}, events)
+}
+
+// TestReproposeUncommittedOnReelection tests that a leader re-elected after
+// stepping down re-proposes the uncommitted entries of its previous term
+// which were overwritten in the meantime, if so configured.
+func TestReproposeUncommittedOnReelection(t *testing.T) {
+	entData := func(r *raft, lo uint64) []string {
+		var data []string
+		for _, e := range r.raftLog.allEntries() {
+			if e.Index >= lo {
+				data = append(data, string(e.Data))
+			}
+		}
+		return data
+	}
+	propose := func(nt *network, data ...string) {
+		for _, d := range data {
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{{Data: []byte(d)}}})
+		}
+	}
+
+	for _, repropose := range []bool{false, true} {
+		t.Run(fmt.Sprint(repropose), func(t *testing.T) {
+			nt := newNetworkWithConfig(func(c *Config) {
+				c.ReproposeUncommittedOnReelection = repropose
+			}, nil, nil, nil)
+			r1 := nt.peers[1].(*raft)
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+			nt.isolate(1)
+			propose(nt, "a", "b")
+			require.Equal(t, []string{"", "a", "b"}, entData(r1, 1))
+
+			// Node 2 is elected in term 2, and overwrites the uncommitted
+			// entries of node 1.
+			nt.send(pb.Message{From: 2, To: 2, Type: pb.MsgHup})
+			nt.recover()
+			nt.send(pb.Message{From: 2, To: 2, Type: pb.MsgBeat})
+			require.Equal(t, StateFollower, r1.state)
+			require.Equal(t, []string{"", ""}, entData(r1, 1))
+
+			// Node 1 is elected again in term 3.
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+			require.Equal(t, StateLeader, r1.state)
+			want := []string{""}
+			if repropose {
+				want = []string{"", "a", "b"}
+			}
+			require.Equal(t, want, entData(r1, 3))
+			for _, e := range r1.raftLog.allEntries()[2:] {
+				require.Equal(t, uint64(3), e.Term)
+			}
+			// The re-proposed entries commit, and a new proposal goes after them.
+			propose(nt, "c")
+			require.Equal(t, append(want, "c"), entData(r1, 3))
+			require.Equal(t, r1.raftLog.lastIndex(), r1.raftLog.committed)
+
+			// Entries that are still in the log when the node is re-elected are
+			// not re-proposed.
+			nt.isolate(1)
+			propose(nt, "d")
+			nt.recover()
+			r1.becomeFollower(r1.Term, None)
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+			require.Equal(t, StateLeader, r1.state)
+			require.Equal(t, append(want, "c", "d", ""), entData(r1, 3))
+		})
+	}
+}
+
+// TestReproposeUncommittedSkipsConfChanges tests that the uncommitted
+// configuration changes of a previous term are not re-proposed, even when they
+// would be invalid in the configuration the node is re-elected in.
+func TestReproposeUncommittedSkipsConfChanges(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.ReproposeUncommittedOnReelection = true
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	cc := pb.ConfChangeV2{Changes: []pb.ConfChangeSingle{{Type: pb.ConfChangeAddLearnerNode, NodeID: 4}}}
+	data, err := cc.Marshal()
+	require.NoError(t, err)
+	require.True(t, r.appendEntry(
+		pb.Entry{Data: []byte("a")},
+		pb.Entry{Type: pb.EntryConfChangeV2, Data: data},
+		pb.Entry{Data: []byte("b")},
+	))
+
+	// Node 2 overwrites the entries in term 2, and the node enters a joint
+	// configuration, in which adding a learner is invalid.
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgApp,
+		Entries: []pb.Entry{{Index: 1, Term: 2}}}))
+	require.Equal(t, StateFollower, r.state)
+	r.applyConfChange(pb.ConfChangeV2{
+		Transition: pb.ConfChangeTransitionJointExplicit,
+		Changes:    []pb.ConfChangeSingle{{Type: pb.ConfChangeAddNode, NodeID: 4}},
+	})
+	require.NotEmpty(t, r.trk.Config.Voters[1])
+
+	r.becomeCandidate()
+	r.becomeLeader()
+	ents := r.raftLog.allEntries()
+	require.Len(t, ents, 4)
+	for i, want := range []string{"", "", "a", "b"} {
+		assert.Equal(t, pb.EntryNormal, ents[i].Type)
+		assert.Equal(t, want, string(ents[i].Data))
+	}
+	assert.NotEmpty(t, r.trk.Config.Voters[1])
+	assert.NotContains(t, r.trk.Learners, uint64(4))
+}
+
+// TestLeaderNoopData tests that the empty entry appended by a new leader
+// carries Config.LeaderNoopData, and commits normally.
+func TestLeaderNoopData(t *testing.T) {
+	noopData := func(id uint64) func(uint64) []byte {
+		return func(term uint64) []byte { return []byte(fmt.Sprintf("%d@%d", id, term)) }
+	}
+	nt := newNetworkWithConfig(func(c *Config) {
+		c.LeaderNoopData = noopData(c.ID)
+	}, nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+	nt.send(pb.Message{From: 2, To: 2, Type: pb.MsgHup})
+	for id := uint64(1); id <= 3; id++ {
+		r := nt.peers[id].(*raft)
+		assert.Equal(t, uint64(2), r.raftLog.committed)
+		ents := r.raftLog.allEntries()
+		require.Len(t, ents, 2)
+		assert.Equal(t, "1@1", string(ents[0].Data))
+		assert.Equal(t, "2@2", string(ents[1].Data))
+	}
+
+	// The leader's entry is not re-proposed as an uncommitted proposal.
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.LeaderNoopData = noopData(1)
+	cfg.ReproposeUncommittedOnReelection = true
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	// Node 2 overwrites the entry in term 2.
+	r.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgApp,
+		Entries: []pb.Entry{{Index: 1, Term: 2, Data: []byte("2@2")}}})
+	require.Equal(t, StateFollower, r.state)
+	r.becomeCandidate()
+	r.becomeLeader()
+	ents := r.raftLog.allEntries()
+	require.Len(t, ents, 2)
+	assert.Equal(t, "2@2", string(ents[0].Data))
+	assert.Equal(t, "1@3", string(ents[1].Data))
+}
+
+// TestProbeRounds tests that the leader counts the rejections it takes to
+// find the point where a follower's log matches, and reports them in Status.
+func TestProbeRounds(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2))
+	require.NoError(t, s.Append(index(1).terms(1, 1, 1, 1, 1)))
+	r := newTestRaft(1, 10, 1, s)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	pr := r.trk.Progress[2]
+	require.Equal(t, tracker.StateProbe, pr.State)
+	require.Equal(t, uint64(6), pr.Next)
+
+	for rejected := uint64(5); rejected >= 3; rejected-- {
+		require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp,
+			Index: rejected, Reject: true, RejectHint: rejected - 1, LogTerm: 1}))
+		require.Equal(t, rejected, pr.Next)
+		require.Equal(t, int(6-rejected), getStatus(r).Progress[2].ProbeRounds)
+	}
+	require.NoError(t, r.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 6}))
+	require.Equal(t, tracker.StateReplicate, pr.State)
+	require.Zero(t, getStatus(r).Progress[2].ProbeRounds)
+}
+
+// TestMaxRejectHintScan tests that Config.MaxRejectHintScan bounds the reject
+// hint computation, at the cost of more rejections before the logs converge.
+func TestMaxRejectHintScan(t *testing.T) {
+	for _, tt := range []struct {
+		maxScan    uint64
+		rejections int
+	}{
+		{maxScan: 0, rejections: 1},
+		{maxScan: 10, rejections: 6},
+		{maxScan: 100, rejections: 1},
+	} {
+		t.Run(fmt.Sprint(tt.maxScan), func(t *testing.T) {
+			// The leader has 50 entries at term 3 after the common first entry,
+			// and the follower has 50 entries at term 2.
+			newNode := func(id uint64, term uint64) *raft {
+				s := newTestMemoryStorage(withPeers(1, 2))
+				ents := index(1).terms(1)
+				for i := 0; i < 50; i++ {
+					ents = append(ents, pb.Entry{Index: uint64(i) + 2, Term: term})
+				}
+				require.NoError(t, s.Append(ents))
+				require.NoError(t, s.SetHardState(pb.HardState{Term: 3, Commit: 1}))
+				c := newTestConfig(id, 10, 1, s)
+				c.MaxRejectHintScan = tt.maxScan
+				return newRaft(c)
+			}
+			a, b := newNode(1, 3), newNode(2, 2)
+			nt := newNetwork(a, b)
+			var rejections int
+			nt.msgHook = func(m pb.Message) bool {
+				if m.Type == pb.MsgAppResp && m.Reject {
+					rejections++
+				}
+				return true
+			}
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+			require.Equal(t, StateLeader, a.state)
+			require.Equal(t, tt.rejections, rejections)
+			require.Equal(t, a.raftLog.allEntries(), b.raftLog.allEntries())
+			require.Equal(t, uint64(52), b.raftLog.committed)
+		})
+	}
+}
+
+// TestOptimalRejectHint tests that with Config.OptimalRejectHint a follower
+// whose log has a gap and a long conflicting tail converges in a single
+// rejection, regardless of Config.MaxRejectHintScan.
+func TestOptimalRejectHint(t *testing.T) {
+	for _, tt := range []struct {
+		optimal    bool
+		rejections int
+	}{
+		{optimal: false, rejections: 5},
+		{optimal: true, rejections: 1},
+	} {
+		t.Run(fmt.Sprint(tt.optimal), func(t *testing.T) {
+			// The leader has 50 entries at term 3 after the common first entry,
+			// and the follower has 20 entries at term 2, ending below the index
+			// the leader first probes.
+			newNode := func(id uint64, term uint64, n int) *raft {
+				s := newTestMemoryStorage(withPeers(1, 2))
+				ents := index(1).terms(1)
+				for i := 0; i < n; i++ {
+					ents = append(ents, pb.Entry{Index: uint64(i) + 2, Term: term})
+				}
+				require.NoError(t, s.Append(ents))
+				require.NoError(t, s.SetHardState(pb.HardState{Term: 3, Commit: 1}))
+				c := newTestConfig(id, 10, 1, s)
+				c.MaxRejectHintScan = 5
+				c.OptimalRejectHint = tt.optimal
+				return newRaft(c)
+			}
+			a, b := newNode(1, 3, 50), newNode(2, 2, 20)
+			nt := newNetwork(a, b)
+			var rejections int
+			nt.msgHook = func(m pb.Message) bool {
+				if m.Type == pb.MsgAppResp && m.Reject {
+					rejections++
+				}
+				return true
+			}
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+			require.Equal(t, StateLeader, a.state)
+			require.Equal(t, tt.rejections, rejections)
+			require.Equal(t, a.raftLog.allEntries(), b.raftLog.allEntries())
+			require.Equal(t, uint64(52), b.raftLog.committed)
+		})
+	}
+}
+
+// TestNetworkDropEvery tests that the network harness deterministically drops
+// every nth message of a given type on a given connection.
+func TestNetworkDropEvery(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.dropEvery(1, 3, pb.MsgApp, 2)
+	var msgs []pb.Message
+	for i := uint64(1); i <= 6; i++ {
+		msgs = append(msgs,
+			pb.Message{From: 1, To: 3, Type: pb.MsgApp, Index: i},
+			pb.Message{From: 1, To: 3, Type: pb.MsgHeartbeat, Commit: i},
+			pb.Message{From: 1, To: 2, Type: pb.MsgApp, Index: i},
+		)
+	}
+	var got []uint64
+	for _, m := range nt.filter(msgs) {
+		if m.To == 3 && m.Type == pb.MsgApp {
+			got = append(got, m.Index)
+		}
+	}
+	require.Equal(t, []uint64{1, 3, 5}, got)
+	require.Len(t, nt.filter(msgs), 6*3-3)
+
+	// The counter restarts when the filter is reconfigured.
+	nt.dropEvery(1, 3, pb.MsgApp, 3)
+	require.Len(t, nt.filter(msgs), 6*3-2)
+	nt.dropEvery(1, 3, pb.MsgApp, 0)
+	require.Len(t, nt.filter(msgs), 6*3)
+}
+
+// TestNetworkIgnore tests that the network harness drops the ignored message
+// types until they are unignored.
+func TestNetworkIgnore(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	require.Empty(t, nt.ignoredTypes())
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+	r2 := nt.peers[2].(*raft)
+	require.Equal(t, uint64(1), r2.raftLog.lastIndex())
+
+	nt.ignore(pb.MsgHeartbeat, pb.MsgApp)
+	require.Equal(t, []pb.MessageType{pb.MsgApp, pb.MsgHeartbeat}, nt.ignoredTypes())
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{{Data: []byte("a")}}})
+	require.Equal(t, uint64(1), r2.raftLog.lastIndex())
+
+	nt.unignore(pb.MsgApp)
+	require.Equal(t, []pb.MessageType{pb.MsgHeartbeat}, nt.ignoredTypes())
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{{Data: []byte("b")}}})
+	require.Equal(t, uint64(3), r2.raftLog.lastIndex())
+	nt.recover()
+	require.Empty(t, nt.ignoredTypes())
+}
+
 // TestStepIgnoreOldTermMsg to ensure that the Step function ignores the message
 // from old term and does not pass it to the actual stepX function.
 func TestStepIgnoreOldTermMsg(t *testing.T) {
@@ -1949,6 +2731,38 @@ func TestReadOnlyOptionSafe(t *testing.T) {
 	}
 }
 
+// TestDedupReadStates tests that with Config.DedupReadStates, a read retried
+// with the same context before the ReadStates are consumed does not produce a
+// duplicate ReadState, neither on the leader nor on a follower.
+func TestDedupReadStates(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		t.Run(fmt.Sprint(dedup), func(t *testing.T) {
+			nt := newNetworkWithConfig(func(c *Config) {
+				c.DedupReadStates = dedup
+			}, nil, nil, nil)
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+
+			for _, id := range []uint64{1, 2} {
+				r := nt.peers[id].(*raft)
+				for _, ctx := range []string{"a", "a", "b"} {
+					nt.send(pb.Message{From: id, To: id, Type: pb.MsgReadIndex, Entries: []pb.Entry{{Data: []byte(ctx)}}})
+					nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{{}}})
+				}
+				want := []ReadState{
+					{Index: r.raftLog.committed - 3, RequestCtx: []byte("a")},
+					{Index: r.raftLog.committed - 2, RequestCtx: []byte("a")},
+					{Index: r.raftLog.committed - 1, RequestCtx: []byte("b")},
+				}
+				if dedup {
+					want = append(want[:1], want[2])
+				}
+				require.Equal(t, want, r.readStates, "id %d", id)
+				r.readStates = nil
+			}
+		})
+	}
+}
+
 func TestReadOnlyWithLearner(t *testing.T) {
 	s := newTestMemoryStorage(withPeers(1), withLearners(2))
 	a := newTestLearnerRaft(1, 10, 1, s)
@@ -2382,6 +3196,50 @@ func TestRecvMsgUnreachable(t *testing.T) {
 	assert.Equal(t, wnext, r.trk.Progress[2].Next)
 }
 
+// restoreSnapshot calls r.restore, and requires the snapshot's ConfState to
+// match the restored configuration.
+func restoreSnapshot(t *testing.T, r *raft, s pb.Snapshot) bool {
+	ok, err := r.restore(s)
+	require.NoError(t, err)
+	return ok
+}
+
+// TestConfStateMismatchNonFatal tests that with Config.ConfStateMismatchNonFatal
+// a node restoring a ConfState which does not match the derived configuration
+// reports the mismatch and continues, both on startup and when receiving a
+// snapshot.
+func TestConfStateMismatchNonFatal(t *testing.T) {
+	// The duplicate voter is lost when the configuration is restored.
+	divergent := pb.ConfState{Voters: []uint64{1, 2, 2}}
+
+	s := NewMemoryStorage()
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index: 1, Term: 1, ConfState: divergent,
+	}}))
+	cfg := newTestConfig(1, 10, 1, s)
+	require.Panics(t, func() { newRaft(cfg) })
+
+	l := &errorRecordingLogger{DefaultLogger: discardLogger}
+	cfg.Logger = l
+	cfg.ConfStateMismatchNonFatal = true
+	r := newRaft(cfg)
+	require.Len(t, l.errors, 1)
+	require.Contains(t, l.errors[0], "mismatching ConfState")
+	require.Equal(t, pb.ConfState{Voters: []uint64{1, 2}}, r.trk.ConfState())
+
+	// A snapshot with a mismatching ConfState is restored, and the mismatch is
+	// returned by Step.
+	snap := pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index: 5, Term: 2, ConfState: pb.ConfState{Voters: []uint64{1, 2, 3, 3}},
+	}}
+	err := r.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgSnap, Snapshot: &snap})
+	require.Error(t, err)
+	require.Len(t, l.errors, 2)
+	require.Equal(t, uint64(5), r.raftLog.lastIndex())
+	require.Equal(t, pb.ConfState{Voters: []uint64{1, 2, 3}}, r.trk.ConfState())
+	require.Equal(t, []pb.Message{{From: 1, To: 2, Term: 2, Type: pb.MsgAppResp, Index: 5}}, r.readMessages())
+}
+
 func TestRestore(t *testing.T) {
 	s := pb.Snapshot{
 		Metadata: pb.SnapshotMetadata{
@@ -2393,13 +3251,13 @@ func TestRestore(t *testing.T) {
 
 	storage := newTestMemoryStorage(withPeers(1, 2))
 	sm := newTestRaft(1, 10, 1, storage)
-	require.True(t, sm.restore(s))
+	require.True(t, restoreSnapshot(t, sm, s))
 
 	assert.Equal(t, s.Metadata.Index, sm.raftLog.lastIndex())
 	assert.Equal(t, s.Metadata.Term, mustTerm(sm.raftLog.term(s.Metadata.Index)))
 	assert.Equal(t, s.Metadata.ConfState.Voters, sm.trk.VoterNodes())
 
-	require.False(t, sm.restore(s))
+	require.False(t, restoreSnapshot(t, sm, s))
 	for i := 0; i < sm.randomizedElectionTimeout; i++ {
 		sm.tick()
 	}
@@ -2418,7 +3276,7 @@ func TestRestoreWithLearner(t *testing.T) {
 
 	storage := newTestMemoryStorage(withPeers(1, 2), withLearners(3))
 	sm := newTestLearnerRaft(3, 8, 2, storage)
-	assert.True(t, sm.restore(s))
+	assert.True(t, restoreSnapshot(t, sm, s))
 
 	assert.Equal(t, s.Metadata.Index, sm.raftLog.lastIndex())
 	assert.Equal(t, s.Metadata.Term, mustTerm(sm.raftLog.term(s.Metadata.Index)))
@@ -2436,7 +3294,7 @@ func TestRestoreWithLearner(t *testing.T) {
 		assert.True(t, sm.trk.Progress[n].IsLearner)
 	}
 
-	assert.False(t, sm.restore(s))
+	assert.False(t, restoreSnapshot(t, sm, s))
 }
 
 // TestRestoreWithVotersOutgoing tests if outgoing voter can receive and apply snapshot correctly.
@@ -2451,7 +3309,7 @@ func TestRestoreWithVotersOutgoing(t *testing.T) {
 
 	storage := newTestMemoryStorage(withPeers(1, 2))
 	sm := newTestRaft(1, 10, 1, storage)
-	require.True(t, sm.restore(s))
+	require.True(t, restoreSnapshot(t, sm, s))
 
 	assert.Equal(t, s.Metadata.Index, sm.raftLog.lastIndex())
 	assert.Equal(t, mustTerm(sm.raftLog.term(s.Metadata.Index)), s.Metadata.Term)
@@ -2459,7 +3317,7 @@ func TestRestoreWithVotersOutgoing(t *testing.T) {
 	sg := sm.trk.VoterNodes()
 	assert.Equal(t, []uint64{1, 2, 3, 4}, sg)
 
-	require.False(t, sm.restore(s))
+	require.False(t, restoreSnapshot(t, sm, s))
 
 	// It should not campaign before actually applying data.
 	for i := 0; i < sm.randomizedElectionTimeout; i++ {
@@ -2489,7 +3347,7 @@ func TestRestoreVoterToLearner(t *testing.T) {
 	sm := newTestRaft(3, 10, 1, storage)
 
 	assert.False(t, sm.isLearner)
-	assert.True(t, sm.restore(s))
+	assert.True(t, restoreSnapshot(t, sm, s))
 }
 
 // TestRestoreLearnerPromotion checks that a learner can become to a follower after
@@ -2507,7 +3365,7 @@ func TestRestoreLearnerPromotion(t *testing.T) {
 	sm := newTestLearnerRaft(3, 10, 1, storage)
 
 	assert.True(t, sm.isLearner)
-	assert.True(t, sm.restore(s))
+	assert.True(t, restoreSnapshot(t, sm, s))
 	assert.False(t, sm.isLearner)
 }
 
@@ -2560,12 +3418,12 @@ func TestRestoreIgnoreSnapshot(t *testing.T) {
 	}
 
 	// ignore snapshot
-	assert.False(t, sm.restore(s))
+	assert.False(t, restoreSnapshot(t, sm, s))
 	assert.Equal(t, sm.raftLog.committed, commit)
 
 	// ignore snapshot and fast forward commit
 	s.Metadata.Index = commit + 1
-	assert.False(t, sm.restore(s))
+	assert.False(t, restoreSnapshot(t, sm, s))
 	assert.Equal(t, sm.raftLog.committed, commit+1)
 }
 
@@ -2595,6 +3453,178 @@ func TestProvideSnap(t *testing.T) {
 	assert.Equal(t, m.Type, pb.MsgSnap)
 }
 
+// unavailableSnapshotStorage is a MemoryStorage whose snapshot is always
+// temporarily unavailable.
+type unavailableSnapshotStorage struct {
+	*MemoryStorage
+}
+
+func (unavailableSnapshotStorage) Snapshot() (pb.Snapshot, error) {
+	return pb.Snapshot{}, ErrSnapshotTemporarilyUnavailable
+}
+
+// TestSnapshotProvider ensures that the leader obtains a snapshot from
+// Config.SnapshotProvider when the storage has none available, and caches it
+// only while a snapshot is being sent.
+func TestSnapshotProvider(t *testing.T) {
+	ms := newTestMemoryStorage(withPeers(1, 2))
+	snap := pb.Snapshot{
+		Data: []byte("data"),
+		Metadata: pb.SnapshotMetadata{
+			Index:     11,
+			Term:      11,
+			ConfState: pb.ConfState{Voters: []uint64{1, 2}},
+		},
+	}
+	require.NoError(t, ms.ApplySnapshot(snap))
+	require.NoError(t, ms.SetHardState(pb.HardState{Term: 11, Commit: 11}))
+
+	var calls []uint64
+	cfg := newTestConfig(1, 10, 1, unavailableSnapshotStorage{ms})
+	cfg.SnapshotProvider = func(index uint64) (pb.Snapshot, error) {
+		calls = append(calls, index)
+		return snap, nil
+	}
+	sm := newRaft(cfg)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.readMessages()
+
+	// Make node 2 need a snapshot.
+	sm.trk.Progress[2].Next = sm.raftLog.firstIndex()
+	require.NoError(t, sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, Type: pb.MsgAppResp, Index: 11, Reject: true}))
+	msgs := sm.readMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, pb.MsgSnap, msgs[0].Type)
+	assert.Equal(t, snap, *msgs[0].Snapshot)
+	assert.Equal(t, []uint64{11}, calls)
+
+	// After a failed snapshot, the next one is served from the cache.
+	sm.Step(pb.Message{From: 2, To: 1, Type: pb.MsgSnapStatus, Reject: true})
+	sm.trk.Progress[2].Next = sm.raftLog.firstIndex()
+	require.NoError(t, sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, Type: pb.MsgAppResp, Index: 11, Reject: true}))
+	msgs = sm.readMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, pb.MsgSnap, msgs[0].Type)
+	assert.Equal(t, []uint64{11}, calls)
+
+	// Once no follower is receiving a snapshot, the cache is dropped on the
+	// next tick, and a newer snapshot is obtained for the next follower.
+	sm.Step(pb.Message{From: 2, To: 1, Type: pb.MsgSnapStatus, Reject: true})
+	sm.tick()
+	assert.Nil(t, sm.providedSnapshot)
+	sm.trk.Progress[2].Next = sm.raftLog.firstIndex()
+	require.NoError(t, sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, Type: pb.MsgAppResp, Index: 11, Reject: true}))
+	assert.Equal(t, []uint64{11, 11}, calls)
+	require.NotNil(t, sm.providedSnapshot)
+
+	// The cache is dropped when the node steps down.
+	sm.becomeFollower(sm.Term+1, None)
+	assert.Nil(t, sm.providedSnapshot)
+}
+
+// TestSnapshotReadRateTicks verifies that the leader spaces out the snapshot
+// reads for followers needing a snapshot by Config.SnapshotReadRateTicks.
+func TestSnapshotReadRateTicks(t *testing.T) {
+	ms := newTestMemoryStorage(withPeers(1, 2, 3, 4))
+	require.NoError(t, ms.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index:     11,
+		Term:      11,
+		ConfState: pb.ConfState{Voters: []uint64{1, 2, 3, 4}},
+	}}))
+	require.NoError(t, ms.SetHardState(pb.HardState{Term: 11, Commit: 11}))
+
+	cfg := newTestConfig(1, 10, 1, ms)
+	cfg.SnapshotReadRateTicks = 3
+	sm := newRaft(cfg)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.readMessages()
+
+	// All followers need a snapshot, but only the first one gets it right away.
+	for id := uint64(2); id <= 4; id++ {
+		sm.trk.Progress[id].Next = sm.raftLog.firstIndex()
+		require.NoError(t, sm.Step(pb.Message{From: id, To: 1, Term: sm.Term, Type: pb.MsgAppResp, Index: 11, Reject: true}))
+	}
+	sent := map[uint64]int{}
+	collect := func(tick int) {
+		for _, m := range sm.readMessages() {
+			if m.Type == pb.MsgSnap {
+				_, ok := sent[m.To]
+				require.False(t, ok, "second snapshot to %x", m.To)
+				sent[m.To] = tick
+			}
+		}
+	}
+	collect(0)
+	require.Equal(t, map[uint64]int{2: 0}, sent)
+
+	// The others are sent a snapshot when they respond to heartbeats, at most
+	// one every 3 ticks.
+	for tick := 1; tick <= 10; tick++ {
+		sm.tick()
+		for id := uint64(2); id <= 4; id++ {
+			require.NoError(t, sm.Step(pb.Message{From: id, To: 1, Term: sm.Term, Type: pb.MsgHeartbeatResp}))
+		}
+		collect(tick)
+	}
+	require.Equal(t, map[uint64]int{2: 0, 3: 3, 4: 6}, sent)
+}
+
+// flakySnapshotStorage is a MemoryStorage whose Snapshot returns
+// ErrSnapshotTemporarilyUnavailable while unavailable is set.
+type flakySnapshotStorage struct {
+	*MemoryStorage
+	unavailable bool
+}
+
+func (s *flakySnapshotStorage) Snapshot() (pb.Snapshot, error) {
+	if s.unavailable {
+		return pb.Snapshot{}, ErrSnapshotTemporarilyUnavailable
+	}
+	return s.MemoryStorage.Snapshot()
+}
+
+// TestSnapshotReadRateTicksUnavailable verifies that a snapshot read failing
+// with ErrSnapshotTemporarilyUnavailable does not delay the retry by
+// Config.SnapshotReadRateTicks.
+func TestSnapshotReadRateTicksUnavailable(t *testing.T) {
+	ms := newTestMemoryStorage(withPeers(1, 2))
+	require.NoError(t, ms.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index:     11,
+		Term:      11,
+		ConfState: pb.ConfState{Voters: []uint64{1, 2}},
+	}}))
+	require.NoError(t, ms.SetHardState(pb.HardState{Term: 11, Commit: 11}))
+	s := &flakySnapshotStorage{MemoryStorage: ms}
+
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.SnapshotReadRateTicks = 3
+	sm := newRaft(cfg)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.readMessages()
+
+	s.unavailable = true
+	sm.trk.Progress[2].Next = sm.raftLog.firstIndex()
+	require.NoError(t, sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, Type: pb.MsgAppResp, Index: 11, Reject: true}))
+	for _, m := range sm.readMessages() {
+		require.NotEqual(t, pb.MsgSnap, m.Type)
+	}
+
+	// The snapshot is sent on the next attempt once it is available.
+	s.unavailable = false
+	sm.tick()
+	require.NoError(t, sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, Type: pb.MsgHeartbeatResp}))
+	var snaps int
+	for _, m := range sm.readMessages() {
+		if m.Type == pb.MsgSnap {
+			snaps++
+		}
+	}
+	require.Equal(t, 1, snaps)
+}
+
 func TestIgnoreProvidingSnap(t *testing.T) {
 	// restore the state machine from a snapshot so it has a compacted log and a snapshot
 	s := pb.Snapshot{
@@ -2639,6 +3669,76 @@ func TestRestoreFromSnapMsg(t *testing.T) {
 	// TODO(bdarnell): what should this test?
 }
 
+// TestRejectStaleTermSnapshot ensures that a follower rejects a snapshot whose
+// term is below the term of its own entry at the snapshot index, without
+// changing its state.
+func TestRejectStaleTermSnapshot(t *testing.T) {
+	sm := newTestRaft(2, 10, 1, newTestMemoryStorage(withPeers(1, 2)))
+	sm.becomeFollower(3, 1)
+	sm.raftLog.append(index(1).terms(1, 3, 3)...)
+	sm.raftLog.commitTo(1)
+
+	snap := &pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index:     3,
+		Term:      2,
+		ConfState: pb.ConfState{Voters: []uint64{1, 2}},
+	}}
+	require.NoError(t, sm.Step(pb.Message{Type: pb.MsgSnap, From: 1, To: 2, Term: 3, Snapshot: snap}))
+
+	assert.Nil(t, sm.raftLog.unstable.snapshot)
+	assert.Equal(t, uint64(1), sm.raftLog.committed)
+	assert.Equal(t, uint64(3), sm.raftLog.lastIndex())
+	assert.Equal(t, []pb.Message{
+		{From: 2, To: 1, Term: 3, Type: pb.MsgAppResp, Index: 1},
+	}, sm.readMessages())
+}
+
+// TestAcceptOverlappingAppends tests that a follower configured with
+// AcceptOverlappingAppends accepts a MsgApp overlapping the snapshot it has
+// just installed, without another round trip to the leader.
+func TestAcceptOverlappingAppends(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		t.Run(fmt.Sprint(accept), func(t *testing.T) {
+			cfg := newTestConfig(2, 10, 1, newTestMemoryStorage(withPeers(1, 2)))
+			cfg.AcceptOverlappingAppends = accept
+			sm := newRaft(cfg)
+			sm.becomeFollower(3, 1)
+
+			snap := &pb.Snapshot{Metadata: pb.SnapshotMetadata{
+				Index:     5,
+				Term:      2,
+				ConfState: pb.ConfState{Voters: []uint64{1, 2}},
+			}}
+			require.NoError(t, sm.Step(pb.Message{Type: pb.MsgSnap, From: 1, To: 2, Term: 3, Snapshot: snap}))
+			sm.readMessages()
+
+			// A MsgApp sent before the leader learned about the snapshot.
+			require.NoError(t, sm.Step(pb.Message{
+				Type: pb.MsgApp, From: 1, To: 2, Term: 3, Index: 3, LogTerm: 2, Commit: 6,
+				Entries: index(4).terms(2, 2, 3, 3),
+			}))
+			want := uint64(5)
+			if accept {
+				want = 7
+			}
+			assert.Equal(t, want, sm.raftLog.lastIndex())
+			assert.Equal(t, min(want, 6), sm.raftLog.committed)
+			assert.Equal(t, []pb.Message{
+				{From: 2, To: 1, Term: 3, Type: pb.MsgAppResp, Index: want},
+			}, sm.readMessages())
+
+			// A MsgApp entirely below the commit index is answered with it.
+			require.NoError(t, sm.Step(pb.Message{
+				Type: pb.MsgApp, From: 1, To: 2, Term: 3, Index: 2, LogTerm: 2, Commit: 6,
+				Entries: index(3).terms(2, 2),
+			}))
+			assert.Equal(t, []pb.Message{
+				{From: 2, To: 1, Term: 3, Type: pb.MsgAppResp, Index: sm.raftLog.committed},
+			}, sm.readMessages())
+		})
+	}
+}
+
 func TestSlowNodeRestore(t *testing.T) {
 	nt := newNetwork(nil, nil, nil)
 	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
@@ -3127,6 +4227,72 @@ func TestLeaderTransferTimeout(t *testing.T) {
 	checkLeaderTransferState(t, lead, StateLeader, 1)
 }
 
+// TestLeaderTransferTimeoutResumes verifies that a leadership transfer which
+// stalls for an election timeout is aborted cleanly: the leader keeps its
+// leadership, accepts and replicates proposals again, and can start another
+// transfer.
+func TestLeaderTransferTimeoutResumes(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+	nt.isolate(3)
+	lead := nt.peers[1].(*raft)
+
+	nt.send(pb.Message{From: 3, To: 1, Type: pb.MsgTransferLeader})
+	require.Equal(t, uint64(3), lead.leadTransferee)
+	require.Equal(t, ErrProposalDropped, lead.Step(pb.Message{From: 1, To: 1, Type: pb.MsgProp,
+		Entries: []pb.Entry{{Data: []byte("foo")}}}))
+
+	for i := 0; i < lead.electionTimeout; i++ {
+		lead.tick()
+	}
+	checkLeaderTransferState(t, lead, StateLeader, 1)
+
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgProp, Entries: []pb.Entry{{Data: []byte("foo")}}})
+	follower := nt.peers[2].(*raft)
+	require.Equal(t, lead.raftLog.committed, lead.raftLog.lastIndex())
+	require.Equal(t, lead.raftLog.lastIndex(), follower.raftLog.lastIndex())
+
+	nt.recover()
+	nt.send(pb.Message{From: 2, To: 1, Type: pb.MsgTransferLeader})
+	checkLeaderTransferState(t, lead, StateFollower, 2)
+}
+
+// TestLeaderTransferAbortOnElectionTimeout verifies that with
+// Config.TransferAbortOnElectionTimeout a stalled leadership transfer is aborted
+// when the leader's current election timeout fires, instead of a full election
+// timeout after it started.
+func TestLeaderTransferAbortOnElectionTimeout(t *testing.T) {
+	for _, abort := range []bool{false, true} {
+		t.Run(fmt.Sprint(abort), func(t *testing.T) {
+			cfg := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+			cfg.TransferAbortOnElectionTimeout = abort
+			nt := newNetwork(newRaft(cfg), nil, nil)
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+			nt.isolate(3)
+			lead := nt.peers[1].(*raft)
+
+			for i := 0; i < lead.electionTimeout/2; i++ {
+				lead.tick()
+			}
+			nt.send(pb.Message{From: 3, To: 1, Type: pb.MsgTransferLeader})
+			require.Equal(t, uint64(3), lead.leadTransferee)
+
+			for i := 0; i < lead.electionTimeout/2; i++ {
+				lead.tick()
+			}
+			if abort {
+				checkLeaderTransferState(t, lead, StateLeader, 1)
+				return
+			}
+			require.Equal(t, uint64(3), lead.leadTransferee)
+			for i := 0; i < lead.electionTimeout/2; i++ {
+				lead.tick()
+			}
+			checkLeaderTransferState(t, lead, StateLeader, 1)
+		})
+	}
+}
+
 func TestLeaderTransferIgnoreProposal(t *testing.T) {
 	s := newTestMemoryStorage(withPeers(1, 2, 3))
 	r := newTestRaft(1, 10, 1, s)
@@ -3366,6 +4532,44 @@ func TestNodeWithSmallerTermCanCompleteElection(t *testing.T) {
 	assert.True(t, sma.state == StateLeader || smb.state == StateLeader)
 }
 
+// TestPreVoteTick tests that a pre-candidate which doesn't win the pre-vote
+// starts a new one after Config.PreVoteTick rather than ElectionTick.
+func TestPreVoteTick(t *testing.T) {
+	for _, tt := range []struct {
+		preVoteTick int
+		lo, hi      int // range of ticks after which the pre-vote restarts
+	}{
+		{0, 10, 19},
+		{3, 3, 5},
+	} {
+		t.Run(fmt.Sprint(tt.preVoteTick), func(t *testing.T) {
+			nt := newNetworkWithConfig(func(c *Config) {
+				c.PreVote = true
+				c.PreVoteTick = tt.preVoteTick
+			}, nil, nil, nil)
+			nt.isolate(1)
+			nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+			r := nt.peers[1].(*raft)
+			require.Equal(t, StatePreCandidate, r.state)
+
+			for round := 0; round < 3; round++ {
+				ticks := 0
+				for r.readMessages() == nil {
+					r.tick()
+					ticks++
+					require.LessOrEqual(t, ticks, tt.hi)
+				}
+				require.GreaterOrEqual(t, ticks, tt.lo)
+				require.Equal(t, StatePreCandidate, r.state)
+			}
+		})
+	}
+
+	c := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1)))
+	c.PreVoteTick = -1
+	require.Error(t, c.validate())
+}
+
 // TestPreVoteWithSplitVote verifies that after split vote, cluster can complete
 // election in next round.
 func TestPreVoteWithSplitVote(t *testing.T) {
@@ -3734,6 +4938,31 @@ func TestFastLogRejection(t *testing.T) {
 			nextAppendTerm:  1,
 			nextAppendIndex: 1,
 		},
+		// This case tests that a follower with a gap in the log before the
+		// appended entries gives a hint at its last index, which lets the leader
+		// converge in a single round.
+		// Firstly leader appends (type=MsgApp,index=8,logTerm=2, entries=...);
+		// After rejected leader appends (type=MsgApp,index=3,logTerm=2).
+		{
+			leaderLog:       index(1).terms(1, 1, 2, 2, 2, 2, 2, 2),
+			followerLog:     index(1).terms(1, 1, 2),
+			rejectHintTerm:  2,
+			rejectHintIndex: 3,
+			nextAppendTerm:  2,
+			nextAppendIndex: 3,
+		},
+		// Same as above, but the follower's last entry conflicts with the leader's
+		// log. The leader skips it based on the hint term.
+		// Firstly leader appends (type=MsgApp,index=8,logTerm=3, entries=...);
+		// After rejected leader appends (type=MsgApp,index=2,logTerm=1).
+		{
+			leaderLog:       index(1).terms(1, 1, 3, 3, 3, 3, 3, 3),
+			followerLog:     index(1).terms(1, 1, 2),
+			rejectHintTerm:  2,
+			rejectHintIndex: 3,
+			nextAppendTerm:  1,
+			nextAppendIndex: 2,
+		},
 		// An normal case that there are no log conflicts.
 		// Firstly leader appends (type=MsgApp,index=5,logTerm=5, entries=...);
 		// After rejected leader appends (type=MsgApp,index=4,logTerm=4).
@@ -3924,6 +5153,9 @@ type network struct {
 	storage map[uint64]*MemoryStorage
 	dropm   map[connem]float64
 	ignorem map[pb.MessageType]bool
+	// dropNth and dropSeen implement dropEvery.
+	dropNth  map[dropKey]int
+	dropSeen map[dropKey]int
 
 	// msgHook is called for each message sent. It may inspect the
 	// message and return true to send it or false to drop it.
@@ -4016,6 +5248,18 @@ func (nw *network) drop(from, to uint64, perc float64) {
 	nw.dropm[connem{from, to}] = perc
 }
 
+// dropEvery deterministically drops every nth message of the given type from
+// one node to another. A non-positive n stops dropping them.
+func (nw *network) dropEvery(from, to uint64, typ pb.MessageType, n int) {
+	if nw.dropNth == nil {
+		nw.dropNth = make(map[dropKey]int)
+		nw.dropSeen = make(map[dropKey]int)
+	}
+	k := dropKey{connem{from, to}, typ}
+	nw.dropNth[k] = n
+	nw.dropSeen[k] = 0
+}
+
 func (nw *network) cut(one, other uint64) {
 	nw.drop(one, other, 2.0) // always drop
 	nw.drop(other, one, 2.0) // always drop
@@ -4031,13 +5275,38 @@ func (nw *network) isolate(id uint64) {
 	}
 }
 
-func (nw *network) ignore(t pb.MessageType) {
-	nw.ignorem[t] = true
+// ignore drops all messages of the given types, until they are unignored or
+// the network recovers.
+func (nw *network) ignore(types ...pb.MessageType) {
+	for _, t := range types {
+		nw.ignorem[t] = true
+	}
+}
+
+// unignore stops dropping messages of the given types.
+func (nw *network) unignore(types ...pb.MessageType) {
+	for _, t := range types {
+		delete(nw.ignorem, t)
+	}
+}
+
+// ignoredTypes returns the message types currently ignored, in increasing
+// order.
+func (nw *network) ignoredTypes() []pb.MessageType {
+	var types []pb.MessageType
+	for t, ignored := range nw.ignorem {
+		if ignored {
+			types = append(types, t)
+		}
+	}
+	slices.Sort(types)
+	return types
 }
 
 func (nw *network) recover() {
 	nw.dropm = make(map[connem]float64)
 	nw.ignorem = make(map[pb.MessageType]bool)
+	nw.dropNth, nw.dropSeen = nil, nil
 }
 
 func (nw *network) filter(msgs []pb.Message) []pb.Message {
@@ -4055,6 +5324,12 @@ func (nw *network) filter(msgs []pb.Message) []pb.Message {
 			if n := rand.Float64(); n < perc {
 				continue
 			}
+			if k := (dropKey{connem{m.From, m.To}, m.Type}); nw.dropNth[k] > 0 {
+				nw.dropSeen[k]++
+				if nw.dropSeen[k]%nw.dropNth[k] == 0 {
+					continue
+				}
+			}
 		}
 		if nw.msgHook != nil {
 			if !nw.msgHook(m) {
@@ -4070,6 +5345,11 @@ type connem struct {
 	from, to uint64
 }
 
+type dropKey struct {
+	connem
+	typ pb.MessageType
+}
+
 type blackHole struct{}
 
 func (blackHole) Step(pb.Message) error       { return nil }
@@ -39,13 +39,19 @@ type node struct {
 	state raftpb.HardState
 }
 
+// stableStorage hides the Close method of the stable storage from raft, which
+// would otherwise close it on Stop, since the storage outlives restarts.
+type stableStorage struct {
+	raft.Storage
+}
+
 func startNode(id uint64, peers []raft.Peer, iface iface) *node {
 	st := raft.NewMemoryStorage()
 	c := &raft.Config{
 		ID:                        id,
 		ElectionTick:              10,
 		HeartbeatTick:             1,
-		Storage:                   st,
+		Storage:                   stableStorage{st},
 		MaxSizePerMsg:             1024 * 1024,
 		MaxInflightMsgs:           256,
 		MaxUncommittedEntriesSize: 1 << 30,
@@ -135,7 +141,7 @@ func (n *node) restart() {
 		ID:                        n.id,
 		ElectionTick:              10,
 		HeartbeatTick:             1,
-		Storage:                   n.storage,
+		Storage:                   stableStorage{n.storage},
 		MaxSizePerMsg:             1024 * 1024,
 		MaxInflightMsgs:           256,
 		MaxUncommittedEntriesSize: 1 << 30,
@@ -15,8 +15,13 @@
 package raft
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"slices"
 
+	"go.etcd.io/raft/v3/confchange"
 	pb "go.etcd.io/raft/v3/raftpb"
 	"go.etcd.io/raft/v3/tracker"
 )
@@ -28,17 +33,50 @@ var ErrStepLocalMsg = errors.New("raft: cannot step raft local message")
 // but there is no peer found in raft.trk for that node.
 var ErrStepPeerNotFound = errors.New("raft: cannot step as peer not found")
 
+// ErrEmptyReadContext is returned by RawNode.ReadIndexWithContext when the
+// given context is empty.
+var ErrEmptyReadContext = errors.New("raft: read context must not be empty")
+
+// ErrDuplicateReadContext is returned by RawNode.ReadIndexWithContext when the
+// given context was used by one of the recent requests.
+var ErrDuplicateReadContext = errors.New("raft: read context used by a recent request")
+
 // RawNode is a thread-unsafe Node.
 // The methods of this struct correspond to the methods of Node and are described
 // more fully there.
 type RawNode struct {
 	raft               *raft
 	asyncStorageWrites bool
+	syncPolicy         func(rd Ready) bool
+	reportEmptyEntries bool
+	maxResponses       int
+	maxMessages        int
+	// logSizer is the Storage if Config.SnapshotOnLogBytes is set, otherwise
+	// nil.
+	logSizer           logSizer
+	snapshotOnLogBytes uint64
+	snapshotProgress   func(applied, total uint64)
 
 	// Mutable fields.
 	prevSoftSt     *SoftState
 	prevHardSt     pb.HardState
 	stepsOnAdvance []pb.Message
+	// readCtxs holds the last len(readCtxs) read contexts passed to
+	// ReadIndexWithContext, as a ring buffer starting at readCtxNext. They are
+	// also the keys of readCtxSet.
+	readCtxs    []string
+	readCtxNext int
+	readCtxSet  map[string]struct{}
+	// suppressedAcks holds the peers whose MsgAppResp are dropped, see
+	// SuppressAcks.
+	suppressedAcks map[uint64]bool
+	// proposals maps the IDs of the unresolved tokens returned by
+	// ProposeWithResult to the state of their proposals.
+	proposals      map[uint64]*trackedProposal
+	nextProposalID uint64
+	// taggedProposals maps the indexes of the entries proposed with
+	// ProposeWithID to their term and ID, until they are committed.
+	taggedProposals map[uint64]taggedProposal
 }
 
 // NewRawNode instantiates a RawNode from the given configuration.
@@ -54,12 +92,52 @@ func NewRawNode(config *Config) (*RawNode, error) {
 		raft: r,
 	}
 	rn.asyncStorageWrites = config.AsyncStorageWrites
+	rn.syncPolicy = config.SyncPolicy
+	rn.reportEmptyEntries = config.ReportEmptyEntries
+	rn.maxResponses = config.MaxResponsesPerMessage
+	rn.maxMessages = config.MaxMessagesPerReady
+	rn.snapshotProgress = config.SnapshotProgress
+	if config.SnapshotOnLogBytes > 0 {
+		rn.logSizer, _ = storageLogSizer(config.Storage)
+		rn.snapshotOnLogBytes = config.SnapshotOnLogBytes
+	}
+	if n := config.ReadContextWindow; n > 0 {
+		rn.readCtxs = make([]string, 0, n)
+		rn.readCtxSet = make(map[string]struct{}, n)
+	}
 	ss := r.softState()
 	rn.prevSoftSt = &ss
 	rn.prevHardSt = r.hardState()
 	return rn, nil
 }
 
+// logSizer is implemented by a Storage that can report the size of the log
+// entries it holds, see Config.SnapshotOnLogBytes.
+type logSizer interface {
+	SizeInBytes() uint64
+}
+
+// storageWrapper is implemented by a Storage wrapping another one, like
+// MeteredStorage.
+type storageWrapper interface {
+	Unwrap() Storage
+}
+
+// storageLogSizer returns the given Storage, or the innermost Storage it wraps
+// which implements logSizer, if any.
+func storageLogSizer(s Storage) (logSizer, bool) {
+	for {
+		if ls, ok := s.(logSizer); ok {
+			return ls, true
+		}
+		w, ok := s.(storageWrapper)
+		if !ok {
+			return nil, false
+		}
+		s = w.Unwrap()
+	}
+}
+
 // Tick advances the internal logical clock by a single tick.
 func (rn *RawNode) Tick() {
 	rn.raft.tick()
@@ -96,6 +174,267 @@ func (rn *RawNode) Propose(data []byte) error {
 		}})
 }
 
+// HasPendingConfChange returns true if the log contains a configuration change
+// entry, of either type, which has not been applied yet. Such an entry may or
+// may not be committed. While this is the case, the leader does not accept a
+// new configuration change, so the application can check this before calling
+// ProposeConfChange.
+func (rn *RawNode) HasPendingConfChange() bool {
+	return rn.raft.hasConfChangesAfterApplied(rn.raft.raftLog.lastIndex())
+}
+
+// AppliedConfChangeIndexes returns the indexes, in increasing order, of the
+// configuration change entries of either type at or below the applied index.
+// Only entries still in the log are considered, i.e. those above the index of
+// the last snapshot or compaction. The application can use this to check that
+// all configuration changes below a snapshot index are reflected in the
+// snapshot's ConfState. If the entries can not be read from the Storage, the
+// error is logged and nil is returned.
+func (rn *RawNode) AppliedConfChangeIndexes() []uint64 {
+	r := rn.raft
+	lo, hi := r.raftLog.firstIndex(), r.raftLog.applied+1
+	if lo >= hi {
+		return nil
+	}
+	var indexes []uint64
+	if err := r.raftLog.scan(lo, hi, r.raftLog.maxApplyingEntsSize, func(ents []pb.Entry) error {
+		for i := range ents {
+			if ents[i].Type == pb.EntryConfChange || ents[i].Type == pb.EntryConfChangeV2 {
+				indexes = append(indexes, ents[i].Index)
+			}
+		}
+		return nil
+	}); err != nil {
+		r.logger.Errorf("%x failed to read the applied entries [%d, %d) from storage: %v", r.id, lo, hi, err)
+		return nil
+	}
+	return indexes
+}
+
+// ProposeBatch proposes the given payloads be appended to the raft log as a
+// contiguous run of entries, in one message. The batch is accepted or dropped
+// as a whole; in particular, it is dropped with ErrProposalDropped if it would
+// exceed Config.MaxUncommittedEntriesSize.
+func (rn *RawNode) ProposeBatch(datas [][]byte) error {
+	if len(datas) == 0 {
+		return nil
+	}
+	ents := make([]pb.Entry, len(datas))
+	for i, data := range datas {
+		ents[i].Data = data
+	}
+	return rn.raft.Step(pb.Message{
+		Type:    pb.MsgProp,
+		From:    rn.raft.id,
+		Entries: ents,
+	})
+}
+
+// ProposalToken identifies a proposal made with ProposeWithResult.
+type ProposalToken struct {
+	id uint64
+}
+
+// ProposalStatus is the outcome of a proposal made with ProposeWithResult.
+type ProposalStatus int
+
+const (
+	// ProposalUnknown is the status of tokens which are not tracked, i.e. were
+	// already resolved, or whose entry was compacted before it was checked.
+	ProposalUnknown ProposalStatus = iota
+	// ProposalPending means that the proposed entry is in the log, but is not
+	// committed yet.
+	ProposalPending
+	// ProposalCommitted means that the proposed entry is committed.
+	ProposalCommitted
+	// ProposalDropped means that the proposed entry was removed from the log,
+	// e.g. overwritten by a new leader, and will never be committed.
+	ProposalDropped
+)
+
+// trackedProposal is the state of a proposal made with ProposeWithResult.
+type trackedProposal struct {
+	// entry is the entry the proposal was appended as, if it was made on the
+	// leader. It is zero if the proposal was forwarded to the leader.
+	entry entryID
+	// committed is set once the entry is handed out in Ready.CommittedEntries.
+	committed bool
+}
+
+// proposalContextMagic starts the data of the entries proposed with
+// ProposeWithResult. It is followed by the ID of the proposing node and the
+// ID of the token, both as 8-byte big-endian integers, and the proposed data.
+const proposalContextMagic = "\xffRPID"
+
+const proposalContextSize = len(proposalContextMagic) + 16
+
+// encodeProposalContext returns the entry data for a proposal of the given
+// data made with ProposeWithResult on the given node.
+func encodeProposalContext(node, id uint64, data []byte) []byte {
+	b := make([]byte, 0, proposalContextSize+len(data))
+	b = append(b, proposalContextMagic...)
+	b = binary.BigEndian.AppendUint64(b, node)
+	b = binary.BigEndian.AppendUint64(b, id)
+	return append(b, data...)
+}
+
+// decodeProposalContext decodes the entry data of a proposal made with
+// ProposeWithResult. It returns false if the data does not carry a proposal
+// context.
+func decodeProposalContext(data []byte) (node, id uint64, payload []byte, ok bool) {
+	if len(data) < proposalContextSize || !bytes.HasPrefix(data, []byte(proposalContextMagic)) {
+		return 0, 0, data, false
+	}
+	b := data[len(proposalContextMagic):]
+	return binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:]), data[proposalContextSize:], true
+}
+
+// ProposalData returns the data passed to ProposeWithResult for the entry with
+// the given data, by removing the proposal context that ProposeWithResult
+// places in front of it. The data of other entries is returned unchanged, so
+// that an application using ProposeWithResult can pass the data of all its
+// normal entries through ProposalData before applying them. Such an
+// application must not propose data starting with "\xffRPID" otherwise.
+func ProposalData(data []byte) []byte {
+	_, _, payload, _ := decodeProposalContext(data)
+	return payload
+}
+
+// ProposeWithResult is like Propose, but returns a token for checking the
+// outcome of the proposal with ProposalResult. The token is correlated with
+// the entry through a proposal context in the entry data, which identifies
+// the proposing node and the token, see ProposalData. The context travels
+// with the entry, so the proposal can be made on any node, and is recognized
+// when it commits even if it was forwarded to the leader or re-proposed (see
+// Config.ReproposeUncommittedOnReelection).
+//
+// Each token must eventually be passed to ProposalResult until it is
+// resolved, or to ForgetProposal, since the RawNode tracks it until then.
+func (rn *RawNode) ProposeWithResult(data []byte) (ProposalToken, error) {
+	r := rn.raft
+	id := rn.nextProposalID + 1
+	if err := rn.Propose(encodeProposalContext(r.id, id, data)); err != nil {
+		return ProposalToken{}, err
+	}
+	rn.nextProposalID = id
+	p := &trackedProposal{}
+	if r.state == StateLeader {
+		p.entry = r.raftLog.lastEntryID()
+	}
+	if rn.proposals == nil {
+		rn.proposals = map[uint64]*trackedProposal{}
+	}
+	rn.proposals[id] = p
+	return ProposalToken{id: id}, nil
+}
+
+// ProposalResult returns the status of the proposal with the given token. The
+// token is resolved, and no longer tracked, once the proposal is committed or
+// dropped. A proposal is committed once the leader it was made on has
+// committed it, or its entry has been handed out in Ready.CommittedEntries.
+//
+// A proposal made on the leader is dropped once its entry is removed from the
+// log, unless Config.ReproposeUncommittedOnReelection is set, in which case
+// it may still be re-proposed. Note that a proposal whose leader has lost
+// leadership stays pending while its entry is in the log, since the new
+// leader may still commit it. Raft can not tell whether a proposal forwarded
+// to the leader was dropped, so such a proposal stays pending until it is
+// committed or the application forgets it.
+func (rn *RawNode) ProposalResult(tok ProposalToken) ProposalStatus {
+	p, ok := rn.proposals[tok.id]
+	if !ok {
+		return ProposalUnknown
+	}
+	r := rn.raft
+	l := r.raftLog
+	status := ProposalPending
+	if p.committed {
+		status = ProposalCommitted
+	} else if p.entry.index != 0 {
+		switch term, err := l.term(p.entry.index); {
+		case err == ErrCompacted:
+			status = ProposalUnknown
+		case err != nil || term != p.entry.term:
+			if !r.reproposeUncommittedOnReelection {
+				status = ProposalDropped
+			}
+		case p.entry.index <= l.committed:
+			status = ProposalCommitted
+		}
+	}
+	if status != ProposalPending {
+		delete(rn.proposals, tok.id)
+	}
+	return status
+}
+
+// markCommittedProposals marks the proposals made with ProposeWithResult on
+// this node whose entries are among the given committed entries as committed.
+func (rn *RawNode) markCommittedProposals(ents []pb.Entry) {
+	for i := range ents {
+		if ents[i].Type != pb.EntryNormal {
+			continue
+		}
+		if node, id, _, ok := decodeProposalContext(ents[i].Data); ok && node == rn.raft.id {
+			if p := rn.proposals[id]; p != nil {
+				p.committed = true
+			}
+		}
+	}
+}
+
+// ForgetProposal stops tracking the proposal with the given token, e.g. when
+// the application abandons it after a timeout. The proposal itself is not
+// affected, and may still be committed.
+func (rn *RawNode) ForgetProposal(tok ProposalToken) {
+	delete(rn.proposals, tok.id)
+}
+
+// ProposalID is an entry proposed with ProposeWithID, see Ready.ProposalIDs.
+type ProposalID struct {
+	Index uint64
+	ID    uint64
+}
+
+// taggedProposal is the term and ID of an entry proposed with ProposeWithID.
+type taggedProposal struct {
+	term, id uint64
+}
+
+// ProposeWithID is like Propose, but tags the proposal with the given ID. Once
+// the resulting entry is committed, Ready.ProposalIDs reports it together with
+// the ID, so that the application can correlate it to the client request.
+// Like ProposeWithResult, it is only accepted by the leader, and other nodes
+// drop it with ErrProposalDropped. If the entry is overwritten by another
+// leader, no ID is reported for it.
+func (rn *RawNode) ProposeWithID(data []byte, id uint64) error {
+	r := rn.raft
+	if r.state != StateLeader {
+		return ErrProposalDropped
+	}
+	if err := rn.Propose(data); err != nil {
+		return err
+	}
+	if rn.taggedProposals == nil {
+		rn.taggedProposals = map[uint64]taggedProposal{}
+	}
+	last := r.raftLog.lastEntryID()
+	rn.taggedProposals[last.index] = taggedProposal{term: last.term, id: id}
+	return nil
+}
+
+// committedProposalIDs returns the IDs of the given committed entries which
+// were proposed with ProposeWithID.
+func (rn *RawNode) committedProposalIDs(ents []pb.Entry) []ProposalID {
+	var ids []ProposalID
+	for i := range ents {
+		if p, ok := rn.taggedProposals[ents[i].Index]; ok && p.term == ents[i].Term {
+			ids = append(ids, ProposalID{Index: ents[i].Index, ID: p.id})
+		}
+	}
+	return ids
+}
+
 // ProposeConfChange proposes a config change. See (Node).ProposeConfChange for
 // details.
 func (rn *RawNode) ProposeConfChange(cc pb.ConfChangeI) error {
@@ -114,6 +453,36 @@ func (rn *RawNode) ApplyConfChange(cc pb.ConfChangeI) *pb.ConfState {
 	return &cs
 }
 
+// ForceSingleVoter replaces the configuration of the node with one in which id
+// is the only voter, bypassing the log and joint consensus. It is meant for
+// disaster recovery when a quorum is permanently lost, and is unsafe: entries
+// committed by the old quorum but missing from this node are lost, and nodes
+// still running the old configuration may elect a conflicting leader. All
+// other nodes must be shut down before using it.
+//
+// The new configuration is not persisted. The application must record it
+// (e.g. in a snapshot) and must not apply conf changes from the log that
+// predate it.
+func (rn *RawNode) ForceSingleVoter(id uint64) error {
+	r := rn.raft
+	if id == None {
+		return errors.New("raft: cannot use none as the single voter")
+	}
+	trk := tracker.MakeProgressTracker(r.trk.MaxInflight, r.trk.MaxInflightBytes)
+	cfg, prs, err := confchange.Restore(confchange.Changer{
+		Tracker:   trk,
+		LastIndex: r.raftLog.lastIndex(),
+	}, pb.ConfState{Voters: []uint64{id}})
+	if err != nil {
+		return err
+	}
+	r.logger.Warningf("%x forcing single-voter configuration with voter %x, previous configuration %s; "+
+		"committed entries may be lost", r.id, id, r.trk.Config)
+	r.trk = trk
+	r.switchToConfig(cfg, prs)
+	return nil
+}
+
 // Step advances the state machine using the given message.
 func (rn *RawNode) Step(m pb.Message) error {
 	// Ignore unexpected local messages receiving over network.
@@ -123,9 +492,57 @@ func (rn *RawNode) Step(m pb.Message) error {
 	if IsResponseMsg(m.Type) && !IsLocalMsgTarget(m.From) && rn.raft.trk.Progress[m.From] == nil {
 		return ErrStepPeerNotFound
 	}
+	if m.Type == pb.MsgAppResp && rn.suppressedAcks[m.From] {
+		return nil
+	}
 	return rn.raft.Step(m)
 }
 
+// SuppressAcks makes Step silently drop the MsgAppResp messages from the given
+// peer if suppress is true, or stops doing so if false. On the leader, this
+// models a follower that receives appends but whose acknowledgements are lost:
+// its Match never advances, so it doesn't count towards the quorum, while the
+// leader keeps probing it on heartbeat responses. It is intended for testing.
+func (rn *RawNode) SuppressAcks(id uint64, suppress bool) {
+	if !suppress {
+		delete(rn.suppressedAcks, id)
+		return
+	}
+	if rn.suppressedAcks == nil {
+		rn.suppressedAcks = map[uint64]bool{}
+	}
+	rn.suppressedAcks[id] = true
+}
+
+// StepManyError is returned by StepMany when stepping one of the messages
+// fails.
+type StepManyError struct {
+	// Index is the position of the failed message in the slice passed to
+	// StepMany. The messages preceding it have been stepped.
+	Index int
+	Err   error
+}
+
+func (e *StepManyError) Error() string {
+	return fmt.Sprintf("raft: stepping message %d: %v", e.Index, e.Err)
+}
+
+func (e *StepManyError) Unwrap() error {
+	return e.Err
+}
+
+// StepMany steps the given messages in order, as if by calling Step for each
+// of them. It stops at the first message for which Step fails, and returns a
+// *StepManyError carrying its index.
+func (rn *RawNode) StepMany(msgs []pb.Message) error {
+	for i := range msgs {
+		if err := rn.Step(msgs[i]); err != nil {
+			return &StepManyError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
 // Ready returns the outstanding work that the application needs to handle. This
 // includes appending and applying entries or a snapshot, updating the HardState,
 // and sending messages. The returned Ready() *must* be handled and subsequently
@@ -146,6 +563,11 @@ func (rn *RawNode) readyWithoutAccept() Ready {
 		CommittedEntries: r.raftLog.nextCommittedEnts(rn.applyUnstableEntries()),
 		Messages:         r.msgs,
 	}
+	if n := rn.numReadyMsgs(); n < len(r.msgs) {
+		// NB: use the full slice expression, so that appends to rd.Messages
+		// below don't overwrite the messages left for the next Ready.
+		rd.Messages = r.msgs[:n:n]
+	}
 	if softSt := r.softState(); !softSt.equal(rn.prevSoftSt) {
 		// Allocate only when SoftState changes.
 		escapingSoftSt := softSt
@@ -160,14 +582,26 @@ func (rn *RawNode) readyWithoutAccept() Ready {
 	if len(r.readStates) != 0 {
 		rd.ReadStates = r.readStates
 	}
+	if rn.reportEmptyEntries {
+		rd.EmptyEntryIndexes = emptyEntryIndexes(rd.CommittedEntries)
+	}
+	if len(rn.taggedProposals) != 0 {
+		rd.ProposalIDs = rn.committedProposalIDs(rd.CommittedEntries)
+	}
+	if rn.logSizer != nil {
+		rd.ShouldSnapshot = rn.logSizer.SizeInBytes() > rn.snapshotOnLogBytes
+	}
 	rd.MustSync = MustSync(r.hardState(), rn.prevHardSt, len(rd.Entries))
+	if rn.syncPolicy != nil {
+		rd.MustSync = rn.syncPolicy(rd)
+	}
 
 	if rn.asyncStorageWrites {
 		// If async storage writes are enabled, enqueue messages to
 		// local storage threads, where applicable.
 		if needStorageAppendMsg(r, rd) {
 			m := newStorageAppendMsg(r, rd)
-			rd.Messages = append(rd.Messages, m)
+			rd.Messages = appendSplitResponses(rd.Messages, m, rn.maxResponses)
 		}
 		if needStorageApplyMsg(rd) {
 			m := newStorageApplyMsg(r, rd)
@@ -188,6 +622,17 @@ func (rn *RawNode) readyWithoutAccept() Ready {
 	return rd
 }
 
+// emptyEntryIndexes returns the indexes of the empty normal entries in ents.
+func emptyEntryIndexes(ents []pb.Entry) []uint64 {
+	var idxs []uint64
+	for i := range ents {
+		if ents[i].Type == pb.EntryNormal && len(ents[i].Data) == 0 {
+			idxs = append(idxs, ents[i].Index)
+		}
+	}
+	return idxs
+}
+
 // MustSync returns true if the hard state and count of Raft entries indicate
 // that a synchronous write to persistent storage is required.
 func MustSync(st, prevst pb.HardState, entsnum int) bool {
@@ -261,6 +706,29 @@ func newStorageAppendMsg(r *raft, rd Ready) pb.Message {
 	return m
 }
 
+// appendSplitResponses appends m to msgs. If m carries more than limit
+// responses (and limit is positive), the excess responses are moved, limit at a
+// time, to copies of m that carry nothing but the responses.
+func appendSplitResponses(msgs []pb.Message, m pb.Message, limit int) []pb.Message {
+	if limit <= 0 || len(m.Responses) <= limit {
+		return append(msgs, m)
+	}
+	resps := m.Responses
+	m.Responses = resps[:limit:limit]
+	msgs = append(msgs, m)
+	for resps = resps[limit:]; len(resps) > 0; {
+		n := min(limit, len(resps))
+		msgs = append(msgs, pb.Message{
+			Type:      m.Type,
+			To:        m.To,
+			From:      m.From,
+			Responses: resps[:n:n],
+		})
+		resps = resps[n:]
+	}
+	return msgs
+}
+
 // newStorageAppendRespMsg creates the message that should be returned to node
 // after the unstable log entries, hard state, and snapshot in the current Ready
 // (along with those in all prior Ready structs) have been saved to stable
@@ -412,6 +880,16 @@ func (rn *RawNode) acceptReady(rd Ready) {
 	if len(rd.ReadStates) != 0 {
 		rn.raft.readStates = nil
 	}
+	if len(rn.proposals) != 0 {
+		rn.markCommittedProposals(rd.CommittedEntries)
+	}
+	if len(rn.taggedProposals) != 0 {
+		// The entries at these indexes are committed, so the proposals tagged
+		// with them have either been reported or were overwritten.
+		for i := range rd.CommittedEntries {
+			delete(rn.taggedProposals, rd.CommittedEntries[i].Index)
+		}
+	}
 	if !rn.asyncStorageWrites {
 		if len(rn.stepsOnAdvance) != 0 {
 			rn.raft.logger.Panicf("two accepted Ready structs without call to Advance")
@@ -430,7 +908,11 @@ func (rn *RawNode) acceptReady(rd Ready) {
 			rn.stepsOnAdvance = append(rn.stepsOnAdvance, m)
 		}
 	}
-	rn.raft.msgs = nil
+	if n := rn.numReadyMsgs(); n < len(rn.raft.msgs) {
+		rn.raft.msgs = rn.raft.msgs[n:]
+	} else {
+		rn.raft.msgs = nil
+	}
 	rn.raft.msgsAfterAppend = nil
 	rn.raft.raftLog.acceptUnstable()
 	if len(rd.CommittedEntries) > 0 {
@@ -442,6 +924,15 @@ func (rn *RawNode) acceptReady(rd Ready) {
 	traceReady(rn.raft)
 }
 
+// numReadyMsgs returns the number of messages from raft.msgs that the next
+// Ready carries, see Config.MaxMessagesPerReady.
+func (rn *RawNode) numReadyMsgs() int {
+	if n := len(rn.raft.msgs); rn.maxMessages == 0 || n <= rn.maxMessages {
+		return n
+	}
+	return rn.maxMessages
+}
+
 // applyUnstableEntries returns whether entries are allowed to be applied once
 // they are known to be committed but before they have been written locally to
 // stable storage.
@@ -486,6 +977,19 @@ func (rn *RawNode) Advance(_ Ready) {
 	if rn.asyncStorageWrites {
 		rn.raft.logger.Panicf("Advance must not be called when using AsyncStorageWrites")
 	}
+	rn.ProcessStorageResponses()
+}
+
+// ProcessStorageResponses steps the local storage response messages buffered
+// by the last accepted Ready, so that their effects (e.g. an advanced commit
+// index) are reflected right away instead of on the call to Advance. The
+// caller must have persisted the Ready's entries, HardState and snapshot, and
+// applied its committed entries, before calling it; Advance then has nothing
+// left to do for that Ready.
+//
+// With AsyncStorageWrites, storage responses are not buffered: they are
+// processed as soon as they are passed to Step, and this method is a no-op.
+func (rn *RawNode) ProcessStorageResponses() {
 	for i, m := range rn.stepsOnAdvance {
 		_ = rn.raft.Step(m)
 		rn.stepsOnAdvance[i] = pb.Message{}
@@ -530,6 +1034,193 @@ func (rn *RawNode) WithProgress(visitor func(id uint64, typ ProgressType, pr tra
 	})
 }
 
+// MemberRole indicates the role of a member in the incoming configuration.
+type MemberRole byte
+
+const (
+	// MemberRoleNone is the role of a member which is only a voter in the
+	// outgoing configuration, i.e. is being removed.
+	MemberRoleNone MemberRole = iota
+	// MemberRoleVoter is the role of a voter.
+	MemberRoleVoter
+	// MemberRoleLearner is the role of a learner, including a voter being
+	// demoted to a learner in a joint configuration.
+	MemberRoleLearner
+)
+
+// Member describes a node of the current configuration.
+type Member struct {
+	ID uint64
+	// Role is the role of the member in the incoming configuration.
+	Role MemberRole
+	// Outgoing is true if the member is a voter in the outgoing configuration,
+	// which is only non-empty during a joint transition.
+	Outgoing bool
+}
+
+// Members returns all the voters and learners of the current configuration,
+// sorted by ID.
+func (rn *RawNode) Members() []Member {
+	cfg := &rn.raft.trk.Config
+	var members []Member
+	rn.raft.trk.Visit(func(id uint64, pr *tracker.Progress) {
+		m := Member{ID: id}
+		_, isLearnerNext := cfg.LearnersNext[id]
+		if _, ok := cfg.Voters[0][id]; ok {
+			m.Role = MemberRoleVoter
+		} else if pr.IsLearner || isLearnerNext {
+			m.Role = MemberRoleLearner
+		}
+		_, m.Outgoing = cfg.Voters[1][id]
+		members = append(members, m)
+	})
+	return members
+}
+
+// VoteHistory returns the most recent votes cast by this node, oldest first.
+// It returns nil unless Config.RecordVoteHistory is set.
+func (rn *RawNode) VoteHistory() []VoteRecord {
+	h := rn.raft.voteHistory
+	if h == nil {
+		return nil
+	}
+	if len(h) < cap(h) {
+		return slices.Clone(h)
+	}
+	next := rn.raft.voteHistoryNext
+	return append(slices.Clone(h[next:]), h[:next]...)
+}
+
+// ProgressSnapshot returns a copy of the replication progress of every peer,
+// including the leader itself. It returns an empty map if this node is not the
+// leader.
+func (rn *RawNode) ProgressSnapshot() map[uint64]ProgressInfo {
+	return getProgressInfos(rn.raft)
+}
+
+// MemoryFootprint returns an estimate of the number of bytes used by the
+// unstable log entries and snapshot, the progress tracker, the pending read
+// only requests, and the pending messages. It is meant for capacity planning,
+// not accounting: the entries held by Storage are not included, and data
+// shared between messages and the log is counted more than once.
+func (rn *RawNode) MemoryFootprint() uint64 {
+	r := rn.raft
+	return r.raftLog.unstable.memoryFootprint() +
+		r.trk.MemoryFootprint() +
+		r.readOnly.memoryFootprint() +
+		messagesFootprint(r.pendingReadIndexMessages) +
+		messagesFootprint(r.msgs) +
+		messagesFootprint(r.msgsAfterAppend)
+}
+
+// InflightStats returns the state of the in-flight MsgApp window of each
+// peer. It returns nil if this node is not the leader.
+func (rn *RawNode) InflightStats() map[uint64]InflightStat {
+	if rn.raft.state != StateLeader {
+		return nil
+	}
+	return getInflightStats(rn.raft)
+}
+
+// IsTransferEligible returns whether leadership can be transferred to the given
+// peer right away, as seen by the leader: the peer must be a voter that is
+// recently active and has the leader's entire log. Otherwise, the returned
+// string describes the reason why the peer is not eligible.
+func (rn *RawNode) IsTransferEligible(id uint64) (bool, string) {
+	r := rn.raft
+	pr := r.trk.Progress[id]
+	switch {
+	case r.state != StateLeader:
+		return false, "this node is not the leader"
+	case id == r.id:
+		return false, "already the leader"
+	case pr == nil:
+		return false, "not a voter"
+	case pr.IsLearner:
+		return false, "is a learner"
+	case !pr.RecentActive:
+		return false, "not recently active"
+	case pr.Match < r.raftLog.lastIndex():
+		return false, fmt.Sprintf("not caught up (match %d, last index %d)", pr.Match, r.raftLog.lastIndex())
+	}
+	return true, ""
+}
+
+// InflightUtilization returns the fraction of the in-flight MsgApp window of
+// the given peer that is currently used, by message count or by bytes,
+// whichever is higher. It returns 0 if this node is not the leader or the peer
+// is unknown.
+func (rn *RawNode) InflightUtilization(id uint64) float64 {
+	pr := rn.raft.trk.Progress[id]
+	if rn.raft.state != StateLeader || pr == nil {
+		return 0
+	}
+	return pr.Inflights.Utilization()
+}
+
+// QuorumActive returns true if this node is the leader and a quorum of voters
+// has been heard from in the current election interval, i.e. if the leader
+// would stay in power if Config.CheckQuorum ran now. The followers are marked
+// inactive at the start of each interval, so this may briefly return false
+// until they respond to the next heartbeat. Without CheckQuorum, followers are
+// never marked inactive again once heard from.
+func (rn *RawNode) QuorumActive() bool {
+	return rn.raft.state == StateLeader && rn.raft.trk.QuorumActive()
+}
+
+// CommitIndexWithout returns the index the leader could commit if the given
+// voter did not count towards the quorum, e.g. because it failed. The voter
+// is not actually removed from the configuration. The result is capped at the
+// leader's last index, and is 0 if this node is not the leader. If the voter
+// is the only one in (a half of) the configuration, no quorum remains to
+// commit further entries, and the current commit index is returned.
+func (rn *RawNode) CommitIndexWithout(id uint64) uint64 {
+	r := rn.raft
+	if r.state != StateLeader {
+		return 0
+	}
+	for _, voters := range r.trk.Voters {
+		if _, ok := voters[id]; ok && len(voters) == 1 {
+			return r.raftLog.committed
+		}
+	}
+	return min(r.trk.CommittedWithout(id), r.raftLog.lastIndex())
+}
+
+// MaxInflightIndex returns the highest log index the leader has sent to any
+// follower, i.e. the maximum of Progress.Next-1 across the followers. It
+// returns 0 if this node is not the leader.
+func (rn *RawNode) MaxInflightIndex() uint64 {
+	r := rn.raft
+	if r.state != StateLeader {
+		return 0
+	}
+	var index uint64
+	r.trk.Visit(func(id uint64, pr *tracker.Progress) {
+		if id != r.id {
+			index = max(index, pr.Next-1)
+		}
+	})
+	return index
+}
+
+// KickAppend makes the leader immediately send an append (or a snapshot, if
+// the required entries are compacted) to the given peer, rather than waiting
+// for the next heartbeat or proposal. A peer in StateProbe is unpaused, as if
+// it had responded to a heartbeat. This is a no-op if this node is not the
+// leader or the peer is unknown.
+func (rn *RawNode) KickAppend(id uint64) {
+	r := rn.raft
+	pr := r.trk.Progress[id]
+	if r.state != StateLeader || pr == nil || id == r.id {
+		return
+	}
+	if pr.State == tracker.StateProbe {
+		pr.MsgAppFlowPaused = false
+	}
+	r.sendAppend(id)
+}
+
 // ReportUnreachable reports the given node is not reachable for the last send.
 func (rn *RawNode) ReportUnreachable(id uint64) {
 	_ = rn.raft.Step(pb.Message{Type: pb.MsgUnreachable, From: id})
@@ -542,6 +1233,15 @@ func (rn *RawNode) ReportSnapshot(id uint64, status SnapshotStatus) {
 	_ = rn.raft.Step(pb.Message{Type: pb.MsgSnapStatus, From: id, Reject: rej})
 }
 
+// ReportSnapshotProgress reports the progress of the application applying the
+// snapshot from Ready.Snapshot, in units of its choice. It is passed through
+// to Config.SnapshotProgress, if set.
+func (rn *RawNode) ReportSnapshotProgress(applied, total uint64) {
+	if rn.snapshotProgress != nil {
+		rn.snapshotProgress(applied, total)
+	}
+}
+
 // TransferLeader tries to transfer leadership to the given transferee.
 func (rn *RawNode) TransferLeader(transferee uint64) {
 	_ = rn.raft.Step(pb.Message{Type: pb.MsgTransferLeader, From: transferee})
@@ -553,6 +1253,318 @@ func (rn *RawNode) ForgetLeader() error {
 	return rn.raft.Step(pb.Message{Type: pb.MsgForgetLeader})
 }
 
+// ConfStateMatches returns true if the given ConfState describes the same
+// configuration as the one currently active on this node. See ConfStatesAgree.
+func (rn *RawNode) ConfStateMatches(other pb.ConfState) bool {
+	return ConfStatesAgree(rn.raft.trk.ConfState(), other)
+}
+
+// MessageCounters returns the number of messages this node has sent to and
+// received from other nodes since it was created or since the last call to
+// ResetMessageCounters. Local messages are not counted.
+func (rn *RawNode) MessageCounters() (sent, received uint64) {
+	return rn.raft.msgsSent, rn.raft.msgsRecv
+}
+
+// ResetMessageCounters zeroes the counters returned by MessageCounters.
+func (rn *RawNode) ResetMessageCounters() {
+	rn.raft.msgsSent, rn.raft.msgsRecv = 0, 0
+}
+
+// DroppedProposalCount returns the number of proposals this node has dropped
+// with ErrProposalDropped, for any reason, since it was created or since the
+// last call to ResetDroppedProposalCount. A proposal of multiple entries, such
+// as one made with ProposeBatch, counts once.
+func (rn *RawNode) DroppedProposalCount() uint64 {
+	return rn.raft.droppedProposals
+}
+
+// ResetDroppedProposalCount zeroes the counter returned by
+// DroppedProposalCount.
+func (rn *RawNode) ResetDroppedProposalCount() {
+	rn.raft.droppedProposals = 0
+}
+
+// ReplicationFactor returns the number of voters that are known to have the
+// log entry at the given index persisted, i.e. whose Match is at least index.
+// In a joint configuration, voters of both the incoming and outgoing configs
+// are counted (once). The result is only meaningful on the leader.
+func (rn *RawNode) ReplicationFactor(index uint64) int {
+	n := 0
+	for id := range rn.raft.trk.Config.Voters.IDs() {
+		if pr := rn.raft.trk.Progress[id]; pr != nil && pr.Match >= index {
+			n++
+		}
+	}
+	return n
+}
+
+// SnapshotMeta returns the index, term and ConfState of the most recent
+// snapshot known to raft: the snapshot restored from a MsgSnap if it is still
+// pending in Ready, or otherwise the one returned by Storage.Snapshot, which
+// is read on every call. If the Storage fails to return its snapshot, the
+// error is logged and zero values are returned.
+func (rn *RawNode) SnapshotMeta() (index, term uint64, cs pb.ConfState) {
+	snap, err := rn.raft.raftLog.snapshot()
+	if err != nil {
+		rn.raft.logger.Errorf("%x failed to read the snapshot from storage: %v", rn.raft.id, err)
+		return 0, 0, pb.ConfState{}
+	}
+	return snap.Metadata.Index, snap.Metadata.Term, snap.Metadata.ConfState
+}
+
+// ConfStateAt reconstructs the configuration in effect once all the conf
+// changes at or below the given committed index have been applied, by
+// replaying the conf changes in the log on top of the ConfState of the most
+// recent snapshot, i.e. the one pending in Ready or returned by
+// Storage.Snapshot. Returns ErrCompacted if the index precedes that snapshot,
+// and ErrUnavailable if the index is not committed.
+func (rn *RawNode) ConfStateAt(index uint64) (pb.ConfState, error) {
+	r := rn.raft
+	snap, err := r.raftLog.snapshot()
+	if err != nil {
+		return pb.ConfState{}, err
+	}
+	snapIndex, cs := snap.Metadata.Index, snap.Metadata.ConfState
+	if index < snapIndex {
+		return pb.ConfState{}, ErrCompacted
+	} else if index > r.raftLog.committed {
+		return pb.ConfState{}, ErrUnavailable
+	}
+
+	trk := tracker.MakeProgressTracker(r.trk.MaxInflight, r.trk.MaxInflightBytes)
+	cfg, prs, err := confchange.Restore(confchange.Changer{Tracker: trk, LastIndex: snapIndex}, cs)
+	if err != nil {
+		return pb.ConfState{}, err
+	}
+	trk.Config, trk.Progress = cfg, prs
+
+	err = r.raftLog.scan(snapIndex+1, index+1, r.raftLog.maxApplyingEntsSize, func(ents []pb.Entry) error {
+		for i := range ents {
+			var cc pb.ConfChangeV2
+			switch ents[i].Type {
+			case pb.EntryConfChange:
+				var ccv1 pb.ConfChange
+				if err := ccv1.Unmarshal(ents[i].Data); err != nil {
+					return err
+				}
+				cc = ccv1.AsV2()
+			case pb.EntryConfChangeV2:
+				if err := cc.Unmarshal(ents[i].Data); err != nil {
+					return err
+				}
+			default:
+				continue
+			}
+			changer := confchange.Changer{Tracker: trk, LastIndex: ents[i].Index}
+			var err error
+			if cc.LeaveJoint() {
+				cfg, prs, err = changer.LeaveJoint()
+			} else if autoLeave, ok := cc.EnterJoint(); ok {
+				cfg, prs, err = changer.EnterJoint(autoLeave, cc.Changes...)
+			} else {
+				cfg, prs, err = changer.Simple(cc.Changes...)
+			}
+			if err != nil {
+				return fmt.Errorf("conf change at index %d: %w", ents[i].Index, err)
+			}
+			trk.Config, trk.Progress = cfg, prs
+		}
+		return nil
+	})
+	if err != nil {
+		return pb.ConfState{}, err
+	}
+	return trk.ConfState(), nil
+}
+
+// CurrentVote returns the current term and the node this node has voted for
+// in it, or None if it has not voted in the current term.
+func (rn *RawNode) CurrentVote() (term uint64, votedFor uint64) {
+	return rn.raft.Term, rn.raft.Vote
+}
+
+// IsJoint returns true if the applied configuration is a joint one, i.e. has
+// both incoming and outgoing voters.
+func (rn *RawNode) IsJoint() bool {
+	return len(rn.raft.trk.Config.Voters[1]) > 0
+}
+
+// PersistentState returns the current HardState and the ConfState of the
+// applied configuration. Note that the HardState may be ahead of the one last
+// handed out in a Ready, and thus not persisted yet.
+func (rn *RawNode) PersistentState() (pb.HardState, pb.ConfState) {
+	return rn.raft.hardState(), rn.raft.trk.ConfState()
+}
+
+// TermOf returns the term of the log entry at the given index. Returns
+// ErrCompacted if the index precedes the last snapshot (the term of the
+// snapshot index itself is retained), or ErrUnavailable if the index is past
+// the end of the log.
+func (rn *RawNode) TermOf(index uint64) (uint64, error) {
+	return rn.raft.raftLog.term(index)
+}
+
+// EntriesOrSnapshot returns the log entries in [lo, hi). If a prefix of the
+// range has been compacted, it also returns the snapshot covering that prefix,
+// and the returned entries start right after the snapshot index. Returns
+// ErrUnavailable if the range is invalid or extends past the end of the log,
+// and ErrCompacted if the snapshot does not reach up to the first available
+// entry.
+func (rn *RawNode) EntriesOrSnapshot(lo, hi uint64) ([]pb.Entry, *pb.Snapshot, error) {
+	l := rn.raft.raftLog
+	if lo > hi || hi > l.lastIndex()+1 {
+		return nil, nil, ErrUnavailable
+	}
+	if lo >= l.firstIndex() {
+		ents, err := l.slice(lo, hi, noLimit)
+		return ents, nil, err
+	}
+	snap, err := l.snapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	if snap.Metadata.Index+1 < l.firstIndex() {
+		return nil, nil, ErrCompacted
+	}
+	if lo = max(lo, snap.Metadata.Index+1); lo >= hi {
+		return nil, &snap, nil
+	}
+	ents, err := l.slice(lo, hi, noLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ents, &snap, nil
+}
+
+// LogBounds returns the first index, applied index, committed index and last
+// index of the raft log, in one read of the node's state. It always holds
+// that firstIndex <= appliedIndex+1, and appliedIndex <= committedIndex <=
+// lastIndex.
+func (rn *RawNode) LogBounds() (firstIndex, appliedIndex, committedIndex, lastIndex uint64) {
+	l := rn.raft.raftLog
+	return l.firstIndex(), l.applied, l.committed, l.lastIndex()
+}
+
+// FailureTolerance returns the number of voters that can fail while the
+// current configuration retains a quorum. In a joint configuration, this is
+// the minimum across the incoming and outgoing majorities.
+func (rn *RawNode) FailureTolerance() int {
+	tolerance := -1
+	for _, c := range rn.raft.trk.Config.Voters {
+		if len(c) == 0 {
+			continue
+		}
+		if t := len(c) - (len(c)/2 + 1); tolerance < 0 || t < tolerance {
+			tolerance = t
+		}
+	}
+	return max(tolerance, 0)
+}
+
+// CheckInvariants verifies internal invariants of the raft state, and returns
+// a descriptive error if one of them is violated. It checks that
+// applied <= committed <= lastIndex, that firstIndex <= applied+1 (unless a
+// snapshot is pending), that the progress tracker is consistent with the
+// active configuration, and that the configuration matches the ConfState last
+// applied, as far as it is known (see appliedConfState). It is intended for use
+// in tests.
+func (rn *RawNode) CheckInvariants() error {
+	r := rn.raft
+	l := r.raftLog
+	if l.applied > l.applying || l.applying > l.committed {
+		return fmt.Errorf("applied(%d) <= applying(%d) <= committed(%d) violated", l.applied, l.applying, l.committed)
+	}
+	if last := l.lastIndex(); l.committed > last {
+		return fmt.Errorf("committed(%d) > lastIndex(%d)", l.committed, last)
+	}
+	if first := l.firstIndex(); l.unstable.snapshot == nil && first > l.applied+1 {
+		return fmt.Errorf("firstIndex(%d) > applied(%d)+1", first, l.applied)
+	}
+	if err := confchange.CheckInvariants(r.trk.Config, r.trk.Progress); err != nil {
+		return fmt.Errorf("config %s: %w", r.trk.Config, err)
+	}
+	if cs, ok, err := rn.appliedConfState(); err != nil {
+		return err
+	} else if ok {
+		if err := r.trk.ConfState().Equivalent(cs); err != nil {
+			return fmt.Errorf("config %s does not match the applied ConfState: %w", r.trk.Config, err)
+		}
+	}
+	voters := r.trk.Config.Voters.IDs()
+	for id, pr := range r.trk.Progress {
+		_, isVoter := voters[id]
+		_, isLearner := r.trk.Config.Learners[id]
+		if !isVoter && !isLearner {
+			return fmt.Errorf("progress for %d which is not in config %s", id, r.trk.Config)
+		}
+		if isVoter && pr.IsLearner {
+			return fmt.Errorf("voter %d is marked as learner in config %s", id, r.trk.Config)
+		}
+	}
+	return nil
+}
+
+// appliedConfState returns the ConfState of the latest snapshot, which is the
+// ConfState last applied if no configuration change entry has been applied
+// since. It returns false if one has, or if the entries applied since the
+// snapshot are not available, in which case the ConfState last applied is not
+// known.
+func (rn *RawNode) appliedConfState() (pb.ConfState, bool, error) {
+	l := rn.raft.raftLog
+	snap, err := l.snapshot()
+	if err != nil {
+		return pb.ConfState{}, false, err
+	}
+	if lo, hi := snap.Metadata.Index+1, l.applied+1; lo < hi {
+		if l.firstIndex() > lo {
+			return pb.ConfState{}, false, nil
+		}
+		ents, err := l.slice(lo, hi, noLimit)
+		if err != nil {
+			return pb.ConfState{}, false, err
+		}
+		for i := range ents {
+			if ents[i].Type != pb.EntryNormal {
+				return pb.ConfState{}, false, nil
+			}
+		}
+	}
+	return snap.Metadata.ConfState, true, nil
+}
+
+// SafeCompactIndex returns the highest index up to which the application can
+// compact its log (see MemoryStorage.Compact) without forcing any follower to
+// be caught up with a snapshot. On the leader, this is the lowest Match index
+// of all followers that are not already waiting for a snapshot. The result
+// never exceeds the applied index, and is reduced by
+// Config.CompactionSafetyMargin. Note that a follower that is down holds the
+// returned index back indefinitely.
+func (rn *RawNode) SafeCompactIndex() uint64 {
+	r := rn.raft
+	index := r.raftLog.applied
+	if r.state == StateLeader {
+		r.trk.Visit(func(id uint64, pr *tracker.Progress) {
+			if id != r.id && pr.State != tracker.StateSnapshot {
+				index = min(index, pr.Match)
+			}
+		})
+	}
+	if index < r.compactionSafetyMargin {
+		return 0
+	}
+	return index - r.compactionSafetyMargin
+}
+
+// UncommittedPayloadSize returns the total payload size of the entries
+// appended by this leader that have not been applied yet, as counted against
+// Config.MaxUncommittedEntriesSize. Proposals are dropped with
+// ErrProposalDropped once they would push it over that limit. The size is
+// reset when the node changes state, and is 0 on followers.
+func (rn *RawNode) UncommittedPayloadSize() uint64 {
+	return uint64(rn.raft.uncommittedSize)
+}
+
 // ReadIndex requests a read state. The read state will be set in ready.
 // Read State has a read index. Once the application advances further than the read
 // index, any linearizable read requests issued before the read request can be
@@ -560,3 +1572,28 @@ func (rn *RawNode) ForgetLeader() error {
 func (rn *RawNode) ReadIndex(rctx []byte) {
 	_ = rn.raft.Step(pb.Message{Type: pb.MsgReadIndex, Entries: []pb.Entry{{Data: rctx}}})
 }
+
+// ReadIndexWithContext is like ReadIndex, but validates the context first. It
+// returns ErrEmptyReadContext if rctx is empty, and ErrDuplicateReadContext if
+// rctx equals one of the last Config.ReadContextWindow contexts passed to it.
+// This helps catch bugs in the matching of ReadStates to requests.
+func (rn *RawNode) ReadIndexWithContext(rctx []byte) error {
+	if len(rctx) == 0 {
+		return ErrEmptyReadContext
+	}
+	if window := cap(rn.readCtxs); window > 0 {
+		key := string(rctx)
+		if _, ok := rn.readCtxSet[key]; ok {
+			return ErrDuplicateReadContext
+		}
+		if len(rn.readCtxs) < window {
+			rn.readCtxs = append(rn.readCtxs, key)
+		} else {
+			delete(rn.readCtxSet, rn.readCtxs[rn.readCtxNext])
+			rn.readCtxs[rn.readCtxNext] = key
+			rn.readCtxNext = (rn.readCtxNext + 1) % window
+		}
+		rn.readCtxSet[key] = struct{}{}
+	}
+	return rn.raft.Step(pb.Message{Type: pb.MsgReadIndex, Entries: []pb.Entry{{Data: rctx}}})
+}
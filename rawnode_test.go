@@ -444,6 +444,297 @@ func TestRawNodeJointAutoLeave(t *testing.T) {
 	require.Equal(t, exp2Cs, *cs)
 }
 
+// TestRawNodeHasPendingConfChange ensures that RawNode.HasPendingConfChange
+// reports a proposed configuration change of either type until it is applied.
+func TestRawNodeHasPendingConfChange(t *testing.T) {
+	for _, cc := range []pb.ConfChangeI{
+		pb.ConfChange{Type: pb.ConfChangeAddLearnerNode, NodeID: 2},
+		pb.ConfChangeV2{Changes: []pb.ConfChangeSingle{{Type: pb.ConfChangeAddLearnerNode, NodeID: 2}}},
+	} {
+		t.Run("", func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1))
+			rn := newTestRawNode(1, 10, 1, s)
+			require.NoError(t, rn.Campaign())
+			stabilize := func() {
+				for rn.HasReady() {
+					rd := rn.Ready()
+					require.NoError(t, s.Append(rd.Entries))
+					for _, e := range rd.CommittedEntries {
+						if e.Type == pb.EntryConfChange || e.Type == pb.EntryConfChangeV2 {
+							// The change is still pending until the entry is
+							// acknowledged as applied.
+							require.True(t, rn.HasPendingConfChange())
+							var cc pb.ConfChangeI
+							if e.Type == pb.EntryConfChange {
+								var ccc pb.ConfChange
+								require.NoError(t, ccc.Unmarshal(e.Data))
+								cc = ccc
+							} else {
+								var ccc pb.ConfChangeV2
+								require.NoError(t, ccc.Unmarshal(e.Data))
+								cc = ccc
+							}
+							rn.ApplyConfChange(cc)
+						}
+					}
+					rn.Advance(rd)
+				}
+			}
+			stabilize()
+			require.Equal(t, StateLeader, rn.raft.state)
+			require.False(t, rn.HasPendingConfChange())
+
+			require.NoError(t, rn.Propose([]byte("foo")))
+			require.False(t, rn.HasPendingConfChange())
+			require.NoError(t, rn.ProposeConfChange(cc))
+			require.True(t, rn.HasPendingConfChange())
+			stabilize()
+			require.False(t, rn.HasPendingConfChange())
+			require.Contains(t, rn.raft.trk.Learners, uint64(2))
+		})
+	}
+}
+
+// TestRawNodeProposeWithResult ensures that the tokens returned by
+// RawNode.ProposeWithResult resolve when the proposal commits, or when it is
+// dropped after the leader loses leadership, and that proposals forwarded by
+// followers are recognized by the context in their entry data.
+func TestRawNodeProposeWithResult(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			rn.Advance(rd)
+		}
+	}
+	// Followers without a leader do not accept the proposal.
+	_, err := rn.ProposeWithResult([]byte("foo"))
+	require.Equal(t, ErrProposalDropped, err)
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	stabilize()
+	tok1, err := rn.ProposeWithResult([]byte("foo"))
+	require.NoError(t, err)
+	tok2, err := rn.ProposeWithResult([]byte("bar"))
+	require.NoError(t, err)
+	stabilize()
+	require.Equal(t, ProposalPending, rn.ProposalResult(tok1))
+	require.Equal(t, ProposalPending, rn.ProposalResult(tok2))
+
+	// Follower 2 acknowledges the first proposal, which commits.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 2}))
+	require.Equal(t, ProposalCommitted, rn.ProposalResult(tok1))
+	require.Equal(t, ProposalUnknown, rn.ProposalResult(tok1))
+	require.Equal(t, ProposalPending, rn.ProposalResult(tok2))
+	tok3, err := rn.ProposeWithResult([]byte("baz"))
+	require.NoError(t, err)
+	stabilize()
+
+	// Node 2 becomes the leader without the other proposals. The second one
+	// stays pending while it is in the log, as the new leader might still
+	// commit it.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term + 1, Type: pb.MsgHeartbeat}))
+	require.Equal(t, StateFollower, r.state)
+	require.Equal(t, ProposalPending, rn.ProposalResult(tok2))
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgApp,
+		LogTerm: 1, Index: 2, Entries: []pb.Entry{{Term: r.Term, Index: 3}}}))
+	require.Equal(t, ProposalDropped, rn.ProposalResult(tok2))
+	require.Equal(t, ProposalDropped, rn.ProposalResult(tok3))
+
+	// Node 1 is elected again. Forgotten tokens are no longer tracked.
+	stabilize()
+	require.NoError(t, rn.Campaign())
+	stabilize()
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgVoteResp}))
+	require.Equal(t, StateLeader, r.state)
+	tok4, err := rn.ProposeWithResult([]byte("qux"))
+	require.NoError(t, err)
+	rn.ForgetProposal(tok4)
+	require.Equal(t, ProposalUnknown, rn.ProposalResult(tok4))
+	require.Empty(t, rn.proposals)
+
+	// Node 3 follows leader 2, and forwards the proposal with its context.
+	s3 := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn3 := newTestRawNode(3, 10, 1, s3)
+	require.NoError(t, rn3.Step(pb.Message{From: 2, To: 3, Term: 2, Type: pb.MsgHeartbeat}))
+	rn3.raft.readMessages()
+	tok5, err := rn3.ProposeWithResult([]byte("foo"))
+	require.NoError(t, err)
+	msgs := rn3.raft.readMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, pb.MsgProp, msgs[0].Type)
+	ent := msgs[0].Entries[0]
+	require.Equal(t, []byte("foo"), ProposalData(ent.Data))
+	require.Equal(t, ProposalPending, rn3.ProposalResult(tok5))
+
+	// The leader appends and commits the entry, which resolves the token.
+	ent.Term, ent.Index = 2, 1
+	require.NoError(t, rn3.Step(pb.Message{From: 2, To: 3, Term: 2, Type: pb.MsgApp,
+		Commit: 1, Entries: []pb.Entry{ent}}))
+	require.Equal(t, ProposalPending, rn3.ProposalResult(tok5))
+	rd := rn3.Ready()
+	require.Equal(t, []pb.Entry{ent}, rd.CommittedEntries)
+	require.NoError(t, s3.Append(rd.Entries))
+	rn3.Advance(rd)
+	require.Equal(t, ProposalCommitted, rn3.ProposalResult(tok5))
+	require.Empty(t, rn3.proposals)
+	require.Equal(t, []byte("bar"), ProposalData([]byte("bar")))
+}
+
+// TestRawNodeProposeWithID ensures that the entries proposed with
+// RawNode.ProposeWithID are reported with their IDs in Ready.ProposalIDs once
+// committed, unless they were overwritten.
+func TestRawNodeProposeWithID(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	var ids []ProposalID
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			ids = append(ids, rd.ProposalIDs...)
+			for _, id := range rd.ProposalIDs {
+				require.Contains(t, rd.CommittedEntries, pb.Entry{Term: 1, Index: id.Index, Data: []byte(fmt.Sprint(id.ID))})
+			}
+			rn.Advance(rd)
+		}
+	}
+	require.Equal(t, ErrProposalDropped, rn.ProposeWithID([]byte("100"), 100))
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	stabilize()
+	require.NoError(t, rn.ProposeWithID([]byte("100"), 100))
+	require.NoError(t, rn.Propose([]byte("foo")))
+	require.NoError(t, rn.ProposeWithID([]byte("101"), 101))
+	stabilize()
+	require.Empty(t, ids)
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 4}))
+	stabilize()
+	require.Equal(t, []ProposalID{{Index: 2, ID: 100}, {Index: 4, ID: 101}}, ids)
+	require.Empty(t, rn.taggedProposals)
+
+	// A new leader overwrites the tagged entry, which is not reported.
+	ids = nil
+	require.NoError(t, rn.ProposeWithID([]byte("102"), 102))
+	stabilize()
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term + 1, Type: pb.MsgApp,
+		LogTerm: 1, Index: 4, Commit: 5, Entries: []pb.Entry{{Term: r.Term + 1, Index: 5}}}))
+	stabilize()
+	require.Equal(t, uint64(5), r.raftLog.applied)
+	require.Empty(t, ids)
+	require.Empty(t, rn.taggedProposals)
+}
+
+// TestRawNodeProposeBatch ensures that RawNode.ProposeBatch appends the batch
+// contiguously, and drops it as a whole if it exceeds the uncommitted size
+// limit.
+func TestRawNodeProposeBatch(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.MaxUncommittedEntriesSize = 10
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	require.NoError(t, rn.ProposeBatch(nil))
+	require.Equal(t, uint64(1), r.raftLog.lastIndex())
+
+	require.NoError(t, rn.Propose([]byte("a")))
+	require.NoError(t, rn.ProposeBatch([][]byte{[]byte("b"), []byte("cc"), []byte("d")}))
+	ents := r.raftLog.allEntries()
+	require.Len(t, ents, 5)
+	for i, want := range []string{"", "a", "b", "cc", "d"} {
+		require.Equal(t, uint64(i+1), ents[i].Index)
+		require.Equal(t, r.Term, ents[i].Term)
+		require.Equal(t, want, string(ents[i].Data))
+	}
+	require.Equal(t, uint64(5), rn.UncommittedPayloadSize())
+
+	// The batch would take the size to 11, so none of it is appended even
+	// though its first entries fit.
+	require.Equal(t, ErrProposalDropped, rn.ProposeBatch([][]byte{[]byte("ee"), []byte("fff"), []byte("g")}))
+	require.Equal(t, uint64(5), r.raftLog.lastIndex())
+	require.Equal(t, uint64(5), rn.UncommittedPayloadSize())
+	require.NoError(t, rn.ProposeBatch([][]byte{[]byte("ee"), []byte("fff")}))
+	require.Equal(t, uint64(7), r.raftLog.lastIndex())
+}
+
+// TestRawNodeRejectEmptyProposals ensures that proposals with empty data are
+// rejected with ErrEmptyProposal if Config.RejectEmptyProposals is set, and
+// appended otherwise.
+func TestRawNodeRejectEmptyProposals(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprint(reject), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1, 2))
+			cfg := newTestConfig(1, 10, 1, s)
+			cfg.RejectEmptyProposals = reject
+			rn, err := NewRawNode(cfg)
+			require.NoError(t, err)
+			r := rn.raft
+			r.becomeCandidate()
+			r.becomeLeader()
+			last := r.raftLog.lastIndex()
+
+			var want error
+			if reject {
+				want = ErrEmptyProposal
+			}
+			require.Equal(t, want, rn.Propose(nil))
+			require.Equal(t, want, rn.Propose([]byte{}))
+			require.Equal(t, want, rn.ProposeBatch([][]byte{[]byte("a"), nil}))
+			if reject {
+				require.Equal(t, last, r.raftLog.lastIndex())
+			} else {
+				require.Equal(t, last+4, r.raftLog.lastIndex())
+			}
+
+			// Non-empty proposals and conf changes are unaffected.
+			require.NoError(t, rn.Propose([]byte("b")))
+			require.NoError(t, rn.ProposeConfChange(pb.ConfChangeV2{}))
+		})
+	}
+}
+
+// TestRawNodeForceSingleVoter ensures that a node left alone from a lost
+// quorum can be forced into a single-voter configuration, and commits alone.
+func TestRawNodeForceSingleVoter(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.Error(t, rn.ForceSingleVoter(None))
+
+	// The node can't get elected without nodes 2 and 3.
+	require.NoError(t, rn.Campaign())
+	require.Equal(t, StateCandidate, rn.raft.state)
+
+	require.NoError(t, rn.ForceSingleVoter(1))
+	require.Equal(t, pb.ConfState{Voters: []uint64{1}}, rn.raft.trk.ConfState())
+	require.NoError(t, rn.Campaign())
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	require.Equal(t, StateLeader, rn.raft.state)
+
+	require.NoError(t, rn.Propose([]byte("foo")))
+	var committed []pb.Entry
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		committed = append(committed, rd.CommittedEntries...)
+		rn.Advance(rd)
+	}
+	require.NotEmpty(t, committed)
+	require.Equal(t, "foo", string(committed[len(committed)-1].Data))
+}
+
 // TestRawNodeProposeAddDuplicateNode ensures that two proposes to add the same node should
 // not affect the later propose to add new node.
 func TestRawNodeProposeAddDuplicateNode(t *testing.T) {
@@ -552,6 +843,1509 @@ func TestRawNodeReadIndex(t *testing.T) {
 	assert.Equal(t, wrequestCtx, msgs[0].Entries[0].Data)
 }
 
+// TestRawNodeReadIndexWithContext ensures that ReadIndexWithContext serves
+// reads like ReadIndex, and rejects empty and recently used contexts.
+func TestRawNodeReadIndexWithContext(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	c := newTestConfig(1, 10, 1, s)
+	c.ReadContextWindow = 2
+	rn, err := NewRawNode(c)
+	require.NoError(t, err)
+	require.NoError(t, rn.Campaign())
+	var readStates []ReadState
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			readStates = append(readStates, rd.ReadStates...)
+			rn.Advance(rd)
+		}
+	}
+	stabilize()
+
+	require.Equal(t, ErrEmptyReadContext, rn.ReadIndexWithContext(nil))
+	require.NoError(t, rn.ReadIndexWithContext([]byte("a")))
+	require.NoError(t, rn.ReadIndexWithContext([]byte("b")))
+	require.Equal(t, ErrDuplicateReadContext, rn.ReadIndexWithContext([]byte("a")))
+	require.Equal(t, ErrDuplicateReadContext, rn.ReadIndexWithContext([]byte("b")))
+	// "a" drops out of the window.
+	require.NoError(t, rn.ReadIndexWithContext([]byte("c")))
+	require.NoError(t, rn.ReadIndexWithContext([]byte("a")))
+	require.Equal(t, ErrDuplicateReadContext, rn.ReadIndexWithContext([]byte("c")))
+	stabilize()
+
+	require.Equal(t, []ReadState{
+		{Index: 1, RequestCtx: []byte("a")},
+		{Index: 1, RequestCtx: []byte("b")},
+		{Index: 1, RequestCtx: []byte("c")},
+		{Index: 1, RequestCtx: []byte("a")},
+	}, readStates)
+
+	// Without a window, only empty contexts are rejected.
+	c = newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1)))
+	rn, err = NewRawNode(c)
+	require.NoError(t, err)
+	require.Equal(t, ErrEmptyReadContext, rn.ReadIndexWithContext([]byte{}))
+	require.NoError(t, rn.ReadIndexWithContext([]byte("a")))
+	require.NoError(t, rn.ReadIndexWithContext([]byte("a")))
+}
+
+// TestRawNodeForgetLeader ensures that RawNode.ForgetLeader makes a follower
+// forget its leader without changing its term or vote, that it re-learns the
+// leader from the next heartbeat, and that it has no effect on a leader.
+func TestRawNodeForgetLeader(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgVote}))
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgHeartbeat}))
+	require.Equal(t, uint64(2), rn.raft.lead)
+
+	require.NoError(t, rn.ForgetLeader())
+	require.Equal(t, StateFollower, rn.raft.state)
+	require.Equal(t, None, rn.raft.lead)
+	require.Equal(t, uint64(2), rn.raft.Term)
+	require.Equal(t, uint64(2), rn.raft.Vote)
+
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgHeartbeat}))
+	require.Equal(t, uint64(2), rn.raft.lead)
+
+	require.NoError(t, rn.Campaign())
+	r := rn.raft
+	for _, id := range []uint64{2, 3} {
+		require.NoError(t, rn.Step(pb.Message{From: id, To: 1, Term: r.Term, Type: pb.MsgVoteResp}))
+	}
+	require.Equal(t, StateLeader, r.state)
+	require.NoError(t, rn.ForgetLeader())
+	require.Equal(t, StateLeader, r.state)
+	require.Equal(t, uint64(1), r.lead)
+}
+
+// TestRawNodeConfStateMatches ensures that RawNode.ConfStateMatches compares
+// the given ConfState against the active configuration.
+func TestRawNodeConfStateMatches(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3), withLearners(4))
+	rn := newTestRawNode(1, 10, 1, s)
+
+	assert.True(t, rn.ConfStateMatches(pb.ConfState{Voters: []uint64{3, 2, 1}, Learners: []uint64{4}}))
+	assert.False(t, rn.ConfStateMatches(pb.ConfState{Voters: []uint64{1, 2, 3}}))
+	assert.False(t, rn.ConfStateMatches(pb.ConfState{Voters: []uint64{1, 2, 3, 4}}))
+}
+
+// TestRawNodeReplicationFactor ensures that RawNode.ReplicationFactor counts
+// the voters whose Match is at or above the given index.
+func TestRawNodeReplicationFactor(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3, 4, 5), withLearners(6))
+	rn := newTestRawNode(1, 10, 1, s)
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	for id, match := range map[uint64]uint64{1: 10, 2: 8, 3: 5, 4: 3, 5: 0, 6: 10} {
+		r.trk.Progress[id].Match = match
+	}
+
+	for _, tt := range []struct {
+		index uint64
+		want  int
+	}{
+		{0, 5},
+		{3, 4},
+		{5, 3},
+		{6, 2},
+		{9, 1},
+		{11, 0},
+	} {
+		assert.Equal(t, tt.want, rn.ReplicationFactor(tt.index), "index %d", tt.index)
+	}
+}
+
+// TestRawNodeSyncPolicy ensures that Config.SyncPolicy overrides the default
+// computation of Ready.MustSync.
+func TestRawNodeSyncPolicy(t *testing.T) {
+	for _, relaxed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("relaxed=%t", relaxed), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1, 2, 3))
+			cfg := newTestConfig(1, 10, 1, s)
+			if relaxed {
+				cfg.SyncPolicy = func(rd Ready) bool { return len(rd.Entries) != 0 }
+			}
+			rn, err := NewRawNode(cfg)
+			require.NoError(t, err)
+
+			// Campaigning changes the term and vote, but appends no entries.
+			require.NoError(t, rn.Campaign())
+			rd := rn.Ready()
+			require.Empty(t, rd.Entries)
+			require.NotEqual(t, emptyState, rd.HardState)
+			assert.Equal(t, !relaxed, rd.MustSync)
+			require.NoError(t, s.SetHardState(rd.HardState))
+			rn.Advance(rd)
+
+			// Winning the election appends an empty entry, which must be synced.
+			require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: rn.raft.Term, Type: pb.MsgVoteResp}))
+			rd = rn.Ready()
+			require.NotEmpty(t, rd.Entries)
+			assert.True(t, rd.MustSync)
+		})
+	}
+}
+
+// TestRawNodeSnapshotMeta ensures that RawNode.SnapshotMeta reports the
+// metadata of an installed snapshot, both while it is pending in Ready and
+// after it has been applied to storage, as well as of a snapshot created in
+// storage later on.
+func TestRawNodeSnapshotMeta(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2))
+	rn := newTestRawNode(1, 10, 1, s)
+	index, term, cs := rn.SnapshotMeta()
+	assert.Zero(t, index)
+	assert.Zero(t, term)
+	assert.Equal(t, pb.ConfState{Voters: []uint64{1, 2}}, cs)
+
+	snap := pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index:     11,
+		Term:      3,
+		ConfState: pb.ConfState{Voters: []uint64{1, 2, 3}},
+	}}
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 3, Type: pb.MsgSnap, Snapshot: &snap}))
+	check := func() {
+		index, term, cs := rn.SnapshotMeta()
+		assert.Equal(t, uint64(11), index)
+		assert.Equal(t, uint64(3), term)
+		assert.Equal(t, snap.Metadata.ConfState, cs)
+	}
+	check()
+
+	rd := rn.Ready()
+	require.Equal(t, snap, rd.Snapshot)
+	require.NoError(t, s.ApplySnapshot(rd.Snapshot))
+	rn.Advance(rd)
+	check()
+
+	// A snapshot created locally is reported right away.
+	require.NoError(t, s.Append([]pb.Entry{{Index: 12, Term: 3}, {Index: 13, Term: 3}}))
+	_, err := s.CreateSnapshot(13, &snap.Metadata.ConfState, nil)
+	require.NoError(t, err)
+	index, term, cs = rn.SnapshotMeta()
+	assert.Equal(t, uint64(13), index)
+	assert.Equal(t, uint64(3), term)
+	assert.Equal(t, snap.Metadata.ConfState, cs)
+}
+
+// TestRawNodeInflightStats ensures that RawNode.InflightStats reports the
+// in-flight MsgApp windows of the followers.
+func TestRawNodeInflightStats(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.MaxInflightMsgs = 3
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	require.Nil(t, rn.InflightStats())
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	// Move follower 2 to StateReplicate. Follower 3 stays in StateProbe, and
+	// does not use the inflights window.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	require.NoError(t, rn.Propose([]byte("foo")))
+	require.NoError(t, rn.Propose([]byte("bar")))
+
+	stats := rn.InflightStats()
+	require.Len(t, stats, 3)
+	size := payloadSize(pb.Entry{Data: []byte("foo")})
+	assert.Equal(t, InflightStat{Count: 2, Bytes: uint64(2 * size), Capacity: 3}, stats[2])
+	assert.Equal(t, InflightStat{Capacity: 3}, stats[3])
+
+	require.NoError(t, rn.Propose([]byte("baz")))
+	assert.Equal(t, InflightStat{Count: 3, Bytes: uint64(3 * size), Capacity: 3, Full: true}, rn.InflightStats()[2])
+}
+
+// TestRawNodeInflightUtilization ensures that RawNode.InflightUtilization
+// reports the higher of the count-based and byte-based window usage.
+func TestRawNodeInflightUtilization(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.MaxSizePerMsg = 16
+	cfg.MaxInflightMsgs = 8
+	cfg.MaxInflightBytes = 64
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	require.Zero(t, rn.InflightUtilization(2))
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	require.Zero(t, rn.InflightUtilization(2))
+
+	// Count-based: 2 of 8 messages, 6 of 64 bytes.
+	require.NoError(t, rn.Propose([]byte("foo")))
+	require.NoError(t, rn.Propose([]byte("bar")))
+	assert.Equal(t, 0.25, rn.InflightUtilization(2))
+	// Byte-based: 3 of 8 messages, 46 of 64 bytes.
+	require.NoError(t, rn.Propose(make([]byte, 40)))
+	assert.Equal(t, 0.71875, rn.InflightUtilization(2))
+	// Follower 3 is in StateProbe and doesn't use the window, and follower 4
+	// is unknown.
+	assert.Zero(t, rn.InflightUtilization(3))
+	assert.Zero(t, rn.InflightUtilization(4))
+}
+
+// TestRawNodeQuorumActive ensures that RawNode.QuorumActive reflects whether
+// the leader has heard from a quorum in the current election interval.
+func TestRawNodeQuorumActive(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	cfg := newTestConfig(1, 5, 1, s)
+	cfg.CheckQuorum = true
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	require.False(t, rn.QuorumActive())
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	require.False(t, rn.QuorumActive())
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgHeartbeatResp}))
+	require.True(t, rn.QuorumActive())
+
+	// The leader checks the quorum, and starts a new interval.
+	for i := 0; i < r.electionTimeout; i++ {
+		rn.Tick()
+	}
+	require.Equal(t, StateLeader, r.state)
+	require.False(t, rn.QuorumActive())
+	require.NoError(t, rn.Step(pb.Message{From: 3, To: 1, Term: r.Term, Type: pb.MsgHeartbeatResp}))
+	require.True(t, rn.QuorumActive())
+
+	// Without responses, the leader steps down after the next check.
+	for i := 0; i < r.electionTimeout; i++ {
+		rn.Tick()
+	}
+	require.False(t, rn.QuorumActive())
+	require.Equal(t, StateLeader, r.state)
+	for i := 0; i < r.electionTimeout; i++ {
+		rn.Tick()
+	}
+	require.Equal(t, StateFollower, r.state)
+	require.False(t, rn.QuorumActive())
+}
+
+// TestRawNodeMaxInflightIndex ensures that RawNode.MaxInflightIndex reports
+// the highest index sent to any follower.
+func TestRawNodeMaxInflightIndex(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.Zero(t, rn.MaxInflightIndex())
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	// Both followers are probed, and nothing has been sent past the last
+	// index they are assumed to have.
+	require.Zero(t, rn.MaxInflightIndex())
+
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	require.Equal(t, uint64(1), rn.MaxInflightIndex())
+	require.NoError(t, rn.Propose([]byte("foo")))
+	require.NoError(t, rn.Propose([]byte("bar")))
+	require.Equal(t, uint64(3), rn.MaxInflightIndex())
+	require.NoError(t, rn.Propose([]byte("baz")))
+	require.Equal(t, uint64(4), rn.MaxInflightIndex())
+
+	// Follower 2 rejects, and the leader falls back to probing it.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp,
+		Index: 4, Reject: true, RejectHint: 1}))
+	require.Equal(t, uint64(1), rn.MaxInflightIndex())
+}
+
+// TestRawNodeCommitIndexWithout verifies that RawNode.CommitIndexWithout
+// computes the commit index as if the given voter did not count.
+func TestRawNodeCommitIndexWithout(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3, 4))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.Zero(t, rn.CommitIndexWithout(4))
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, rn.Propose([]byte("foo")))
+	}
+	require.Equal(t, uint64(5), r.raftLog.lastIndex())
+	for id, match := range map[uint64]uint64{1: 5, 2: 5, 3: 2, 4: 1} {
+		r.trk.Progress[id].Match = match
+	}
+	require.Equal(t, uint64(2), r.trk.Committed())
+
+	// Without one of the lagging voters, the other two have a majority.
+	require.Equal(t, uint64(5), rn.CommitIndexWithout(4))
+	require.Equal(t, uint64(5), rn.CommitIndexWithout(3))
+	require.Equal(t, uint64(2), rn.CommitIndexWithout(1))
+	// Unknown IDs change nothing.
+	require.Equal(t, uint64(2), rn.CommitIndexWithout(5))
+	// The voter still counts for the actual commit index.
+	require.Equal(t, uint64(2), r.trk.Committed())
+
+	// Without the only voter, or the only voter of a half of a joint
+	// configuration, nothing more can be committed.
+	for _, cs := range []pb.ConfState{
+		{Voters: []uint64{1}},
+		{Voters: []uint64{1, 2, 3}, VotersOutgoing: []uint64{1}},
+	} {
+		s := newTestMemoryStorage()
+		require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 1, Term: 1, ConfState: cs}}))
+		rn := newTestRawNode(1, 10, 1, s)
+		r := rn.raft
+		r.becomeCandidate()
+		r.becomeLeader()
+		require.NoError(t, rn.Propose([]byte("foo")))
+		committed := r.raftLog.committed
+		require.Less(t, committed, r.raftLog.lastIndex())
+		assert.Equal(t, committed, rn.CommitIndexWithout(1), "%v", cs)
+	}
+}
+
+// TestRawNodeVoteHistory ensures that RawNode.VoteHistory returns the votes
+// cast across terms in order, and keeps only the most recent ones.
+func TestRawNodeVoteHistory(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgVote}))
+	require.Nil(t, rn.VoteHistory())
+
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.RecordVoteHistory = true
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	require.Empty(t, rn.VoteHistory())
+
+	vote := func(from, term uint64, typ pb.MessageType) {
+		require.NoError(t, rn.Step(pb.Message{From: from, To: 1, Term: term, Type: typ}))
+	}
+	vote(2, 2, pb.MsgVote)
+	vote(2, 2, pb.MsgVote) // repeated
+	require.NoError(t, rn.Campaign())
+	vote(2, 4, pb.MsgPreVote) // pre-votes are not recorded
+	vote(3, 5, pb.MsgVote)
+	require.Equal(t, []VoteRecord{
+		{Term: 2, VotedFor: 2},
+		{Term: 3, VotedFor: 1},
+		{Term: 5, VotedFor: 3},
+	}, rn.VoteHistory())
+
+	for term := uint64(6); term < 6+voteHistorySize; term++ {
+		vote(term%2+2, term, pb.MsgVote)
+	}
+	h := rn.VoteHistory()
+	require.Len(t, h, voteHistorySize)
+	require.Equal(t, VoteRecord{Term: 6, VotedFor: 2}, h[0])
+	for i := range h {
+		require.Equal(t, uint64(6+i), h[i].Term)
+	}
+}
+
+// TestRawNodeReportSnapshotProgress ensures that the progress reported with
+// RawNode.ReportSnapshotProgress is passed to Config.SnapshotProgress.
+func TestRawNodeReportSnapshotProgress(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2))
+	rn := newTestRawNode(1, 10, 1, s)
+	rn.ReportSnapshotProgress(1, 2) // no callback set
+
+	var got [][2]uint64
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.SnapshotProgress = func(applied, total uint64) {
+		got = append(got, [2]uint64{applied, total})
+	}
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	rn.ReportSnapshotProgress(0, 100)
+	rn.ReportSnapshotProgress(40, 100)
+	rn.ReportSnapshotProgress(100, 100)
+	require.Equal(t, [][2]uint64{{0, 100}, {40, 100}, {100, 100}}, got)
+}
+
+// TestRawNodeProgressSnapshot ensures that RawNode.ProgressSnapshot returns a
+// copy of the progress of the peers which follows replication.
+func TestRawNodeProgressSnapshot(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3), withLearners(4))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.Empty(t, rn.ProgressSnapshot())
+	require.NotNil(t, rn.ProgressSnapshot())
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	ps := rn.ProgressSnapshot()
+	require.Len(t, ps, 4)
+	require.Equal(t, ProgressInfo{Match: 1, Next: 2, State: "StateReplicate", RecentActive: true}, ps[1])
+	require.Equal(t, ProgressInfo{Next: 1, State: "StateProbe"}, ps[2])
+	require.Equal(t, ProgressInfo{Next: 1, State: "StateProbe", IsLearner: true}, ps[4])
+
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	require.NoError(t, rn.Propose([]byte("foo")))
+	ps2 := rn.ProgressSnapshot()
+	require.Equal(t, ProgressInfo{Match: 1, Next: 3, State: "StateReplicate", Inflight: 1, RecentActive: true}, ps2[2])
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 2}))
+	require.Equal(t, uint64(2), rn.ProgressSnapshot()[2].Match)
+	// The earlier snapshots are not affected.
+	require.Equal(t, uint64(0), ps[2].Match)
+	require.Equal(t, uint64(1), ps2[2].Match)
+
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term + 1, Type: pb.MsgHeartbeat}))
+	require.Empty(t, rn.ProgressSnapshot())
+}
+
+// compactedEntriesStorage is a MemoryStorage whose Entries returns
+// ErrCompacted once compacted is set.
+type compactedEntriesStorage struct {
+	*MemoryStorage
+	compacted bool
+}
+
+func (s *compactedEntriesStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
+	if s.compacted {
+		return nil, ErrCompacted
+	}
+	return s.MemoryStorage.Entries(lo, hi, maxSize)
+}
+
+// TestRawNodeAppliedConfChangeIndexes ensures that
+// RawNode.AppliedConfChangeIndexes lists the applied configuration change
+// entries still in the log.
+func TestRawNodeAppliedConfChangeIndexes(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.NoError(t, rn.Campaign())
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			for _, e := range rd.CommittedEntries {
+				switch e.Type {
+				case pb.EntryConfChange:
+					var cc pb.ConfChange
+					require.NoError(t, cc.Unmarshal(e.Data))
+					rn.ApplyConfChange(cc)
+				case pb.EntryConfChangeV2:
+					var cc pb.ConfChangeV2
+					require.NoError(t, cc.Unmarshal(e.Data))
+					rn.ApplyConfChange(cc)
+				}
+			}
+			rn.Advance(rd)
+		}
+	}
+	stabilize()
+	require.Empty(t, rn.AppliedConfChangeIndexes())
+
+	// Index 1 is the empty entry of the leader.
+	require.NoError(t, rn.Propose([]byte("foo")))
+	require.NoError(t, rn.ProposeConfChange(pb.ConfChange{Type: pb.ConfChangeAddLearnerNode, NodeID: 2}))
+	stabilize()
+	require.NoError(t, rn.Propose([]byte("bar")))
+	require.NoError(t, rn.ProposeConfChange(pb.ConfChangeV2{
+		Changes: []pb.ConfChangeSingle{{Type: pb.ConfChangeAddLearnerNode, NodeID: 3}},
+	}))
+	// Conf changes which are not applied yet are not listed.
+	require.Equal(t, []uint64{3}, rn.AppliedConfChangeIndexes())
+	stabilize()
+	require.Equal(t, []uint64{3, 5}, rn.AppliedConfChangeIndexes())
+
+	// Compacted entries are not listed.
+	require.NoError(t, s.Compact(4))
+	require.Equal(t, []uint64{5}, rn.AppliedConfChangeIndexes())
+
+	// Errors reading the entries are logged, e.g. if the log is compacted
+	// concurrently.
+	cs := &compactedEntriesStorage{MemoryStorage: s}
+	rn.raft.raftLog.storage = cs
+	l := &errorRecordingLogger{DefaultLogger: discardLogger}
+	rn.raft.logger = l
+	cs.compacted = true
+	require.Nil(t, rn.AppliedConfChangeIndexes())
+	require.Len(t, l.errors, 1)
+	require.Contains(t, l.errors[0], ErrCompacted.Error())
+}
+
+// TestRawNodeMemoryFootprint ensures that RawNode.MemoryFootprint grows with
+// unstable entries and pending read only requests, and shrinks again once the
+// entries are persisted.
+func TestRawNodeMemoryFootprint(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.NoError(t, rn.Campaign())
+	r := rn.raft
+	for _, id := range []uint64{2, 3} {
+		require.NoError(t, rn.Step(pb.Message{From: id, To: 1, Term: r.Term, Type: pb.MsgVoteResp}))
+	}
+	require.Equal(t, StateLeader, r.state)
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	base := rn.MemoryFootprint()
+	require.NotZero(t, base)
+
+	data := make([]byte, 1000)
+	require.NoError(t, rn.Propose(data))
+	proposed := rn.MemoryFootprint()
+	// The data is held by the unstable log.
+	require.GreaterOrEqual(t, proposed, base+uint64(len(data)))
+
+	// A pending read only request adds to the estimate until it is acked.
+	rn.ReadIndex(make([]byte, 100))
+	require.Greater(t, rn.MemoryFootprint(), proposed)
+
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	require.Less(t, rn.MemoryFootprint(), proposed)
+}
+
+// TestRawNodeIsTransferEligible ensures that RawNode.IsTransferEligible only
+// accepts caught-up, recently active voters, and reports why others are not.
+func TestRawNodeIsTransferEligible(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3, 4), withLearners(5))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.CheckQuorum = true
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	ok, reason := rn.IsTransferEligible(2)
+	require.False(t, ok)
+	require.Equal(t, "this node is not the leader", reason)
+
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	// Follower 2 is caught up, follower 3 lags behind.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+	require.NoError(t, rn.Step(pb.Message{From: 3, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 0}))
+	// Follower 4 is not recently active.
+	r.trk.Progress[4].RecentActive = false
+
+	for _, tt := range []struct {
+		id     uint64
+		ok     bool
+		reason string
+	}{
+		{1, false, "already the leader"},
+		{2, true, ""},
+		{3, false, "not caught up (match 0, last index 1)"},
+		{4, false, "not recently active"},
+		{5, false, "is a learner"},
+		{6, false, "not a voter"},
+	} {
+		ok, reason := rn.IsTransferEligible(tt.id)
+		assert.Equal(t, tt.ok, ok, "id %d", tt.id)
+		assert.Equal(t, tt.reason, reason, "id %d", tt.id)
+	}
+}
+
+// TestRawNodeKickAppend ensures that RawNode.KickAppend makes the leader send
+// an append or a snapshot to a newly added learner immediately.
+func TestRawNodeKickAppend(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compact=%t", compact), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1, 2))
+			rn := newTestRawNode(1, 10, 1, s)
+			r := rn.raft
+			r.becomeCandidate()
+			r.becomeLeader()
+			require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 1}))
+			require.NoError(t, rn.Propose([]byte("foo")))
+			require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 2}))
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			rn.Advance(rd)
+			cs := rn.ApplyConfChange(pb.ConfChangeV2{Changes: []pb.ConfChangeSingle{
+				{Type: pb.ConfChangeAddLearnerNode, NodeID: 3},
+			}})
+			r.readMessages()
+			// The learner has been probed already, so nothing else is sent to it
+			// until it responds.
+			require.True(t, r.trk.Progress[3].IsPaused())
+			if compact {
+				_, err := s.CreateSnapshot(2, cs, nil)
+				require.NoError(t, err)
+				require.NoError(t, s.Compact(2))
+			}
+
+			rn.KickAppend(3)
+			msgs := r.readMessages()
+			require.Len(t, msgs, 1)
+			assert.Equal(t, uint64(3), msgs[0].To)
+			if compact {
+				assert.Equal(t, pb.MsgSnap, msgs[0].Type)
+			} else {
+				assert.Equal(t, pb.MsgApp, msgs[0].Type)
+			}
+
+			// Unknown peers and self are ignored.
+			rn.KickAppend(4)
+			rn.KickAppend(1)
+			assert.Empty(t, r.readMessages())
+		})
+	}
+}
+
+// TestRawNodeTermOf ensures that RawNode.TermOf returns the terms of entries
+// in the stable and unstable log, and the appropriate errors outside of it.
+func TestRawNodeTermOf(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index: 3, Term: 1, ConfState: pb.ConfState{Voters: []uint64{1}},
+	}}))
+	require.NoError(t, s.Append(index(4).terms(1, 2, 2)))
+	require.NoError(t, s.SetHardState(pb.HardState{Term: 2, Commit: 3}))
+	rn := newTestRawNode(1, 10, 1, s)
+	// The leader appends an empty entry at index 7 to its unstable log.
+	require.NoError(t, rn.Campaign())
+	rn.Advance(rn.Ready())
+	require.Equal(t, StateLeader, rn.raft.state)
+	require.Equal(t, uint64(7), rn.raft.raftLog.lastIndex())
+	require.Equal(t, uint64(7), rn.raft.raftLog.unstable.offset)
+
+	for _, tt := range []struct {
+		index uint64
+		term  uint64
+		err   error
+	}{
+		{index: 2, err: ErrCompacted},
+		{index: 3, term: 1},
+		{index: 4, term: 1},
+		{index: 6, term: 2},
+		{index: 7, term: 3},
+		{index: 8, err: ErrUnavailable},
+	} {
+		term, err := rn.TermOf(tt.index)
+		assert.Equal(t, tt.err, err, "index %d", tt.index)
+		assert.Equal(t, tt.term, term, "index %d", tt.index)
+	}
+}
+
+// TestRawNodeCurrentVote ensures that RawNode.CurrentVote reports the vote
+// cast in the current term, and that it resets when the term changes.
+func TestRawNodeCurrentVote(t *testing.T) {
+	rn := newTestRawNode(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+	term, vote := rn.CurrentVote()
+	require.Equal(t, uint64(0), term)
+	require.Equal(t, None, vote)
+
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 2, Type: pb.MsgVote}))
+	term, vote = rn.CurrentVote()
+	require.Equal(t, uint64(2), term)
+	require.Equal(t, uint64(2), vote)
+
+	// A competing candidate in the same term does not get the vote.
+	require.NoError(t, rn.Step(pb.Message{From: 3, To: 1, Term: 2, Type: pb.MsgVote}))
+	term, vote = rn.CurrentVote()
+	require.Equal(t, uint64(2), term)
+	require.Equal(t, uint64(2), vote)
+
+	require.NoError(t, rn.Step(pb.Message{From: 3, To: 1, Term: 3, Type: pb.MsgHeartbeat}))
+	term, vote = rn.CurrentVote()
+	require.Equal(t, uint64(3), term)
+	require.Equal(t, None, vote)
+}
+
+// TestRawNodeIsJoint ensures that RawNode.IsJoint reports whether the applied
+// configuration is joint.
+func TestRawNodeIsJoint(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.False(t, rn.IsJoint())
+
+	rn.ApplyConfChange(pb.ConfChangeV2{
+		Transition: pb.ConfChangeTransitionJointExplicit,
+		Changes:    []pb.ConfChangeSingle{{Type: pb.ConfChangeAddNode, NodeID: 2}},
+	})
+	require.True(t, rn.IsJoint())
+	rn.ApplyConfChange(pb.ConfChangeV2{})
+	require.False(t, rn.IsJoint())
+	require.Equal(t, pb.ConfState{Voters: []uint64{1, 2}}, rn.raft.trk.ConfState())
+}
+
+// TestRawNodePersistentState ensures that RawNode.PersistentState returns the
+// current HardState and ConfState as they change.
+func TestRawNodePersistentState(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	require.NoError(t, s.SetHardState(pb.HardState{Term: 3, Vote: 2, Commit: 0}))
+	rn := newTestRawNode(1, 10, 1, s)
+	hs, cs := rn.PersistentState()
+	require.Equal(t, pb.HardState{Term: 3, Vote: 2}, hs)
+	require.Equal(t, pb.ConfState{Voters: []uint64{1}}, cs)
+
+	require.NoError(t, rn.Campaign())
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	require.NoError(t, rn.ProposeConfChange(pb.ConfChange{Type: pb.ConfChangeAddLearnerNode, NodeID: 2}))
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		for _, e := range rd.CommittedEntries {
+			if e.Type == pb.EntryConfChange {
+				var cc pb.ConfChange
+				require.NoError(t, cc.Unmarshal(e.Data))
+				rn.ApplyConfChange(cc)
+			}
+		}
+		rn.Advance(rd)
+	}
+	hs, cs = rn.PersistentState()
+	require.Equal(t, pb.HardState{Term: 4, Vote: 1, Commit: 2}, hs)
+	require.Equal(t, rn.raft.hardState(), hs)
+	require.Equal(t, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{2}}, cs)
+}
+
+// TestRawNodeEntriesOrSnapshot ensures that RawNode.EntriesOrSnapshot
+// returns the snapshot in place of the compacted part of the requested range.
+func TestRawNodeEntriesOrSnapshot(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index: 3, Term: 1, ConfState: pb.ConfState{Voters: []uint64{1}},
+	}}))
+	require.NoError(t, s.Append(index(4).terms(1, 2, 2)))
+	require.NoError(t, s.SetHardState(pb.HardState{Term: 2, Commit: 3}))
+	rn := newTestRawNode(1, 10, 1, s)
+	// The leader appends an empty entry at index 7 to its unstable log.
+	require.NoError(t, rn.Campaign())
+	rn.Advance(rn.Ready())
+	require.Equal(t, uint64(7), rn.raft.raftLog.lastIndex())
+
+	for _, tt := range []struct {
+		lo, hi uint64
+		ents   []pb.Entry
+		snap   bool
+		err    error
+	}{
+		{lo: 1, hi: 3, snap: true},
+		{lo: 2, hi: 4, snap: true},
+		{lo: 2, hi: 6, ents: index(4).terms(1, 2), snap: true},
+		{lo: 1, hi: 8, ents: index(4).terms(1, 2, 2, 3), snap: true},
+		{lo: 4, hi: 8, ents: index(4).terms(1, 2, 2, 3)},
+		{lo: 6, hi: 6},
+		{lo: 3, hi: 9, err: ErrUnavailable},
+		{lo: 5, hi: 4, err: ErrUnavailable},
+	} {
+		t.Run("", func(t *testing.T) {
+			ents, snap, err := rn.EntriesOrSnapshot(tt.lo, tt.hi)
+			require.Equal(t, tt.err, err)
+			require.Equal(t, tt.ents, ents)
+			require.Equal(t, tt.snap, snap != nil)
+			if snap != nil {
+				require.Equal(t, uint64(3), snap.Metadata.Index)
+			}
+		})
+	}
+
+	// A snapshot older than the first index cannot cover the gap.
+	require.NoError(t, s.Compact(5))
+	_, _, err := rn.EntriesOrSnapshot(2, 7)
+	require.Equal(t, ErrCompacted, err)
+	ents, snap, err := rn.EntriesOrSnapshot(6, 8)
+	require.NoError(t, err)
+	require.Nil(t, snap)
+	require.Equal(t, index(6).terms(2, 3), ents)
+}
+
+// TestRawNodeLogBounds ensures that RawNode.LogBounds reports the log
+// indexes consistently as entries are appended, committed, applied and
+// compacted.
+func TestRawNodeLogBounds(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	rn := newTestRawNode(1, 10, 1, s)
+
+	check := func(first, applied, committed, last uint64) {
+		t.Helper()
+		f, a, c, l := rn.LogBounds()
+		require.Equal(t, [4]uint64{first, applied, committed, last}, [4]uint64{f, a, c, l})
+		require.LessOrEqual(t, f, a+1)
+		require.LessOrEqual(t, a, c)
+		require.LessOrEqual(t, c, l)
+	}
+	check(1, 0, 0, 0)
+
+	require.NoError(t, rn.Campaign())
+	// Campaign, become leader and append the empty entry, but hold off on
+	// acknowledging the append.
+	rd := rn.Ready()
+	require.NoError(t, s.Append(rd.Entries))
+	rn.Advance(rd)
+	rd = rn.Ready()
+	check(1, 0, 0, 1)
+
+	require.NoError(t, s.Append(rd.Entries))
+	rn.Advance(rd)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rn.Propose([]byte("foo")))
+	}
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	check(1, 4, 4, 4)
+
+	require.NoError(t, s.Compact(3))
+	check(4, 4, 4, 4)
+}
+
+// TestRawNodeConfStateAt ensures that RawNode.ConfStateAt reconstructs the
+// configuration at past committed indexes.
+func TestRawNodeConfStateAt(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	rn := newTestRawNode(1, 10, 1, s)
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			for _, e := range rd.CommittedEntries {
+				switch e.Type {
+				case pb.EntryConfChange:
+					var cc pb.ConfChange
+					require.NoError(t, cc.Unmarshal(e.Data))
+					rn.ApplyConfChange(cc)
+				case pb.EntryConfChangeV2:
+					var cc pb.ConfChangeV2
+					require.NoError(t, cc.Unmarshal(e.Data))
+					rn.ApplyConfChange(cc)
+				}
+			}
+			rn.Advance(rd)
+		}
+	}
+	require.NoError(t, rn.Campaign())
+	stabilize()
+
+	// The log is: 1: empty, 2: add learner 2, 3: data, 4: add learner 3,
+	// 5: remove 2, 6: data.
+	for _, cc := range []pb.ConfChangeI{
+		pb.ConfChange{Type: pb.ConfChangeAddLearnerNode, NodeID: 2},
+		nil,
+		pb.ConfChangeV2{Changes: []pb.ConfChangeSingle{{Type: pb.ConfChangeAddLearnerNode, NodeID: 3}}},
+		pb.ConfChange{Type: pb.ConfChangeRemoveNode, NodeID: 2},
+		nil,
+	} {
+		if cc == nil {
+			require.NoError(t, rn.Propose([]byte("foo")))
+		} else {
+			require.NoError(t, rn.ProposeConfChange(cc))
+		}
+		stabilize()
+	}
+	require.Equal(t, uint64(6), rn.raft.raftLog.committed)
+
+	check := func(index uint64, want pb.ConfState) {
+		t.Helper()
+		cs, err := rn.ConfStateAt(index)
+		require.NoError(t, err)
+		require.Equal(t, want, cs, "index %d", index)
+	}
+	onlyVoter := pb.ConfState{Voters: []uint64{1}}
+	check(0, onlyVoter)
+	check(1, onlyVoter)
+	check(2, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{2}})
+	check(3, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{2}})
+	check(4, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{2, 3}})
+	check(5, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{3}})
+	check(6, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{3}})
+	_, err := rn.ConfStateAt(7)
+	require.Equal(t, ErrUnavailable, err)
+
+	// After compaction, the state is replayed from the snapshot.
+	_, err = s.CreateSnapshot(4, &pb.ConfState{Voters: []uint64{1}, Learners: []uint64{2, 3}}, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.Compact(4))
+	_, err = rn.ConfStateAt(3)
+	require.Equal(t, ErrCompacted, err)
+	check(4, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{2, 3}})
+	check(6, pb.ConfState{Voters: []uint64{1}, Learners: []uint64{3}})
+}
+
+// TestRawNodeFailureTolerance ensures that RawNode.FailureTolerance reports
+// the number of voter failures the configuration can tolerate.
+func TestRawNodeFailureTolerance(t *testing.T) {
+	for _, tt := range []struct {
+		cs   pb.ConfState
+		want int
+	}{
+		{pb.ConfState{Voters: []uint64{1}}, 0},
+		{pb.ConfState{Voters: []uint64{1, 2}}, 0},
+		{pb.ConfState{Voters: []uint64{1, 2, 3}}, 1},
+		{pb.ConfState{Voters: []uint64{1, 2, 3, 4}}, 1},
+		{pb.ConfState{Voters: []uint64{1, 2, 3, 4, 5}}, 2},
+		// Learners don't count.
+		{pb.ConfState{Voters: []uint64{1, 2, 3}, Learners: []uint64{4, 5}}, 1},
+		// Joint configurations tolerate the minimum of both halves.
+		{pb.ConfState{Voters: []uint64{1, 2, 3, 4, 5}, VotersOutgoing: []uint64{1, 2, 3}}, 1},
+		{pb.ConfState{Voters: []uint64{1, 2}, VotersOutgoing: []uint64{1, 2, 3, 4, 5}}, 0},
+		{pb.ConfState{Voters: []uint64{1, 2, 3, 4, 5}, VotersOutgoing: []uint64{1, 2, 3, 4, 5, 6, 7}}, 2},
+	} {
+		s := NewMemoryStorage()
+		require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{
+			Index: 1, Term: 1, ConfState: tt.cs,
+		}}))
+		rn := newTestRawNode(1, 10, 1, s)
+		assert.Equal(t, tt.want, rn.FailureTolerance(), "%v", tt.cs)
+	}
+}
+
+// TestRawNodeCheckInvariants ensures that RawNode.CheckInvariants passes on a
+// healthy node, and detects corrupted state.
+func TestRawNodeCheckInvariants(t *testing.T) {
+	newHealthy := func() *RawNode {
+		s := newTestMemoryStorage(withPeers(1, 2, 3))
+		rn := newTestRawNode(1, 10, 1, s)
+		require.NoError(t, rn.Campaign())
+		require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 1, Type: pb.MsgVoteResp}))
+		stabilize := func() {
+			for rn.HasReady() {
+				rd := rn.Ready()
+				require.NoError(t, s.Append(rd.Entries))
+				rn.Advance(rd)
+			}
+		}
+		stabilize()
+		require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 1, Type: pb.MsgAppResp, Index: 1}))
+		stabilize()
+		return rn
+	}
+	require.NoError(t, newHealthy().CheckInvariants())
+	rn := newHealthy()
+	s := rn.raft.raftLog.storage.(*MemoryStorage)
+	require.NoError(t, rn.ProposeConfChange(pb.ConfChange{Type: pb.ConfChangeAddLearnerNode, NodeID: 4}))
+	var cs *pb.ConfState
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			for _, e := range rd.CommittedEntries {
+				if e.Type == pb.EntryConfChange {
+					var cc pb.ConfChange
+					require.NoError(t, cc.Unmarshal(e.Data))
+					cs = rn.ApplyConfChange(cc)
+				}
+			}
+			rn.Advance(rd)
+		}
+	}
+	stabilize()
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 1, Type: pb.MsgAppResp, Index: rn.raft.raftLog.lastIndex()}))
+	stabilize()
+	require.NotNil(t, cs)
+	require.NoError(t, rn.CheckInvariants())
+
+	// The configuration is checked against the ConfState in storage.
+	_, err := s.CreateSnapshot(rn.raft.raftLog.applied, cs, nil)
+	require.NoError(t, err)
+	require.NoError(t, rn.CheckInvariants())
+	rn = newHealthy()
+	s = rn.raft.raftLog.storage.(*MemoryStorage)
+	_, err = s.CreateSnapshot(rn.raft.raftLog.applied, &pb.ConfState{Voters: []uint64{1, 2}}, nil)
+	require.NoError(t, err)
+	require.Error(t, rn.CheckInvariants())
+
+	for _, tt := range []struct {
+		name    string
+		corrupt func(r *raft)
+	}{
+		{"applied", func(r *raft) { r.raftLog.applied = r.raftLog.committed + 1 }},
+		{"committed", func(r *raft) { r.raftLog.committed = r.raftLog.lastIndex() + 1 }},
+		{"learner", func(r *raft) { r.trk.Progress[2].IsLearner = true }},
+		{"progress", func(r *raft) { r.trk.Progress[4] = r.trk.Progress[3] }},
+		{"config", func(r *raft) { delete(r.trk.Progress, 3) }},
+		{"confstate", func(r *raft) {
+			r.trk.Learners = map[uint64]struct{}{4: {}}
+			r.trk.Progress[4] = &tracker.Progress{IsLearner: true}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rn := newHealthy()
+			tt.corrupt(rn.raft)
+			assert.Error(t, rn.CheckInvariants())
+		})
+	}
+}
+
+// TestRawNodeMembers ensures that RawNode.Members reports the roles of all
+// members in the incoming and outgoing configurations.
+func TestRawNodeMembers(t *testing.T) {
+	s := NewMemoryStorage()
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index: 1, Term: 1, ConfState: pb.ConfState{
+			Voters:         []uint64{1, 2, 4},
+			VotersOutgoing: []uint64{1, 2, 3, 5},
+			Learners:       []uint64{6},
+			LearnersNext:   []uint64{5},
+		},
+	}}))
+	rn := newTestRawNode(1, 10, 1, s)
+	assert.Equal(t, []Member{
+		{ID: 1, Role: MemberRoleVoter, Outgoing: true},
+		{ID: 2, Role: MemberRoleVoter, Outgoing: true},
+		{ID: 3, Role: MemberRoleNone, Outgoing: true},
+		{ID: 4, Role: MemberRoleVoter},
+		{ID: 5, Role: MemberRoleLearner, Outgoing: true},
+		{ID: 6, Role: MemberRoleLearner},
+	}, rn.Members())
+}
+
+// TestRawNodeSafeCompactIndex ensures that RawNode.SafeCompactIndex accounts
+// for lagging followers and the configured safety margin.
+func TestRawNodeSafeCompactIndex(t *testing.T) {
+	for _, margin := range []uint64{0, 2, 10} {
+		t.Run(fmt.Sprintf("margin=%d", margin), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1, 2, 3, 4))
+			cfg := newTestConfig(1, 10, 1, s)
+			cfg.CompactionSafetyMargin = margin
+			rn, err := NewRawNode(cfg)
+			require.NoError(t, err)
+			r := rn.raft
+			sub := func(index uint64) uint64 {
+				if index < margin {
+					return 0
+				}
+				return index - margin
+			}
+
+			r.becomeCandidate()
+			r.becomeLeader()
+			for i := 0; i < 9; i++ {
+				require.NoError(t, rn.Propose([]byte("foo")))
+			}
+			require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 10}))
+			require.NoError(t, rn.Step(pb.Message{From: 3, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 10}))
+			for rn.HasReady() {
+				rd := rn.Ready()
+				require.NoError(t, s.Append(rd.Entries))
+				rn.Advance(rd)
+			}
+			require.Equal(t, uint64(10), r.raftLog.applied)
+
+			// Follower 4 has not acked anything.
+			assert.Equal(t, uint64(0), rn.SafeCompactIndex())
+			require.NoError(t, rn.Step(pb.Message{From: 4, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 8}))
+			assert.Equal(t, sub(8), rn.SafeCompactIndex())
+			// Followers waiting for a snapshot are not accounted for.
+			r.trk.Progress[4].BecomeSnapshot(10)
+			assert.Equal(t, sub(10), rn.SafeCompactIndex())
+
+			// On followers, the applied index is used.
+			r.becomeFollower(r.Term+1, 2)
+			assert.Equal(t, sub(10), rn.SafeCompactIndex())
+		})
+	}
+}
+
+// TestRawNodeStepMany ensures that RawNode.StepMany has the same effect as
+// stepping the messages one by one, and reports the first failure.
+func TestRawNodeStepMany(t *testing.T) {
+	newFollower := func() *RawNode {
+		rn := newTestRawNode(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+		rn.raft.becomeFollower(1, 2)
+		return rn
+	}
+	msgs := []pb.Message{
+		{From: 2, To: 1, Type: pb.MsgApp, Term: 1, Entries: index(1).terms(1, 1)},
+		{From: 2, To: 1, Type: pb.MsgHeartbeat, Term: 1, Commit: 1},
+		{From: 2, To: 1, Type: pb.MsgApp, Term: 1, Index: 2, LogTerm: 1, Commit: 2, Entries: index(3).terms(1)},
+	}
+
+	rn1, rn2 := newFollower(), newFollower()
+	require.NoError(t, rn1.StepMany(msgs))
+	for _, m := range msgs {
+		require.NoError(t, rn2.Step(m))
+	}
+	require.Equal(t, rn2.Ready(), rn1.Ready())
+
+	// Local messages are rejected like in Step, and stepping stops there.
+	rn := newFollower()
+	bad := append(msgs[:1:1], pb.Message{From: 2, To: 1, Type: pb.MsgHup}, msgs[1])
+	err := rn.StepMany(bad)
+	var smErr *StepManyError
+	require.ErrorAs(t, err, &smErr)
+	require.Equal(t, 1, smErr.Index)
+	require.ErrorIs(t, err, ErrStepLocalMsg)
+	require.Equal(t, uint64(2), rn.raft.raftLog.lastIndex())
+	require.Zero(t, rn.raft.raftLog.committed)
+}
+
+// TestRawNodeReportEmptyEntries ensures that Ready.EmptyEntryIndexes flags
+// the empty entries among the committed entries if so configured.
+func TestRawNodeReportEmptyEntries(t *testing.T) {
+	for _, report := range []bool{false, true} {
+		t.Run(fmt.Sprint(report), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1))
+			cfg := newTestConfig(1, 10, 1, s)
+			cfg.ReportEmptyEntries = report
+			rn, err := NewRawNode(cfg)
+			require.NoError(t, err)
+
+			var empty []uint64
+			stabilize := func() {
+				for rn.HasReady() {
+					rd := rn.Ready()
+					require.NoError(t, s.Append(rd.Entries))
+					for _, idx := range rd.EmptyEntryIndexes {
+						require.Empty(t, rd.CommittedEntries[idx-rd.CommittedEntries[0].Index].Data)
+					}
+					empty = append(empty, rd.EmptyEntryIndexes...)
+					rn.Advance(rd)
+				}
+			}
+			// Each election appends an empty entry: 1, 3, 4 and 6.
+			for _, data := range []string{"a", "", "b", ""} {
+				require.NoError(t, rn.Campaign())
+				stabilize()
+				if data != "" {
+					require.NoError(t, rn.Propose([]byte(data)))
+					stabilize()
+				}
+				rn.raft.becomeFollower(rn.raft.Term, None)
+			}
+			if report {
+				require.Equal(t, []uint64{1, 3, 4, 6}, empty)
+			} else {
+				require.Empty(t, empty)
+			}
+		})
+	}
+}
+
+// TestRawNodeSnapshotOnLogBytes ensures that Ready.ShouldSnapshot is set once
+// the log in Storage grows beyond Config.SnapshotOnLogBytes.
+func TestRawNodeSnapshotOnLogBytes(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.SnapshotOnLogBytes = 100
+	// The Storage must be able to report its size.
+	cfg.Storage = struct{ Storage }{s}
+	require.Panics(t, func() { _, _ = NewRawNode(cfg) })
+	cfg.Storage = s
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+
+	var signalled bool
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			signalled = rd.ShouldSnapshot
+			require.Equal(t, s.SizeInBytes() > 100, signalled)
+			require.NoError(t, s.Append(rd.Entries))
+			rn.Advance(rd)
+		}
+	}
+	require.NoError(t, rn.Campaign())
+	stabilize()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rn.Propose(make([]byte, 20)))
+		stabilize()
+		require.False(t, signalled, "proposal %d", i)
+	}
+	require.NoError(t, rn.Propose(make([]byte, 20)))
+	stabilize()
+	require.True(t, signalled)
+
+	// The signal clears once the log is compacted.
+	applied := rn.raft.raftLog.applied
+	_, err = s.CreateSnapshot(applied, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.Compact(applied))
+	require.NoError(t, rn.Propose(make([]byte, 20)))
+	stabilize()
+	require.False(t, signalled)
+}
+
+// TestRawNodeMaxMessagesPerReady ensures that Config.MaxMessagesPerReady
+// spreads the messages across successive Readys, without losing or reordering
+// any of them.
+func TestRawNodeMaxMessagesPerReady(t *testing.T) {
+	peers := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	s := newTestMemoryStorage(withPeers(peers...))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.MaxMessagesPerReady = 4
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+
+	var msgs []pb.Message
+	var readys int
+	stabilize := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.LessOrEqual(t, len(rd.Messages), 4)
+			readys++
+			msgs = append(msgs, rd.Messages...)
+			require.NoError(t, s.Append(rd.Entries))
+			rn.Advance(rd)
+		}
+	}
+	// The vote requests take 3 Readys.
+	require.NoError(t, rn.Campaign())
+	stabilize()
+	require.Equal(t, 3, readys)
+	require.Len(t, msgs, 9)
+	for i, m := range msgs {
+		require.Equal(t, pb.MsgVote, m.Type)
+		require.Equal(t, uint64(i+2), m.To)
+	}
+
+	// The node wins the election. The appends it sends are followed by
+	// heartbeats, which are queued behind the appends not sent yet.
+	msgs, readys = nil, 0
+	for id := uint64(2); id <= 6; id++ {
+		require.NoError(t, rn.Step(pb.Message{From: id, To: 1, Term: rn.raft.Term, Type: pb.MsgVoteResp}))
+	}
+	require.Equal(t, StateLeader, rn.raft.state)
+	rd := rn.Ready()
+	require.Len(t, rd.Messages, 4)
+	msgs = append(msgs, rd.Messages...)
+	require.NoError(t, s.Append(rd.Entries))
+	rn.Advance(rd)
+	rn.Tick()
+	stabilize()
+	require.Len(t, msgs, 18)
+	for i, m := range msgs {
+		require.Equal(t, uint64(i%9+2), m.To)
+		if i < 9 {
+			require.Equal(t, pb.MsgApp, m.Type)
+		} else {
+			require.Equal(t, pb.MsgHeartbeat, m.Type)
+		}
+	}
+	require.False(t, rn.HasReady())
+}
+
+// TestRawNodeSuppressAcks ensures that the leader doesn't count a follower
+// whose acks are suppressed towards the quorum, but keeps replicating to it.
+func TestRawNodeSuppressAcks(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2, 3))
+	rn := newTestRawNode(1, 10, 1, s)
+	stabilize := func() (msgs []pb.Message) {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, s.Append(rd.Entries))
+			msgs = append(msgs, rd.Messages...)
+			rn.Advance(rd)
+		}
+		return msgs
+	}
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	stabilize()
+	require.NoError(t, rn.Propose([]byte("foo")))
+	stabilize()
+
+	// Follower 3 is down, so follower 2 is the deciding vote.
+	rn.SuppressAcks(2, true)
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 2}))
+	stabilize()
+	require.Zero(t, r.trk.Progress[2].Match)
+	require.Zero(t, r.raftLog.committed)
+
+	// The leader keeps sending appends to the follower.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgHeartbeatResp}))
+	var sent bool
+	for _, m := range stabilize() {
+		sent = sent || (m.To == 2 && m.Type == pb.MsgApp)
+	}
+	require.True(t, sent)
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 2}))
+	require.Zero(t, r.raftLog.committed)
+
+	rn.SuppressAcks(2, false)
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 2}))
+	require.Equal(t, uint64(2), r.trk.Progress[2].Match)
+	require.Equal(t, uint64(2), r.raftLog.committed)
+}
+
+// TestRawNodeProcessStorageResponses ensures that the storage responses of a
+// Ready take effect on RawNode.ProcessStorageResponses, without waiting for
+// Advance.
+func TestRawNodeProcessStorageResponses(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	rn := newTestRawNode(1, 10, 1, s)
+	require.NoError(t, rn.Campaign())
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	r := rn.raft
+	committed := r.raftLog.committed
+
+	require.NoError(t, rn.Propose([]byte("foo")))
+	rd := rn.Ready()
+	require.Len(t, rd.Entries, 1)
+	require.NoError(t, s.Append(rd.Entries))
+	require.Equal(t, committed, r.raftLog.committed)
+
+	rn.ProcessStorageResponses()
+	require.Equal(t, committed+1, r.raftLog.committed)
+	require.True(t, rn.HasReady())
+	// Advance has nothing left to do for this Ready.
+	rn.Advance(rd)
+	require.Equal(t, committed+1, r.raftLog.committed)
+	rd = rn.Ready()
+	require.Len(t, rd.CommittedEntries, 1)
+	require.Equal(t, []byte("foo"), rd.CommittedEntries[0].Data)
+	rn.Advance(rd)
+}
+
+// TestRawNodeProcessStorageResponsesAsync ensures that with AsyncStorageWrites
+// a storage append response takes effect as soon as it is stepped, leaving
+// nothing for RawNode.ProcessStorageResponses to do.
+func TestRawNodeProcessStorageResponsesAsync(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.AsyncStorageWrites = true
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	rd := rn.Ready()
+	var resps []pb.Message
+	for _, m := range rd.Messages {
+		if m.Type == pb.MsgStorageAppend {
+			require.NoError(t, s.Append(m.Entries))
+			resps = append(resps, m.Responses...)
+		}
+	}
+	require.NotEmpty(t, resps)
+	require.Zero(t, r.raftLog.committed)
+	for _, m := range resps {
+		require.NoError(t, rn.Step(m))
+	}
+	require.Equal(t, uint64(1), r.raftLog.committed)
+	rn.ProcessStorageResponses()
+	require.Equal(t, uint64(1), r.raftLog.committed)
+}
+
+// TestRawNodeMaxResponsesPerMessage ensures that the responses attached to a
+// MsgStorageAppend are split across several messages if they exceed
+// Config.MaxResponsesPerMessage.
+func TestRawNodeMaxResponsesPerMessage(t *testing.T) {
+	for _, limit := range []int{0, 3} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			s := newTestMemoryStorage(withPeers(1, 2, 3))
+			cfg := newTestConfig(1, 10, 1, s)
+			cfg.AsyncStorageWrites = true
+			cfg.MaxResponsesPerMessage = limit
+			rn, err := NewRawNode(cfg)
+			require.NoError(t, err)
+			rn.raft.becomeFollower(1, 2)
+
+			// Each append is acked with a MsgAppResp after persistence.
+			for i := uint64(0); i < 7; i++ {
+				require.NoError(t, rn.Step(pb.Message{
+					From: 2, To: 1, Type: pb.MsgApp, Term: 1, Index: i, LogTerm: min(i, 1),
+					Entries: index(i + 1).terms(1),
+				}))
+			}
+			rd := rn.Ready()
+			var appends []pb.Message
+			for _, m := range rd.Messages {
+				if m.Type == pb.MsgStorageAppend {
+					appends = append(appends, m)
+				}
+			}
+			var resps []pb.Message
+			for i, m := range appends {
+				if limit > 0 {
+					require.LessOrEqual(t, len(m.Responses), limit)
+				}
+				if i > 0 {
+					require.Empty(t, m.Entries)
+					require.True(t, IsEmptyHardState(pb.HardState{Term: m.Term, Vote: m.Vote, Commit: m.Commit}))
+				}
+				resps = append(resps, m.Responses...)
+			}
+			require.Len(t, appends[0].Entries, 7)
+			require.Len(t, resps, 8)
+			for i, m := range resps[:7] {
+				require.Equal(t, pb.MsgAppResp, m.Type)
+				require.Equal(t, uint64(i+1), m.Index)
+			}
+			require.Equal(t, pb.MsgStorageAppendResp, resps[7].Type)
+			if limit == 0 {
+				require.Len(t, appends, 1)
+			} else {
+				require.Len(t, appends, 3)
+			}
+		})
+	}
+}
+
+// TestRawNodeMessageCounters ensures that RawNode.MessageCounters reports the
+// messages exchanged with other nodes, and that ResetMessageCounters zeroes
+// them.
+func TestRawNodeMessageCounters(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgHup})
+
+	rn := &RawNode{raft: nt.peers[1].(*raft)}
+	sent, received := rn.MessageCounters()
+	// The leader sent MsgVote, MsgApp with the empty entry, and MsgApp with the
+	// updated commit index to both followers, and received their responses.
+	assert.Equal(t, uint64(6), sent)
+	assert.Equal(t, uint64(6), received)
+
+	rn.ResetMessageCounters()
+	sent, received = rn.MessageCounters()
+	assert.Zero(t, sent)
+	assert.Zero(t, received)
+
+	nt.send(pb.Message{From: 1, To: 1, Type: pb.MsgBeat})
+	sent, received = rn.MessageCounters()
+	assert.Equal(t, uint64(2), sent)
+	assert.Equal(t, uint64(2), received)
+}
+
+// TestRawNodeDroppedProposalCount ensures that RawNode.DroppedProposalCount
+// counts the proposals dropped for any reason.
+func TestRawNodeDroppedProposalCount(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.DisableProposalForwarding = true
+	cfg.MaxUncommittedEntriesSize = 4
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+
+	// A follower without a leader drops proposals.
+	require.Equal(t, ErrProposalDropped, rn.Propose([]byte("a")))
+	require.Equal(t, ErrProposalDropped, rn.ProposeBatch([][]byte{[]byte("b"), []byte("c")}))
+	require.Equal(t, uint64(2), rn.DroppedProposalCount())
+	// So does a follower with a leader, if forwarding is disabled.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: 1, Type: pb.MsgHeartbeat}))
+	require.Equal(t, uint64(2), rn.raft.lead)
+	require.Equal(t, ErrProposalDropped, rn.Propose([]byte("d")))
+	require.Equal(t, uint64(3), rn.DroppedProposalCount())
+
+	rn.ResetDroppedProposalCount()
+	require.Zero(t, rn.DroppedProposalCount())
+
+	// The leader drops proposals exceeding the uncommitted size limit.
+	rn.raft.becomeCandidate()
+	rn.raft.becomeLeader()
+	require.NoError(t, rn.Propose([]byte("abc")))
+	require.Zero(t, rn.DroppedProposalCount())
+	require.Equal(t, ErrProposalDropped, rn.Propose([]byte("de")))
+	require.Equal(t, uint64(1), rn.DroppedProposalCount())
+}
+
 // TestBlockProposal from node_test.go has no equivalent in rawNode because there is
 // no leader check in RawNode.
 
@@ -813,6 +2607,39 @@ func TestRawNodeCommitPaginationAfterRestart(t *testing.T) {
 	}
 }
 
+// TestRawNodeUncommittedPayloadSize ensures that UncommittedPayloadSize
+// follows the size counted against MaxUncommittedEntriesSize.
+func TestRawNodeUncommittedPayloadSize(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1, 2))
+	cfg := newTestConfig(1, 10, 1, s)
+	cfg.MaxUncommittedEntriesSize = 10
+	rn, err := NewRawNode(cfg)
+	require.NoError(t, err)
+	r := rn.raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	require.Zero(t, rn.UncommittedPayloadSize())
+
+	require.NoError(t, rn.Propose([]byte("foo")))
+	require.Equal(t, uint64(3), rn.UncommittedPayloadSize())
+	require.NoError(t, rn.Propose([]byte("barbaz")))
+	require.Equal(t, uint64(9), rn.UncommittedPayloadSize())
+	require.Equal(t, ErrProposalDropped, rn.Propose([]byte("qu")))
+	require.Equal(t, uint64(9), rn.UncommittedPayloadSize())
+
+	// Commit and apply the first proposal.
+	require.NoError(t, rn.Step(pb.Message{From: 2, To: 1, Term: r.Term, Type: pb.MsgAppResp, Index: 2}))
+	for rn.HasReady() {
+		rd := rn.Ready()
+		require.NoError(t, s.Append(rd.Entries))
+		rn.Advance(rd)
+	}
+	require.Equal(t, uint64(2), r.raftLog.applied)
+	require.Equal(t, uint64(6), rn.UncommittedPayloadSize())
+	require.NoError(t, rn.Propose([]byte("qu")))
+	require.Equal(t, uint64(8), rn.UncommittedPayloadSize())
+}
+
 // TestRawNodeBoundedLogGrowthWithPartition tests a scenario where a leader is
 // partitioned from a quorum of nodes. It verifies that the leader's log is
 // protected from unbounded growth even as new entries continue to be proposed.
@@ -995,6 +2822,46 @@ func BenchmarkRawNode(b *testing.B) {
 	}
 }
 
+func BenchmarkRawNodeStepMany(b *testing.B) {
+	msgs := make([]pb.Message, 16)
+	for i := range msgs {
+		msgs[i] = pb.Message{From: 2, To: 1, Type: pb.MsgHeartbeat, Term: 1}
+	}
+	setup := func() *RawNode {
+		cfg := newTestConfig(1, 10, 1, newTestMemoryStorage(withPeers(1, 2, 3)))
+		cfg.Logger = discardLogger
+		rn, err := NewRawNode(cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rn.raft.becomeFollower(1, 2)
+		return rn
+	}
+
+	b.Run("Step", func(b *testing.B) {
+		rn := setup()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, m := range msgs {
+				if err := rn.Step(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+			rn.raft.msgs = rn.raft.msgs[:0]
+		}
+	})
+	b.Run("StepMany", func(b *testing.B) {
+		rn := setup()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := rn.StepMany(msgs); err != nil {
+				b.Fatal(err)
+			}
+			rn.raft.msgs = rn.raft.msgs[:0]
+		}
+	})
+}
+
 func benchmarkRawNodeImpl(b *testing.B, peers ...uint64) {
 
 	const debug = false
@@ -14,7 +14,11 @@
 
 package raft
 
-import pb "go.etcd.io/raft/v3/raftpb"
+import (
+	"unsafe"
+
+	pb "go.etcd.io/raft/v3/raftpb"
+)
 
 // ReadState provides state for read only query.
 // It's caller's responsibility to call ReadIndex first before getting
@@ -24,11 +28,17 @@ import pb "go.etcd.io/raft/v3/raftpb"
 type ReadState struct {
 	Index      uint64
 	RequestCtx []byte
+	// Rejected is set if the request could not be served, see
+	// Config.ForwardReadIndexOnStepDown. Index is zero then, and must not be
+	// used to serve the read.
+	Rejected bool
 }
 
 type readIndexStatus struct {
 	req   pb.Message
 	index uint64
+	// tick is the value of readOnly.ticks when the request was added.
+	tick int
 	// NB: this never records 'false', but it's more convenient to use this
 	// instead of a map[uint64]struct{} due to the API of quorum.VoteResult. If
 	// this becomes performance sensitive enough (doubtful), quorum.VoteResult
@@ -40,6 +50,9 @@ type readOnly struct {
 	option           ReadOnlyOption
 	pendingReadIndex map[string]*readIndexStatus
 	readIndexQueue   []string
+	// ticks is the number of ticks passed, used to track the age of the
+	// pending requests. Only maintained if Config.ReadIndexTimeoutTicks is set.
+	ticks int
 }
 
 func newReadOnly(option ReadOnlyOption) *readOnly {
@@ -58,7 +71,7 @@ func (ro *readOnly) addRequest(index uint64, m pb.Message) {
 	if _, ok := ro.pendingReadIndex[s]; ok {
 		return
 	}
-	ro.pendingReadIndex[s] = &readIndexStatus{index: index, req: m, acks: make(map[uint64]bool)}
+	ro.pendingReadIndex[s] = &readIndexStatus{index: index, req: m, tick: ro.ticks, acks: make(map[uint64]bool)}
 	ro.readIndexQueue = append(ro.readIndexQueue, s)
 }
 
@@ -111,6 +124,48 @@ func (ro *readOnly) advance(m pb.Message) []*readIndexStatus {
 	return nil
 }
 
+// tick advances the clock used to track the age of the pending requests.
+func (ro *readOnly) tick() {
+	ro.ticks++
+}
+
+// expire removes and returns the pending read only requests which were added
+// at least timeout ticks ago.
+func (ro *readOnly) expire(timeout int) []*readIndexStatus {
+	var rss []*readIndexStatus
+	for _, ctx := range ro.readIndexQueue {
+		rs := ro.pendingReadIndex[ctx]
+		if ro.ticks-rs.tick < timeout {
+			break
+		}
+		rss = append(rss, rs)
+		delete(ro.pendingReadIndex, ctx)
+	}
+	ro.readIndexQueue = ro.readIndexQueue[len(rss):]
+	return rss
+}
+
+// memoryFootprint returns an estimate of the number of bytes used by the
+// pending read only requests.
+func (ro *readOnly) memoryFootprint() uint64 {
+	var n uint64
+	for ctx, rs := range ro.pendingReadIndex {
+		// The context is held by the map key, the queue and the request.
+		n += uint64(unsafe.Sizeof(*rs)) + 3*uint64(len(ctx)) + messagesFootprint([]pb.Message{rs.req})
+		n += uint64(len(rs.acks)) * uint64(unsafe.Sizeof(uint64(0))+unsafe.Sizeof(false))
+	}
+	return n
+}
+
+// pendingRequests returns the pending read only requests, oldest first.
+func (ro *readOnly) pendingRequests() []pb.Message {
+	msgs := make([]pb.Message, 0, len(ro.readIndexQueue))
+	for _, ctx := range ro.readIndexQueue {
+		msgs = append(msgs, ro.pendingReadIndex[ctx].req)
+	}
+	return msgs
+}
+
 // lastPendingRequestCtx returns the context of the last pending read only
 // request in readonly struct.
 func (ro *readOnly) lastPendingRequestCtx() string {
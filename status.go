@@ -41,6 +41,63 @@ type BasicStatus struct {
 	LeadTransferee uint64
 }
 
+// InflightStat describes the in-flight MsgApp window of a follower. See
+// tracker.Inflights.
+type InflightStat struct {
+	// Count is the number of in-flight messages.
+	Count int
+	// Bytes is the total byte size of the entries in the in-flight messages.
+	Bytes uint64
+	// Capacity is the max number of in-flight messages.
+	Capacity int
+	// Full is true if no more messages can be sent at the moment.
+	Full bool
+}
+
+// ProgressInfo is a copy of the replication progress of a peer, as tracked by
+// the leader. See tracker.Progress.
+type ProgressInfo struct {
+	Match, Next uint64
+	// State is the replication state: StateProbe, StateReplicate or
+	// StateSnapshot.
+	State string
+	// Inflight is the number of in-flight MsgApp messages.
+	Inflight     int
+	RecentActive bool
+	IsLearner    bool
+}
+
+func getProgressInfos(r *raft) map[uint64]ProgressInfo {
+	m := make(map[uint64]ProgressInfo)
+	if r.state != StateLeader {
+		return m
+	}
+	r.trk.Visit(func(id uint64, pr *tracker.Progress) {
+		m[id] = ProgressInfo{
+			Match:        pr.Match,
+			Next:         pr.Next,
+			State:        pr.State.String(),
+			Inflight:     pr.Inflights.Count(),
+			RecentActive: pr.RecentActive,
+			IsLearner:    pr.IsLearner,
+		}
+	})
+	return m
+}
+
+func getInflightStats(r *raft) map[uint64]InflightStat {
+	m := make(map[uint64]InflightStat)
+	r.trk.Visit(func(id uint64, pr *tracker.Progress) {
+		m[id] = InflightStat{
+			Count:    pr.Inflights.Count(),
+			Bytes:    pr.Inflights.Bytes(),
+			Capacity: pr.Inflights.Cap(),
+			Full:     pr.Inflights.Full(),
+		}
+	})
+	return m
+}
+
 func getProgressCopy(r *raft) map[uint64]tracker.Progress {
 	m := make(map[uint64]tracker.Progress)
 	r.trk.Visit(func(id uint64, pr *tracker.Progress) {
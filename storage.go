@@ -15,7 +15,9 @@
 package raft
 
 import (
+	"bytes"
 	"errors"
+	"slices"
 	"sync"
 
 	pb "go.etcd.io/raft/v3/raftpb"
@@ -43,6 +45,11 @@ var ErrSnapshotTemporarilyUnavailable = errors.New("snapshot is temporarily unav
 // If any Storage method returns an error, the raft instance will
 // become inoperable and refuse to participate in elections; the
 // application is responsible for cleanup and recovery in this case.
+//
+// A Storage may implement io.Closer to release the resources it holds. Node.Stop
+// closes such a Storage, or the one wrapped by it (see MeteredStorage.Unwrap),
+// once the Node has stopped. A RawNode has no shutdown, so the application
+// closes the Storage once the RawNode is no longer used.
 type Storage interface {
 	// TODO(tbg): split this into two interfaces, LogStorage and StateStorage.
 
@@ -89,6 +96,19 @@ type Storage interface {
 	Snapshot() (pb.Snapshot, error)
 }
 
+// IterableStorage is a Storage which can also pass a range of entries to a
+// callback one at a time, which spares callers streaming the entries, e.g. to
+// a network connection, from materializing the whole range in a slice.
+// MemoryStorage implements it.
+type IterableStorage interface {
+	Storage
+	// EntriesFunc calls yield for the entries in [lo, hi), in order, until
+	// yield returns false. The entries are limited by maxSize the same way as
+	// the ones returned by Entries, and the errors are the same as well. In
+	// particular, yield is not called if an error is returned.
+	EntriesFunc(lo, hi, maxSize uint64, yield func(pb.Entry) bool) error
+}
+
 type inMemStorageCallStats struct {
 	initialState, firstIndex, lastIndex, entries, term, snapshot int
 }
@@ -105,6 +125,13 @@ type MemoryStorage struct {
 	snapshot  pb.Snapshot
 	// ents[i] has raft log position i+snapshot.Metadata.Index
 	ents []pb.Entry
+	// entsBytes is the total encoded size of ents[1:], see SizeInBytes.
+	entsBytes entryEncodingSize
+	// maxEntries, if positive, is the number of entries beyond which the log
+	// is automatically compacted. See SetMaxEntries.
+	maxEntries int
+	// closed is true after Close has been called.
+	closed bool
 
 	callStats inMemStorageCallStats
 }
@@ -117,25 +144,125 @@ func NewMemoryStorage() *MemoryStorage {
 	}
 }
 
+// Close releases the entries and the snapshot held by the MemoryStorage. After
+// Close, all methods return ErrUnavailable. Close implements io.Closer.
+func (ms *MemoryStorage) Close() error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.closed = true
+	ms.hardState = pb.HardState{}
+	ms.snapshot = pb.Snapshot{}
+	ms.ents = nil
+	ms.entsBytes = 0
+	return nil
+}
+
+// Clone returns a deep copy of the MemoryStorage, including its entries, its
+// HardState and its snapshot. The clone and the original can be used
+// independently. The call statistics are not copied.
+func (ms *MemoryStorage) Clone() *MemoryStorage {
+	ms.Lock()
+	defer ms.Unlock()
+	c := &MemoryStorage{
+		hardState:  ms.hardState,
+		snapshot:   ms.snapshot,
+		ents:       slices.Clone(ms.ents),
+		entsBytes:  ms.entsBytes,
+		maxEntries: ms.maxEntries,
+		closed:     ms.closed,
+	}
+	for i := range c.ents {
+		c.ents[i].Data = bytes.Clone(c.ents[i].Data)
+	}
+	c.snapshot.Data = bytes.Clone(ms.snapshot.Data)
+	cs := &c.snapshot.Metadata.ConfState
+	cs.Voters = slices.Clone(cs.Voters)
+	cs.Learners = slices.Clone(cs.Learners)
+	cs.VotersOutgoing = slices.Clone(cs.VotersOutgoing)
+	cs.LearnersNext = slices.Clone(cs.LearnersNext)
+	return c
+}
+
 // InitialState implements the Storage interface.
 func (ms *MemoryStorage) InitialState() (pb.HardState, pb.ConfState, error) {
+	ms.Lock()
+	defer ms.Unlock()
 	ms.callStats.initialState++
+	if ms.closed {
+		return pb.HardState{}, pb.ConfState{}, ErrUnavailable
+	}
 	return ms.hardState, ms.snapshot.Metadata.ConfState, nil
 }
 
+// SetMaxEntries makes the MemoryStorage automatically compact its log once it
+// holds more than n entries, discarding the oldest entries so that n remain.
+// Entries above the last snapshot index are never discarded, so memory is only
+// bounded if snapshots are created regularly (see CreateSnapshot). The
+// compaction is equivalent to a call to Compact. Zero or a negative n disables
+// the automatic compaction, which is the default.
+func (ms *MemoryStorage) SetMaxEntries(n int) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.maxEntries = n
+	if !ms.closed {
+		ms.maybeAutoCompact()
+	}
+}
+
+// maybeAutoCompact compacts the log if it holds more than maxEntries entries,
+// but not beyond the snapshot index.
+func (ms *MemoryStorage) maybeAutoCompact() {
+	if ms.maxEntries <= 0 || len(ms.ents)-1 <= ms.maxEntries {
+		return
+	}
+	i := min(ms.lastIndex()-uint64(ms.maxEntries), ms.snapshot.Metadata.Index)
+	if i > ms.ents[0].Index {
+		ms.compact(i)
+	}
+}
+
+// SizeInBytes returns the total encoded size of the log entries held by the
+// MemoryStorage. The size is maintained as entries are appended and
+// compacted, so this is cheap to call.
+func (ms *MemoryStorage) SizeInBytes() uint64 {
+	ms.Lock()
+	defer ms.Unlock()
+	return uint64(ms.entsBytes)
+}
+
 // SetHardState saves the current HardState.
 func (ms *MemoryStorage) SetHardState(st pb.HardState) error {
 	ms.Lock()
 	defer ms.Unlock()
+	if ms.closed {
+		return ErrUnavailable
+	}
 	ms.hardState = st
 	return nil
 }
 
 // Entries implements the Storage interface.
 func (ms *MemoryStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
+	ents, err := ms.entriesRange(lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	ents = limitSize(ents, entryEncodingSize(maxSize))
+	// NB: use the full slice expression to limit what the caller can do with the
+	// returned slice. For example, an append will reallocate and copy this slice
+	// instead of corrupting the neighbouring ms.ents.
+	return ents[:len(ents):len(ents)], nil
+}
+
+// entriesRange returns the entries in [lo, hi) without a size limit, with the
+// same errors as Entries.
+func (ms *MemoryStorage) entriesRange(lo, hi uint64) ([]pb.Entry, error) {
 	ms.Lock()
 	defer ms.Unlock()
 	ms.callStats.entries++
+	if ms.closed {
+		return nil, ErrUnavailable
+	}
 	offset := ms.ents[0].Index
 	if lo <= offset {
 		return nil, ErrCompacted
@@ -147,12 +274,30 @@ func (ms *MemoryStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
 	if len(ms.ents) == 1 {
 		return nil, ErrUnavailable
 	}
+	return ms.ents[lo-offset : hi-offset], nil
+}
 
-	ents := limitSize(ms.ents[lo-offset:hi-offset], entryEncodingSize(maxSize))
-	// NB: use the full slice expression to limit what the caller can do with the
-	// returned slice. For example, an append will reallocate and copy this slice
-	// instead of corrupting the neighbouring ms.ents.
-	return ents[:len(ents):len(ents)], nil
+// EntriesFunc implements the IterableStorage interface. Note that yield is
+// called without holding the MemoryStorage lock, so it may call into the
+// MemoryStorage.
+func (ms *MemoryStorage) EntriesFunc(lo, hi, maxSize uint64, yield func(pb.Entry) bool) error {
+	ents, err := ms.entriesRange(lo, hi)
+	if err != nil {
+		return err
+	}
+	// The entries are not modified in place by MemoryStorage, see Append, so it
+	// is safe to read them outside the lock.
+	var size entryEncodingSize
+	for i := range ents {
+		size += entryEncodingSize(ents[i].Size())
+		if i > 0 && size > entryEncodingSize(maxSize) {
+			return nil
+		}
+		if !yield(ents[i]) {
+			return nil
+		}
+	}
+	return nil
 }
 
 // Term implements the Storage interface.
@@ -160,6 +305,9 @@ func (ms *MemoryStorage) Term(i uint64) (uint64, error) {
 	ms.Lock()
 	defer ms.Unlock()
 	ms.callStats.term++
+	if ms.closed {
+		return 0, ErrUnavailable
+	}
 	offset := ms.ents[0].Index
 	if i < offset {
 		return 0, ErrCompacted
@@ -175,6 +323,9 @@ func (ms *MemoryStorage) LastIndex() (uint64, error) {
 	ms.Lock()
 	defer ms.Unlock()
 	ms.callStats.lastIndex++
+	if ms.closed {
+		return 0, ErrUnavailable
+	}
 	return ms.lastIndex(), nil
 }
 
@@ -182,11 +333,29 @@ func (ms *MemoryStorage) lastIndex() uint64 {
 	return ms.ents[0].Index + uint64(len(ms.ents)) - 1
 }
 
+// LastEntryID returns the index and term of the last entry in the storage,
+// under a single lock acquisition. The result is the same as that of LastIndex
+// followed by Term of the returned index. The last entry is never compacted:
+// if all entries are compacted, it is the entry at the snapshot index.
+func (ms *MemoryStorage) LastEntryID() (index, term uint64, err error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.callStats.lastIndex++
+	if ms.closed {
+		return 0, 0, ErrUnavailable
+	}
+	last := ms.ents[len(ms.ents)-1]
+	return last.Index, last.Term, nil
+}
+
 // FirstIndex implements the Storage interface.
 func (ms *MemoryStorage) FirstIndex() (uint64, error) {
 	ms.Lock()
 	defer ms.Unlock()
 	ms.callStats.firstIndex++
+	if ms.closed {
+		return 0, ErrUnavailable
+	}
 	return ms.firstIndex(), nil
 }
 
@@ -199,6 +368,9 @@ func (ms *MemoryStorage) Snapshot() (pb.Snapshot, error) {
 	ms.Lock()
 	defer ms.Unlock()
 	ms.callStats.snapshot++
+	if ms.closed {
+		return pb.Snapshot{}, ErrUnavailable
+	}
 	return ms.snapshot, nil
 }
 
@@ -207,6 +379,9 @@ func (ms *MemoryStorage) Snapshot() (pb.Snapshot, error) {
 func (ms *MemoryStorage) ApplySnapshot(snap pb.Snapshot) error {
 	ms.Lock()
 	defer ms.Unlock()
+	if ms.closed {
+		return ErrUnavailable
+	}
 
 	//handle check for old snapshot being applied
 	msIndex := ms.snapshot.Metadata.Index
@@ -217,6 +392,26 @@ func (ms *MemoryStorage) ApplySnapshot(snap pb.Snapshot) error {
 
 	ms.snapshot = snap
 	ms.ents = []pb.Entry{{Term: snap.Metadata.Term, Index: snap.Metadata.Index}}
+	ms.entsBytes = 0
+	return nil
+}
+
+// ApplySnapshotUnsafe is like ApplySnapshot, but installs the snapshot even if
+// its index is not newer than that of the current one, discarding all entries.
+//
+// It is intended only for recovery tooling, e.g. to idempotently restore a
+// known-good snapshot into a fresh MemoryStorage. It must not be used on a
+// Storage backing a live raft node: regressing the snapshot can make the
+// node lose committed entries.
+func (ms *MemoryStorage) ApplySnapshotUnsafe(snap pb.Snapshot) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.closed {
+		return ErrUnavailable
+	}
+	ms.snapshot = snap
+	ms.ents = []pb.Entry{{Term: snap.Metadata.Term, Index: snap.Metadata.Index}}
+	ms.entsBytes = 0
 	return nil
 }
 
@@ -227,6 +422,26 @@ func (ms *MemoryStorage) ApplySnapshot(snap pb.Snapshot) error {
 func (ms *MemoryStorage) CreateSnapshot(i uint64, cs *pb.ConfState, data []byte) (pb.Snapshot, error) {
 	ms.Lock()
 	defer ms.Unlock()
+	return ms.createSnapshot(i, cs, data)
+}
+
+// CreateSnapshotFromApplied is like CreateSnapshot, but always uses the
+// ConfState of the current snapshot. Use it only if no configuration changes
+// have been applied since the last snapshot. Unlike CreateSnapshot, it returns
+// ErrCompacted if the log has been compacted past i.
+func (ms *MemoryStorage) CreateSnapshotFromApplied(i uint64, data []byte) (pb.Snapshot, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if !ms.closed && i > ms.snapshot.Metadata.Index && i < ms.ents[0].Index {
+		return pb.Snapshot{}, ErrCompacted
+	}
+	return ms.createSnapshot(i, nil, data)
+}
+
+func (ms *MemoryStorage) createSnapshot(i uint64, cs *pb.ConfState, data []byte) (pb.Snapshot, error) {
+	if ms.closed {
+		return pb.Snapshot{}, ErrUnavailable
+	}
 	if i <= ms.snapshot.Metadata.Index {
 		return pb.Snapshot{}, ErrSnapOutOfDate
 	}
@@ -242,6 +457,7 @@ func (ms *MemoryStorage) CreateSnapshot(i uint64, cs *pb.ConfState, data []byte)
 		ms.snapshot.Metadata.ConfState = *cs
 	}
 	ms.snapshot.Data = data
+	ms.maybeAutoCompact()
 	return ms.snapshot, nil
 }
 
@@ -251,6 +467,9 @@ func (ms *MemoryStorage) CreateSnapshot(i uint64, cs *pb.ConfState, data []byte)
 func (ms *MemoryStorage) Compact(compactIndex uint64) error {
 	ms.Lock()
 	defer ms.Unlock()
+	if ms.closed {
+		return ErrUnavailable
+	}
 	offset := ms.ents[0].Index
 	if compactIndex <= offset {
 		return ErrCompacted
@@ -258,8 +477,14 @@ func (ms *MemoryStorage) Compact(compactIndex uint64) error {
 	if compactIndex > ms.lastIndex() {
 		getLogger().Panicf("compact %d is out of bound lastindex(%d)", compactIndex, ms.lastIndex())
 	}
+	ms.compact(compactIndex)
+	return nil
+}
 
-	i := compactIndex - offset
+// compact discards all log entries prior to compactIndex, which must be within
+// (offset, lastIndex].
+func (ms *MemoryStorage) compact(compactIndex uint64) {
+	i := compactIndex - ms.ents[0].Index
 	// NB: allocate a new slice instead of reusing the old ms.ents. Entries in
 	// ms.ents are immutable, and can be referenced from outside MemoryStorage
 	// through slices returned by ms.Entries().
@@ -267,8 +492,8 @@ func (ms *MemoryStorage) Compact(compactIndex uint64) error {
 	ents[0].Index = ms.ents[i].Index
 	ents[0].Term = ms.ents[i].Term
 	ents = append(ents, ms.ents[i+1:]...)
+	ms.entsBytes -= entsSize(ms.ents[1 : i+1])
 	ms.ents = ents
-	return nil
 }
 
 // Append the new entries to storage.
@@ -281,6 +506,9 @@ func (ms *MemoryStorage) Append(entries []pb.Entry) error {
 
 	ms.Lock()
 	defer ms.Unlock()
+	if ms.closed {
+		return ErrUnavailable
+	}
 
 	first := ms.firstIndex()
 	last := entries[0].Index + uint64(len(entries)) - 1
@@ -299,12 +527,119 @@ func (ms *MemoryStorage) Append(entries []pb.Entry) error {
 	case uint64(len(ms.ents)) > offset:
 		// NB: full slice expression protects ms.ents at index >= offset from
 		// rewrites, as they may still be referenced from outside MemoryStorage.
+		ms.entsBytes -= entsSize(ms.ents[offset:])
 		ms.ents = append(ms.ents[:offset:offset], entries...)
+		ms.entsBytes += entsSize(entries)
 	case uint64(len(ms.ents)) == offset:
 		ms.ents = append(ms.ents, entries...)
+		ms.entsBytes += entsSize(entries)
 	default:
 		getLogger().Panicf("missing log entry [last: %d, append at: %d]",
 			ms.lastIndex(), entries[0].Index)
 	}
+	ms.maybeAutoCompact()
 	return nil
 }
+
+// StorageStats holds the counters of a MeteredStorage.
+type StorageStats struct {
+	// InitialState, Entries, Term, LastIndex, FirstIndex and Snapshot are the
+	// numbers of calls to the respective Storage methods, including the ones
+	// which returned an error.
+	InitialState, Entries, Term, LastIndex, FirstIndex, Snapshot uint64
+	// EntriesReturned is the total number of entries returned by Entries.
+	EntriesReturned uint64
+	// EntryBytesReturned is the total encoded size of the entries counted in
+	// EntriesReturned, as used for the maxSize limit.
+	EntryBytesReturned uint64
+	// SnapshotBytesReturned is the total size of the snapshot data returned by
+	// Snapshot.
+	SnapshotBytesReturned uint64
+}
+
+// MeteredStorage is a Storage which passes all calls through to another
+// Storage, and counts them and the data they return. It can be used to
+// diagnose how much raft reads from the Storage. It is safe for concurrent
+// use.
+//
+// MeteredStorage implements only the Storage interface. The optional
+// interfaces of the wrapped Storage, like IterableStorage or io.Closer, are
+// available through Unwrap. Raft looks through a MeteredStorage for the ones
+// it uses, see Config.SnapshotOnLogBytes.
+type MeteredStorage struct {
+	storage Storage
+
+	mu    sync.Mutex
+	stats StorageStats
+}
+
+var _ Storage = (*MeteredStorage)(nil)
+
+// NewMeteredStorage returns a MeteredStorage wrapping the given Storage.
+func NewMeteredStorage(s Storage) *MeteredStorage {
+	return &MeteredStorage{storage: s}
+}
+
+// Unwrap returns the wrapped Storage.
+func (ms *MeteredStorage) Unwrap() Storage {
+	return ms.storage
+}
+
+// Stats returns the counters accumulated so far.
+func (ms *MeteredStorage) Stats() StorageStats {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.stats
+}
+
+// record updates the counters under the lock.
+func (ms *MeteredStorage) record(f func(*StorageStats)) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	f(&ms.stats)
+}
+
+// InitialState implements the Storage interface.
+func (ms *MeteredStorage) InitialState() (pb.HardState, pb.ConfState, error) {
+	ms.record(func(s *StorageStats) { s.InitialState++ })
+	return ms.storage.InitialState()
+}
+
+// Entries implements the Storage interface.
+func (ms *MeteredStorage) Entries(lo, hi, maxSize uint64) ([]pb.Entry, error) {
+	ents, err := ms.storage.Entries(lo, hi, maxSize)
+	ms.record(func(s *StorageStats) {
+		s.Entries++
+		s.EntriesReturned += uint64(len(ents))
+		s.EntryBytesReturned += uint64(entsSize(ents))
+	})
+	return ents, err
+}
+
+// Term implements the Storage interface.
+func (ms *MeteredStorage) Term(i uint64) (uint64, error) {
+	ms.record(func(s *StorageStats) { s.Term++ })
+	return ms.storage.Term(i)
+}
+
+// LastIndex implements the Storage interface.
+func (ms *MeteredStorage) LastIndex() (uint64, error) {
+	ms.record(func(s *StorageStats) { s.LastIndex++ })
+	return ms.storage.LastIndex()
+}
+
+// FirstIndex implements the Storage interface.
+func (ms *MeteredStorage) FirstIndex() (uint64, error) {
+	ms.record(func(s *StorageStats) { s.FirstIndex++ })
+	return ms.storage.FirstIndex()
+}
+
+// Snapshot implements the Storage interface.
+func (ms *MeteredStorage) Snapshot() (pb.Snapshot, error) {
+	snap, err := ms.storage.Snapshot()
+	ms.record(func(s *StorageStats) {
+		s.Snapshot++
+		s.SnapshotBytesReturned += uint64(len(snap.Data))
+	})
+	return snap, err
+}
@@ -15,6 +15,8 @@
 package raft
 
 import (
+	"fmt"
+	"io"
 	"math"
 	"testing"
 
@@ -89,6 +91,63 @@ func TestStorageEntries(t *testing.T) {
 	}
 }
 
+func TestStorageEntriesFunc(t *testing.T) {
+	ents := index(3).terms(3, 4, 5, 6, 7)
+	ents[2].Data = []byte("data")
+	size := func(ents ...pb.Entry) uint64 { return uint64(entsSize(ents)) }
+	var _ IterableStorage = (*MemoryStorage)(nil)
+
+	for _, tt := range []struct {
+		lo, hi, maxSize uint64
+	}{
+		{2, 6, math.MaxUint64},
+		{3, 4, math.MaxUint64},
+		{4, 4, math.MaxUint64},
+		{4, 5, math.MaxUint64},
+		{4, 8, math.MaxUint64},
+		{5, 8, math.MaxUint64},
+		{4, 8, 0},
+		{4, 8, size(ents[1:3]...)},
+		{4, 8, size(ents[1:3]...) + 1},
+		{4, 8, size(ents[1:4]...) - 1},
+		{4, 8, size(ents[1:]...)},
+	} {
+		t.Run(fmt.Sprintf("%d-%d/%d", tt.lo, tt.hi, tt.maxSize), func(t *testing.T) {
+			s := &MemoryStorage{ents: ents}
+			want, wantErr := s.Entries(tt.lo, tt.hi, tt.maxSize)
+			var got []pb.Entry
+			err := s.EntriesFunc(tt.lo, tt.hi, tt.maxSize, func(e pb.Entry) bool {
+				got = append(got, e)
+				return true
+			})
+			require.Equal(t, wantErr, err)
+			if len(want) == 0 {
+				require.Empty(t, got)
+			} else {
+				require.Equal(t, want, got)
+			}
+
+			// Iteration stops when yield returns false.
+			if len(want) > 1 {
+				got = nil
+				require.NoError(t, s.EntriesFunc(tt.lo, tt.hi, tt.maxSize, func(e pb.Entry) bool {
+					got = append(got, e)
+					return len(got) < 2
+				}))
+				require.Equal(t, want[:2], got)
+			}
+		})
+	}
+
+	// Errors match Entries for an empty storage as well.
+	s := NewMemoryStorage()
+	_, wantErr := s.Entries(1, 1, math.MaxUint64)
+	require.Equal(t, wantErr, s.EntriesFunc(1, 1, math.MaxUint64, func(pb.Entry) bool {
+		t.Fatal("unexpected call")
+		return false
+	}))
+}
+
 func TestStorageLastIndex(t *testing.T) {
 	ents := index(3).terms(3, 4, 5)
 	s := &MemoryStorage{ents: ents}
@@ -245,3 +304,333 @@ func TestStorageApplySnapshot(t *testing.T) {
 	tt = tests[i]
 	require.Equal(t, ErrSnapOutOfDate, s.ApplySnapshot(tt))
 }
+
+func TestStorageSetMaxEntries(t *testing.T) {
+	s := NewMemoryStorage()
+	s.SetMaxEntries(10)
+	for i := uint64(1); i <= 100; i++ {
+		require.NoError(t, s.Append([]pb.Entry{{Index: i, Term: i/10 + 1}}))
+		// Imitate an application which snapshots its state with a lag.
+		if i%5 == 0 && i > 5 {
+			_, err := s.CreateSnapshot(i-5, nil, nil)
+			require.NoError(t, err)
+		}
+		require.LessOrEqual(t, len(s.ents), 11, "index %d", i)
+	}
+	snap, err := s.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, uint64(95), snap.Metadata.Index)
+	require.Equal(t, uint64(90), s.ents[0].Index)
+	require.Equal(t, uint64(10), s.ents[0].Term)
+
+	first, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(91), first)
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), last)
+
+	_, err = s.Term(89)
+	require.Equal(t, ErrCompacted, err)
+	term, err := s.Term(95)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), term)
+	_, err = s.Entries(90, 101, noLimit)
+	require.Equal(t, ErrCompacted, err)
+	ents, err := s.Entries(91, 101, noLimit)
+	require.NoError(t, err)
+	require.Len(t, ents, 10)
+	require.Equal(t, uint64(91), ents[0].Index)
+
+	// The log is never compacted beyond the snapshot index.
+	_, err = s.CreateSnapshot(92, nil, nil)
+	require.Equal(t, ErrSnapOutOfDate, err)
+	s.SetMaxEntries(1)
+	require.Equal(t, uint64(95), s.ents[0].Index)
+	require.Equal(t, uint64(10), s.ents[0].Term)
+
+	// Without snapshots, the log is not compacted.
+	s = NewMemoryStorage()
+	s.SetMaxEntries(10)
+	for i := uint64(1); i <= 20; i++ {
+		require.NoError(t, s.Append([]pb.Entry{{Index: i, Term: 1}}))
+	}
+	require.Len(t, s.ents, 21)
+}
+
+func TestStorageClose(t *testing.T) {
+	s := NewMemoryStorage()
+	require.NoError(t, s.Append(index(1).terms(1, 1, 2)))
+	var _ io.Closer = s
+	require.NoError(t, s.Close())
+	require.Nil(t, s.ents)
+
+	_, err := s.Entries(1, 3, noLimit)
+	require.Equal(t, ErrUnavailable, err)
+	_, err = s.Term(1)
+	require.Equal(t, ErrUnavailable, err)
+	_, err = s.FirstIndex()
+	require.Equal(t, ErrUnavailable, err)
+	_, err = s.LastIndex()
+	require.Equal(t, ErrUnavailable, err)
+	_, err = s.Snapshot()
+	require.Equal(t, ErrUnavailable, err)
+	_, _, err = s.InitialState()
+	require.Equal(t, ErrUnavailable, err)
+
+	require.Equal(t, ErrUnavailable, s.Append(index(4).terms(2)))
+	require.Equal(t, ErrUnavailable, s.Compact(2))
+	_, err = s.CreateSnapshot(2, nil, nil)
+	require.Equal(t, ErrUnavailable, err)
+	require.Equal(t, ErrUnavailable, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 5, Term: 2}}))
+	require.Equal(t, ErrUnavailable, s.SetHardState(pb.HardState{Term: 2}))
+}
+
+func TestStorageApplySnapshotUnsafe(t *testing.T) {
+	cs := pb.ConfState{Voters: []uint64{1, 2, 3}}
+	snap := pb.Snapshot{Data: []byte("data"), Metadata: pb.SnapshotMetadata{Index: 4, Term: 4, ConfState: cs}}
+
+	s := NewMemoryStorage()
+	require.NoError(t, s.ApplySnapshotUnsafe(snap))
+	require.NoError(t, s.Append(index(5).terms(4, 5)))
+	// Replaying the same snapshot succeeds, and discards the entries.
+	require.Equal(t, ErrSnapOutOfDate, s.ApplySnapshot(snap))
+	require.NoError(t, s.ApplySnapshotUnsafe(snap))
+	got, err := s.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, snap, got)
+	require.Equal(t, []pb.Entry{{Index: 4, Term: 4}}, s.ents)
+
+	// An older snapshot is installed as well.
+	older := pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 2, Term: 1, ConfState: cs}}
+	require.NoError(t, s.ApplySnapshotUnsafe(older))
+	first, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), first)
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), last)
+}
+
+func TestStorageCreateSnapshotFromApplied(t *testing.T) {
+	cs := pb.ConfState{Voters: []uint64{1, 2, 3}}
+	s := NewMemoryStorage()
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 3, Term: 3, ConfState: cs}}))
+	require.NoError(t, s.Append(index(4).terms(4, 5, 5, 6)))
+
+	for _, tt := range []struct {
+		i       uint64
+		wterm   uint64
+		wdata   string
+		wantErr error
+	}{
+		{i: 2, wantErr: ErrSnapOutOfDate},
+		{i: 3, wantErr: ErrSnapOutOfDate},
+		{i: 5, wterm: 5, wdata: "5"},
+		{i: 5, wantErr: ErrSnapOutOfDate},
+		{i: 7, wterm: 6, wdata: "7"},
+	} {
+		snap, err := s.CreateSnapshotFromApplied(tt.i, []byte(tt.wdata))
+		require.Equal(t, tt.wantErr, err, "index %d", tt.i)
+		if err == nil {
+			want := pb.Snapshot{Data: []byte(tt.wdata), Metadata: pb.SnapshotMetadata{Index: tt.i, Term: tt.wterm, ConfState: cs}}
+			require.Equal(t, want, snap)
+			got, err := s.Snapshot()
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		}
+	}
+
+	// The log was compacted past the index, but not the snapshot.
+	s = NewMemoryStorage()
+	require.NoError(t, s.Append(index(1).terms(1, 2, 3, 4)))
+	require.NoError(t, s.Compact(3))
+	_, err := s.CreateSnapshotFromApplied(2, nil)
+	require.Equal(t, ErrCompacted, err)
+	snap, err := s.CreateSnapshotFromApplied(3, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), snap.Metadata.Term)
+}
+
+func TestStorageSizeInBytes(t *testing.T) {
+	s := NewMemoryStorage()
+	require.Zero(t, s.SizeInBytes())
+	ents := index(1).terms(1, 2, 3)
+	ents[1].Data = []byte("data")
+	require.NoError(t, s.Append(ents))
+	require.Equal(t, uint64(entsSize(ents)), s.SizeInBytes())
+	require.NoError(t, s.Compact(2))
+	require.Equal(t, uint64(entsSize(ents[2:])), s.SizeInBytes())
+	// Overwriting the tail replaces the size of the overwritten entries.
+	tail := index(3).terms(4, 4)
+	tail[1].Data = []byte("more data")
+	require.NoError(t, s.Append(tail))
+	require.Equal(t, uint64(entsSize(tail)), s.SizeInBytes())
+	require.Equal(t, s.SizeInBytes(), s.Clone().SizeInBytes())
+	// The size is consistent with the entries after automatic compaction.
+	s.SetMaxEntries(1)
+	require.Equal(t, uint64(entsSize(tail)), s.SizeInBytes())
+	_, err := s.CreateSnapshot(4, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(entsSize(tail[1:])), s.SizeInBytes())
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 10, Term: 5}}))
+	require.Zero(t, s.SizeInBytes())
+	require.NoError(t, s.Append(index(11).terms(5)))
+	require.NoError(t, s.Close())
+	require.Zero(t, s.SizeInBytes())
+}
+
+func TestStorageClone(t *testing.T) {
+	cs := pb.ConfState{Voters: []uint64{1, 2, 3}}
+	s := NewMemoryStorage()
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Data: []byte("snap"), Metadata: pb.SnapshotMetadata{
+		Index: 3, Term: 3, ConfState: cs,
+	}}))
+	ents := index(4).terms(3, 4)
+	ents[0].Data = []byte("a")
+	require.NoError(t, s.Append(ents))
+	require.NoError(t, s.SetHardState(pb.HardState{Term: 4, Vote: 1, Commit: 4}))
+
+	c := s.Clone()
+	require.Equal(t, s.ents, c.ents)
+	require.Equal(t, s.hardState, c.hardState)
+	require.Equal(t, s.snapshot, c.snapshot)
+
+	// Mutating the clone does not affect the original.
+	require.NoError(t, c.Append(index(5).terms(5, 5)))
+	require.NoError(t, c.SetHardState(pb.HardState{Term: 5, Commit: 6}))
+	_, err := c.CreateSnapshot(5, &pb.ConfState{Voters: []uint64{1}}, nil)
+	require.NoError(t, err)
+	c.ents[1].Data[0] = 'b'
+	c.snapshot.Metadata.ConfState.Voters[0] = 7
+	require.Equal(t, ents, s.ents[1:])
+	require.Equal(t, "a", string(s.ents[1].Data))
+	require.Equal(t, pb.HardState{Term: 4, Vote: 1, Commit: 4}, s.hardState)
+	require.Equal(t, pb.SnapshotMetadata{Index: 3, Term: 3, ConfState: cs}, s.snapshot.Metadata)
+
+	// And vice versa.
+	c = s.Clone()
+	require.NoError(t, s.Compact(4))
+	s.snapshot.Data[0] = 'x'
+	require.Equal(t, uint64(4), s.ents[0].Index)
+	require.Equal(t, uint64(3), c.ents[0].Index)
+	require.Equal(t, "snap", string(c.snapshot.Data))
+}
+
+func TestMeteredStorage(t *testing.T) {
+	s := NewMemoryStorage()
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Data: []byte("snap"), Metadata: pb.SnapshotMetadata{Index: 3, Term: 3}}))
+	ents := index(4).terms(3, 4, 5)
+	ents[1].Data = []byte("data")
+	require.NoError(t, s.Append(ents))
+	ms := NewMeteredStorage(s)
+	require.Equal(t, StorageStats{}, ms.Stats())
+
+	_, _, err := ms.InitialState()
+	require.NoError(t, err)
+	first, err := ms.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), first)
+	last, err := ms.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), last)
+	term, err := ms.Term(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), term)
+	_, err = ms.Term(2)
+	require.Equal(t, ErrCompacted, err)
+	got, err := ms.Entries(4, 7, noLimit)
+	require.NoError(t, err)
+	require.Equal(t, ents, got)
+	_, err = ms.Entries(5, 6, noLimit)
+	require.NoError(t, err)
+	_, err = ms.Entries(2, 5, noLimit)
+	require.Equal(t, ErrCompacted, err)
+	snap, err := ms.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, "snap", string(snap.Data))
+
+	require.Equal(t, StorageStats{
+		InitialState:          1,
+		Entries:               3,
+		Term:                  2,
+		LastIndex:             1,
+		FirstIndex:            1,
+		Snapshot:              1,
+		EntriesReturned:       4,
+		EntryBytesReturned:    uint64(entsSize(ents) + entsSize(ents[1:2])),
+		SnapshotBytesReturned: 4,
+	}, ms.Stats())
+}
+
+// TestMeteredStorageUnwrap ensures that the optional interfaces of the Storage
+// wrapped by a MeteredStorage are available through Unwrap, and that raft
+// finds a SizeInBytes method through it.
+func TestMeteredStorageUnwrap(t *testing.T) {
+	s := newTestMemoryStorage(withPeers(1))
+	ents := index(1).terms(1, 1, 1)
+	require.NoError(t, s.Append(ents))
+	ms := NewMeteredStorage(s)
+	require.Same(t, s, ms.Unwrap())
+
+	sizer, ok := storageLogSizer(ms)
+	require.True(t, ok)
+	require.Equal(t, s.SizeInBytes(), sizer.SizeInBytes())
+	_, ok = ms.Unwrap().(IterableStorage)
+	require.True(t, ok)
+	_, ok = ms.Unwrap().(io.Closer)
+	require.True(t, ok)
+	index, term, err := ms.Unwrap().(*MemoryStorage).LastEntryID()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), index)
+	require.Equal(t, uint64(1), term)
+
+	// Config.SnapshotOnLogBytes accepts the MeteredStorage.
+	cfg := newTestConfig(1, 10, 1, ms)
+	cfg.SnapshotOnLogBytes = 100
+	require.NoError(t, cfg.validate())
+
+	// A Storage without a SizeInBytes method is not accepted, wrapped or not.
+	plain := NewMeteredStorage(struct{ Storage }{s})
+	_, ok = storageLogSizer(plain)
+	require.False(t, ok)
+	cfg = newTestConfig(1, 10, 1, plain)
+	cfg.SnapshotOnLogBytes = 100
+	require.Error(t, cfg.validate())
+}
+
+func TestStorageLastEntryID(t *testing.T) {
+	s := NewMemoryStorage()
+	check := func() {
+		t.Helper()
+		last, err := s.LastIndex()
+		require.NoError(t, err)
+		term, err := s.Term(last)
+		require.NoError(t, err)
+		gotIndex, gotTerm, err := s.LastEntryID()
+		require.NoError(t, err)
+		require.Equal(t, last, gotIndex)
+		require.Equal(t, term, gotTerm)
+	}
+	check()
+
+	require.NoError(t, s.Append(index(1).terms(1, 2, 2, 3)))
+	check()
+	require.NoError(t, s.Append(index(3).terms(4)))
+	check()
+	require.NoError(t, s.Compact(2))
+	check()
+	// All entries are compacted.
+	require.NoError(t, s.Compact(3))
+	check()
+	require.NoError(t, s.ApplySnapshot(pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 10, Term: 5}}))
+	check()
+	last, term, err := s.LastEntryID()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), last)
+	require.Equal(t, uint64(5), term)
+
+	require.NoError(t, s.Close())
+	_, _, err = s.LastEntryID()
+	require.Equal(t, ErrUnavailable, err)
+}
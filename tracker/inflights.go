@@ -135,6 +135,23 @@ func (in *Inflights) Full() bool {
 // Count returns the number of inflight messages.
 func (in *Inflights) Count() int { return in.count }
 
+// Bytes returns the total byte size of the inflight messages.
+func (in *Inflights) Bytes() uint64 { return in.bytes }
+
+// Cap returns the max number of inflight messages.
+func (in *Inflights) Cap() int { return in.size }
+
+// Utilization returns the fraction of the window in use, in [0, 1]. It is the
+// higher of the fractions of used message slots and used bytes, the latter
+// only if the byte size is limited.
+func (in *Inflights) Utilization() float64 {
+	u := float64(in.count) / float64(in.size)
+	if in.maxBytes != 0 {
+		u = max(u, float64(in.bytes)/float64(in.maxBytes))
+	}
+	return min(u, 1)
+}
+
 // reset frees all inflights.
 func (in *Inflights) reset() {
 	in.start = 0
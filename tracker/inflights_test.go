@@ -239,9 +239,31 @@ func TestInflightsReset(t *testing.T) {
 		in.FreeLE(index - 2)
 		require.False(t, in.Full())
 		require.Equal(t, 2, in.Count())
+		require.Equal(t, uint64(32), in.Bytes())
 	}
 	in.FreeLE(index)
 	require.Equal(t, 0, in.Count())
+	require.Zero(t, in.Bytes())
+	require.Equal(t, 10, in.Cap())
+}
+
+func TestInflightsUtilization(t *testing.T) {
+	in := NewInflights(4, 100)
+	require.Zero(t, in.Utilization())
+	in.Add(1, 10)
+	require.Equal(t, 0.25, in.Utilization())
+	in.Add(2, 40)
+	require.Equal(t, 0.5, in.Utilization())
+	// The byte limit is soft, but the utilization is capped.
+	in.Add(3, 80)
+	require.Equal(t, 1.0, in.Utilization())
+	in.FreeLE(2)
+	require.Equal(t, 0.8, in.Utilization())
+
+	// Without a byte limit, only the message count matters.
+	in = NewInflights(4, 0)
+	in.Add(1, 1000)
+	require.Equal(t, 0.25, in.Utilization())
 }
 
 func inflightsBuffer(indices []uint64, sizes []uint64) []inflight {
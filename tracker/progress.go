@@ -113,8 +113,20 @@ type Progress struct {
 	// received entry.
 	Inflights *Inflights
 
+	// SendBudget is the number of entry bytes that the leader may still send
+	// to the follower if the rate of appends is limited, see
+	// raft.Config.MaxBytesPerSecondPerPeer. Entries are only sent while it is
+	// positive, and it can become negative if a message exceeds it.
+	SendBudget int64
+
 	// IsLearner is true if this progress is tracked for a learner.
 	IsLearner bool
+
+	// ProbeRounds is the number of MsgApp rejections received from the
+	// follower since its log last matched the leader's, i.e. the number of
+	// rounds taken so far to find the point where the logs diverge. It is reset
+	// when an MsgApp is accepted.
+	ProbeRounds int
 }
 
 // ResetState moves the Progress into the specified State, resetting MsgAppFlowPaused,
@@ -147,6 +159,7 @@ func (pr *Progress) BecomeProbe() {
 func (pr *Progress) BecomeReplicate() {
 	pr.ResetState(StateReplicate)
 	pr.Next = pr.Match + 1
+	pr.ProbeRounds = 0
 }
 
 // BecomeSnapshot moves the Progress to StateSnapshot with the specified pending
@@ -210,6 +223,7 @@ func (pr *Progress) MaybeUpdate(n uint64) bool {
 	pr.Match = n
 	pr.Next = max(pr.Next, n+1) // invariant: Match < Next
 	pr.MsgAppFlowPaused = false
+	pr.ProbeRounds = 0
 	return true
 }
 
@@ -237,6 +251,7 @@ func (pr *Progress) MaybeDecrTo(rejected, matchHint uint64) bool {
 		pr.Next = pr.Match + 1
 		// Regress the sentCommit since it unlikely has been applied.
 		pr.sentCommit = min(pr.sentCommit, pr.Next-1)
+		pr.ProbeRounds++
 		return true
 	}
 
@@ -251,6 +266,7 @@ func (pr *Progress) MaybeDecrTo(rejected, matchHint uint64) bool {
 	// Regress the sentCommit since it unlikely has been applied.
 	pr.sentCommit = min(pr.sentCommit, pr.Next-1)
 	pr.MsgAppFlowPaused = false
+	pr.ProbeRounds++
 	return true
 }
 
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestProgressString(t *testing.T) {
@@ -207,5 +208,32 @@ func TestProgressMaybeDecr(t *testing.T) {
 		assert.Equal(t, tt.w, p.MaybeDecrTo(tt.rejected, tt.last), i)
 		assert.Equal(t, tt.m, p.Match, i)
 		assert.Equal(t, tt.wn, p.Next, i)
+		if tt.w {
+			assert.Equal(t, 1, p.ProbeRounds, i)
+		} else {
+			assert.Zero(t, p.ProbeRounds, i)
+		}
+	}
+}
+
+func TestProgressProbeRounds(t *testing.T) {
+	p := &Progress{State: StateProbe, Match: 1, Next: 10, Inflights: NewInflights(10, 0)}
+	for next := uint64(9); next >= 7; next-- {
+		require.True(t, p.MaybeDecrTo(next, next-1))
+		require.Equal(t, int(10-next), p.ProbeRounds)
 	}
+	// A stale rejection is not counted.
+	require.False(t, p.MaybeDecrTo(9, 8))
+	require.Equal(t, 3, p.ProbeRounds)
+	// An acceptance resets the counter.
+	require.True(t, p.MaybeUpdate(6))
+	require.Zero(t, p.ProbeRounds)
+
+	p.BecomeReplicate()
+	require.True(t, p.MaybeDecrTo(8, 6))
+	require.Equal(t, 1, p.ProbeRounds)
+	p.BecomeProbe()
+	require.Equal(t, 1, p.ProbeRounds)
+	p.BecomeReplicate()
+	require.Zero(t, p.ProbeRounds)
 }
@@ -17,6 +17,7 @@ package tracker
 import (
 	"fmt"
 	"strings"
+	"unsafe"
 
 	"go.etcd.io/raft/v3/quorum"
 	"go.etcd.io/raft/v3/quorum/slices"
@@ -180,6 +181,38 @@ func (p *ProgressTracker) Committed() uint64 {
 	return uint64(p.Voters.CommittedIndex(matchAckIndexer(p.Progress)))
 }
 
+// CommittedWithout is like Committed, but computed as if the given voter was
+// removed from both halves of the configuration. As for Committed, the result
+// is math.MaxUint64 if no voters remain.
+func (p *ProgressTracker) CommittedWithout(id uint64) uint64 {
+	var voters quorum.JointConfig
+	for i := range p.Voters {
+		if len(p.Voters[i]) == 0 {
+			continue
+		}
+		voters[i] = quorum.MajorityConfig{}
+		for vid := range p.Voters[i] {
+			if vid != id {
+				voters[i][vid] = struct{}{}
+			}
+		}
+	}
+	return uint64(voters.CommittedIndex(matchAckIndexer(p.Progress)))
+}
+
+// MemoryFootprint returns an estimate of the number of bytes used by the
+// tracked progresses, including their Inflights.
+func (p *ProgressTracker) MemoryFootprint() uint64 {
+	var n uintptr
+	for _, pr := range p.Progress {
+		n += unsafe.Sizeof(*pr)
+		if in := pr.Inflights; in != nil {
+			n += unsafe.Sizeof(*in) + uintptr(cap(in.buffer))*unsafe.Sizeof(inflight{})
+		}
+	}
+	return uint64(n)
+}
+
 // Visit invokes the supplied closure for all tracked progresses in stable order.
 func (p *ProgressTracker) Visit(f func(id uint64, pr *Progress)) {
 	n := len(p.Progress)
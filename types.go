@@ -88,6 +88,16 @@ func (s logSlice) lastEntryID() entryID {
 	return s.prev
 }
 
+// forward returns the suffix of this log slice starting after the given index,
+// which must be in [prev.index, lastIndex()].
+func (s logSlice) forward(index uint64) logSlice {
+	if index == s.prev.index {
+		return s
+	}
+	k := index - s.prev.index
+	return logSlice{term: s.term, prev: pbEntryID(&s.entries[k-1]), entries: s.entries[k:]}
+}
+
 // valid returns nil iff the logSlice is a well-formed log slice. See logSlice
 // comment for details on what constitutes a valid raft log slice.
 func (s logSlice) valid() error {
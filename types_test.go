@@ -92,3 +92,16 @@ func TestLogSlice(t *testing.T) {
 		})
 	}
 }
+
+func TestLogSliceForward(t *testing.T) {
+	s := logSlice{term: 10, prev: entryID{term: 2, index: 12}, entries: index(13).terms(2, 3, 3)}
+	require.Equal(t, s, s.forward(12))
+	for _, idx := range []uint64{13, 14, 15} {
+		fwd := s.forward(idx)
+		require.NoError(t, fwd.valid())
+		require.Equal(t, idx, fwd.prev.index)
+		require.Equal(t, s.lastEntryID(), fwd.lastEntryID())
+	}
+	require.Equal(t, entryID{term: 3, index: 14}, s.forward(14).prev)
+	require.Empty(t, s.forward(15).entries)
+}
@@ -16,9 +16,16 @@ package raft
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"unsafe"
 
+	"github.com/gogo/protobuf/proto"
+
+	"go.etcd.io/raft/v3/quorum/slices"
 	pb "go.etcd.io/raft/v3/raftpb"
 )
 
@@ -49,6 +56,16 @@ var isResponseMsg = [...]bool{
 	pb.MsgStorageApplyResp:  true,
 }
 
+var isVoteMsg = [...]bool{
+	pb.MsgVote:    true,
+	pb.MsgPreVote: true,
+}
+
+var isVoteRespMsg = [...]bool{
+	pb.MsgVoteResp:    true,
+	pb.MsgPreVoteResp: true,
+}
+
 func isMsgInArray(msgt pb.MessageType, arr []bool) bool {
 	i := int(msgt)
 	return i < len(arr) && arr[i]
@@ -62,6 +79,17 @@ func IsResponseMsg(msgt pb.MessageType) bool {
 	return isMsgInArray(msgt, isResponseMsg[:])
 }
 
+// IsVoteMsg returns true for the vote requests MsgVote and MsgPreVote.
+func IsVoteMsg(msgt pb.MessageType) bool {
+	return isMsgInArray(msgt, isVoteMsg[:])
+}
+
+// IsVoteRespMsg returns true for the vote responses MsgVoteResp and
+// MsgPreVoteResp.
+func IsVoteRespMsg(msgt pb.MessageType) bool {
+	return isMsgInArray(msgt, isVoteRespMsg[:])
+}
+
 func IsLocalMsgTarget(id uint64) bool {
 	return id == LocalAppendThread || id == LocalApplyThread
 }
@@ -99,39 +127,119 @@ func DescribeConfState(state pb.ConfState) string {
 	)
 }
 
+// DiffConfState returns the voters and learners added and removed between two
+// ConfStates. In a joint configuration, the voters are the union of Voters and
+// VotersOutgoing, and the learners are the union of Learners and LearnersNext.
+// The returned slices are sorted and contain no duplicates.
+func DiffConfState(from, to pb.ConfState) (addedVoters, removedVoters, addedLearners, removedLearners []uint64) {
+	voters := func(cs pb.ConfState) []uint64 {
+		return slices.DedupUint64(append(append([]uint64(nil), cs.Voters...), cs.VotersOutgoing...))
+	}
+	learners := func(cs pb.ConfState) []uint64 {
+		return slices.DedupUint64(append(append([]uint64(nil), cs.Learners...), cs.LearnersNext...))
+	}
+	addedVoters, removedVoters = diffSorted(voters(from), voters(to))
+	addedLearners, removedLearners = diffSorted(learners(from), learners(to))
+	return addedVoters, removedVoters, addedLearners, removedLearners
+}
+
+// diffSorted returns the elements only in b, and the elements only in a, given
+// two sorted slices without duplicates.
+func diffSorted(a, b []uint64) (added, removed []uint64) {
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0] < b[0]:
+			removed, a = append(removed, a[0]), a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			added, b = append(added, b[0]), b[1:]
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+	return added, removed
+}
+
 func DescribeSnapshot(snap pb.Snapshot) string {
 	m := snap.Metadata
 	return fmt.Sprintf("Index:%d Term:%d ConfState:%s", m.Index, m.Term, DescribeConfState(m.ConfState))
 }
 
+// DescribeSnapshotVerbose is like DescribeSnapshot, but for snapshots with
+// data also appends the data size and the first 8 hex digits of its SHA-256,
+// which helps spotting peers that disagree on snapshot contents at an index.
+func DescribeSnapshotVerbose(snap pb.Snapshot) string {
+	s := DescribeSnapshot(snap)
+	if len(snap.Data) == 0 {
+		return s
+	}
+	sum := sha256.Sum256(snap.Data)
+	return fmt.Sprintf("%s Data:%dB Digest:%s", s, len(snap.Data), hex.EncodeToString(sum[:4]))
+}
+
 func DescribeReady(rd Ready, f EntryFormatter) string {
+	return DescribeReadyWithFormatterV2(rd, f.v2())
+}
+
+// DescribeReadyWithFormatterV2 is like DescribeReady, but uses an
+// EntryFormatterV2.
+func DescribeReadyWithFormatterV2(rd Ready, f EntryFormatterV2) string {
+	return describeReadySections(rd, f, ReadyAllSections)
+}
+
+// ReadySection is a bitmask of the sections of a Ready, used to select the
+// sections rendered by DescribeReadySections.
+type ReadySection uint8
+
+// The sections of a Ready.
+const (
+	ReadySoftState ReadySection = 1 << iota
+	ReadyHardState
+	ReadyEntries
+	ReadyCommittedEntries
+	ReadyMessages
+	ReadySnapshot
+	ReadyReadStates
+
+	// ReadyAllSections selects all sections of a Ready.
+	ReadyAllSections = ReadySoftState | ReadyHardState | ReadyEntries |
+		ReadyCommittedEntries | ReadyMessages | ReadySnapshot | ReadyReadStates
+)
+
+// DescribeReadySections is like DescribeReady, but only renders the given
+// sections of the Ready. A Ready with none of the given sections is described
+// as "<empty Ready>".
+func DescribeReadySections(rd Ready, f EntryFormatter, sections ReadySection) string {
+	return describeReadySections(rd, f.v2(), sections)
+}
+
+func describeReadySections(rd Ready, f EntryFormatterV2, sections ReadySection) string {
 	var buf strings.Builder
-	if rd.SoftState != nil {
+	if sections&ReadySoftState != 0 && rd.SoftState != nil {
 		fmt.Fprint(&buf, DescribeSoftState(*rd.SoftState))
 		buf.WriteByte('\n')
 	}
-	if !IsEmptyHardState(rd.HardState) {
+	if sections&ReadyHardState != 0 && !IsEmptyHardState(rd.HardState) {
 		fmt.Fprintf(&buf, "HardState %s", DescribeHardState(rd.HardState))
 		buf.WriteByte('\n')
 	}
-	if len(rd.ReadStates) > 0 {
+	if sections&ReadyReadStates != 0 && len(rd.ReadStates) > 0 {
 		fmt.Fprintf(&buf, "ReadStates %v\n", rd.ReadStates)
 	}
-	if len(rd.Entries) > 0 {
+	if sections&ReadyEntries != 0 && len(rd.Entries) > 0 {
 		buf.WriteString("Entries:\n")
-		fmt.Fprint(&buf, DescribeEntries(rd.Entries, f))
+		fmt.Fprint(&buf, DescribeEntriesWithFormatterV2(rd.Entries, f))
 	}
-	if !IsEmptySnap(rd.Snapshot) {
+	if sections&ReadySnapshot != 0 && !IsEmptySnap(rd.Snapshot) {
 		fmt.Fprintf(&buf, "Snapshot %s\n", DescribeSnapshot(rd.Snapshot))
 	}
-	if len(rd.CommittedEntries) > 0 {
+	if sections&ReadyCommittedEntries != 0 && len(rd.CommittedEntries) > 0 {
 		buf.WriteString("CommittedEntries:\n")
-		fmt.Fprint(&buf, DescribeEntries(rd.CommittedEntries, f))
+		fmt.Fprint(&buf, DescribeEntriesWithFormatterV2(rd.CommittedEntries, f))
 	}
-	if len(rd.Messages) > 0 {
+	if sections&ReadyMessages != 0 && len(rd.Messages) > 0 {
 		buf.WriteString("Messages:\n")
 		for _, msg := range rd.Messages {
-			fmt.Fprint(&buf, DescribeMessage(msg, f))
+			fmt.Fprint(&buf, DescribeMessageWithFormatterV2(msg, f))
 			buf.WriteByte('\n')
 		}
 	}
@@ -141,17 +249,252 @@ func DescribeReady(rd Ready, f EntryFormatter) string {
 	return "<empty Ready>"
 }
 
+// ReadySummary returns a single-line summary of the given Ready, such as
+//
+//	entries=3 committed=2 msgs=5(app=3,vote=2) snap=false hs=true
+//
+// Messages are counted by category: app (MsgApp, MsgAppResp), vote (MsgVote,
+// MsgPreVote and their responses), heartbeat (MsgHeartbeat, MsgHeartbeatResp),
+// snap (MsgSnap) and other; categories without messages are omitted. Returns
+// "<empty Ready>" for an empty Ready.
+func ReadySummary(rd Ready) string {
+	if rd.SoftState == nil && IsEmptyHardState(rd.HardState) && len(rd.ReadStates) == 0 &&
+		len(rd.Entries) == 0 && IsEmptySnap(rd.Snapshot) && len(rd.CommittedEntries) == 0 &&
+		len(rd.Messages) == 0 {
+		return "<empty Ready>"
+	}
+	var app, vote, heartbeat, snap, other int
+	for i := range rd.Messages {
+		switch typ := rd.Messages[i].Type; {
+		case typ == pb.MsgApp || typ == pb.MsgAppResp:
+			app++
+		case IsVoteMsg(typ) || IsVoteRespMsg(typ):
+			vote++
+		case typ == pb.MsgHeartbeat || typ == pb.MsgHeartbeatResp:
+			heartbeat++
+		case typ == pb.MsgSnap:
+			snap++
+		default:
+			other++
+		}
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "entries=%d committed=%d msgs=%d", len(rd.Entries), len(rd.CommittedEntries), len(rd.Messages))
+	sep := byte('(')
+	for _, c := range []struct {
+		name string
+		n    int
+	}{{"app", app}, {"vote", vote}, {"heartbeat", heartbeat}, {"snap", snap}, {"other", other}} {
+		if c.n > 0 {
+			buf.WriteByte(sep)
+			fmt.Fprintf(&buf, "%s=%d", c.name, c.n)
+			sep = ','
+		}
+	}
+	if sep == ',' {
+		buf.WriteByte(')')
+	}
+	fmt.Fprintf(&buf, " snap=%t hs=%t", !IsEmptySnap(rd.Snapshot), !IsEmptyHardState(rd.HardState))
+	return buf.String()
+}
+
+// ReadyToJSON returns a JSON encoding of the given Ready, suitable for
+// structured logging. Empty parts of the Ready are omitted. Entry data is
+// base64-encoded, and the changes carried by conf change entries are
+// additionally included in human-readable form.
+func ReadyToJSON(rd Ready) ([]byte, error) {
+	j := jsonReady{
+		Entries:          jsonEntries(rd.Entries),
+		CommittedEntries: jsonEntries(rd.CommittedEntries),
+		MustSync:         rd.MustSync,
+	}
+	if rd.SoftState != nil {
+		j.SoftState = &jsonSoftState{Lead: rd.Lead, RaftState: rd.RaftState}
+	}
+	if !IsEmptyHardState(rd.HardState) {
+		j.HardState = &jsonHardState{Term: rd.Term, Vote: rd.Vote, Commit: rd.Commit}
+	}
+	if !IsEmptySnap(rd.Snapshot) {
+		j.Snapshot = newJSONSnapshotMetadata(rd.Snapshot.Metadata)
+	}
+	for _, rs := range rd.ReadStates {
+		j.ReadStates = append(j.ReadStates, jsonReadState{Index: rs.Index, RequestCtx: rs.RequestCtx})
+	}
+	for _, m := range rd.Messages {
+		j.Messages = append(j.Messages, newJSONMessage(m))
+	}
+	return json.Marshal(j)
+}
+
+// MarshalJSON implements json.Marshaler. See ReadyToJSON.
+func (rd Ready) MarshalJSON() ([]byte, error) {
+	return ReadyToJSON(rd)
+}
+
+type jsonReady struct {
+	SoftState        *jsonSoftState        `json:"softState,omitempty"`
+	HardState        *jsonHardState        `json:"hardState,omitempty"`
+	ReadStates       []jsonReadState       `json:"readStates,omitempty"`
+	Entries          []jsonEntry           `json:"entries,omitempty"`
+	Snapshot         *jsonSnapshotMetadata `json:"snapshot,omitempty"`
+	CommittedEntries []jsonEntry           `json:"committedEntries,omitempty"`
+	Messages         []jsonMessage         `json:"messages,omitempty"`
+	MustSync         bool                  `json:"mustSync"`
+}
+
+type jsonSoftState struct {
+	Lead      uint64    `json:"lead"`
+	RaftState StateType `json:"raftState"`
+}
+
+type jsonReadState struct {
+	Index      uint64 `json:"index"`
+	RequestCtx []byte `json:"requestCtx"`
+}
+
+type jsonHardState struct {
+	Term   uint64 `json:"term"`
+	Vote   uint64 `json:"vote"`
+	Commit uint64 `json:"commit"`
+}
+
+type jsonEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Type  string `json:"type"`
+	Data  []byte `json:"data,omitempty"`
+	// ConfChange describes the changes of a conf change entry.
+	ConfChange string `json:"confChange,omitempty"`
+}
+
+func jsonEntries(ents []pb.Entry) []jsonEntry {
+	if len(ents) == 0 {
+		return nil
+	}
+	j := make([]jsonEntry, len(ents))
+	for i, e := range ents {
+		j[i] = jsonEntry{Index: e.Index, Term: e.Term, Type: e.Type.String(), Data: e.Data}
+		var cc pb.ConfChangeI
+		switch e.Type {
+		case pb.EntryConfChange:
+			var ccv1 pb.ConfChange
+			if ccv1.Unmarshal(e.Data) == nil {
+				cc = ccv1
+			}
+		case pb.EntryConfChangeV2:
+			var ccv2 pb.ConfChangeV2
+			if ccv2.Unmarshal(e.Data) == nil {
+				cc = ccv2
+			}
+		}
+		if cc != nil {
+			j[i].ConfChange = pb.ConfChangesToString(cc.AsV2().Changes)
+		}
+	}
+	return j
+}
+
+type jsonSnapshotMetadata struct {
+	Index     uint64       `json:"index"`
+	Term      uint64       `json:"term"`
+	ConfState pb.ConfState `json:"confState"`
+}
+
+func newJSONSnapshotMetadata(m pb.SnapshotMetadata) *jsonSnapshotMetadata {
+	return &jsonSnapshotMetadata{Index: m.Index, Term: m.Term, ConfState: m.ConfState}
+}
+
+type jsonMessage struct {
+	Type       string                `json:"type"`
+	From       uint64                `json:"from"`
+	To         uint64                `json:"to"`
+	Term       uint64                `json:"term"`
+	LogTerm    uint64                `json:"logTerm,omitempty"`
+	Index      uint64                `json:"index,omitempty"`
+	Commit     uint64                `json:"commit,omitempty"`
+	Vote       uint64                `json:"vote,omitempty"`
+	Reject     bool                  `json:"reject,omitempty"`
+	RejectHint uint64                `json:"rejectHint,omitempty"`
+	Entries    []jsonEntry           `json:"entries,omitempty"`
+	Snapshot   *jsonSnapshotMetadata `json:"snapshot,omitempty"`
+	Responses  []jsonMessage         `json:"responses,omitempty"`
+}
+
+func newJSONMessage(m pb.Message) jsonMessage {
+	j := jsonMessage{
+		Type:       m.Type.String(),
+		From:       m.From,
+		To:         m.To,
+		Term:       m.Term,
+		LogTerm:    m.LogTerm,
+		Index:      m.Index,
+		Commit:     m.Commit,
+		Vote:       m.Vote,
+		Reject:     m.Reject,
+		RejectHint: m.RejectHint,
+		Entries:    jsonEntries(m.Entries),
+	}
+	if m.Snapshot != nil && !IsEmptySnap(*m.Snapshot) {
+		j.Snapshot = newJSONSnapshotMetadata(m.Snapshot.Metadata)
+	}
+	for _, resp := range m.Responses {
+		j.Responses = append(j.Responses, newJSONMessage(resp))
+	}
+	return j
+}
+
 // EntryFormatter can be implemented by the application to provide human-readable formatting
 // of entry data. Nil is a valid EntryFormatter and will use a default format.
 type EntryFormatter func([]byte) string
 
+// ProtoEntryFormatter returns an EntryFormatter for entries carrying protobuf
+// messages. It decodes the data with unmarshal and renders the message in the
+// compact proto text format, or falls back to a quoted string if decoding
+// fails.
+func ProtoEntryFormatter(unmarshal func([]byte) (proto.Message, error)) EntryFormatter {
+	return func(data []byte) string {
+		msg, err := unmarshal(data)
+		if err != nil {
+			return fmt.Sprintf("%q", data)
+		}
+		return strings.TrimSpace(proto.CompactTextString(msg))
+	}
+}
+
+// EntryFormatterV2 is like EntryFormatter, but is also passed the type of the
+// entry. For normal entries, it is called with the entry data. For conf change
+// entries, it is called with the Context of the decoded conf change, and its
+// output is appended to the description of the changes. Nil is a valid
+// EntryFormatterV2 and will use the same default format as EntryFormatter.
+type EntryFormatterV2 func(typ pb.EntryType, data []byte) string
+
+// v2 adapts the EntryFormatter to an EntryFormatterV2 which formats only
+// normal entries, like EntryFormatter always did.
+func (f EntryFormatter) v2() EntryFormatterV2 {
+	if f == nil {
+		return nil
+	}
+	return func(typ pb.EntryType, data []byte) string {
+		if typ != pb.EntryNormal {
+			return ""
+		}
+		return f(data)
+	}
+}
+
 // DescribeMessage returns a concise human-readable description of a
 // Message for debugging.
 func DescribeMessage(m pb.Message, f EntryFormatter) string {
+	return DescribeMessageWithFormatterV2(m, f.v2())
+}
+
+// DescribeMessageWithFormatterV2 is like DescribeMessage, but uses an
+// EntryFormatterV2.
+func DescribeMessageWithFormatterV2(m pb.Message, f EntryFormatterV2) string {
 	return describeMessageWithIndent("", m, f)
 }
 
-func describeMessageWithIndent(indent string, m pb.Message, f EntryFormatter) string {
+func describeMessageWithIndent(indent string, m pb.Message, f EntryFormatterV2) string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "%s%s->%s %v Term:%d Log:%d/%d", indent,
 		describeTarget(m.From), describeTarget(m.To), m.Type, m.Term, m.LogTerm, m.Index)
@@ -165,12 +508,12 @@ func describeMessageWithIndent(indent string, m pb.Message, f EntryFormatter) st
 		fmt.Fprintf(&buf, " Vote:%d", m.Vote)
 	}
 	if ln := len(m.Entries); ln == 1 {
-		fmt.Fprintf(&buf, " Entries:[%s]", DescribeEntry(m.Entries[0], f))
+		fmt.Fprintf(&buf, " Entries:[%s]", DescribeEntryWithFormatterV2(m.Entries[0], f))
 	} else if ln > 1 {
 		fmt.Fprint(&buf, " Entries:[")
 		for _, e := range m.Entries {
 			fmt.Fprintf(&buf, "\n%s  ", indent)
-			buf.WriteString(DescribeEntry(e, f))
+			buf.WriteString(DescribeEntryWithFormatterV2(e, f))
 		}
 		fmt.Fprintf(&buf, "\n%s]", indent)
 	}
@@ -188,6 +531,46 @@ func describeMessageWithIndent(indent string, m pb.Message, f EntryFormatter) st
 	return buf.String()
 }
 
+// DescribeMessageCompact returns a single-line description of a Message,
+// suitable for high-volume tracing. Unlike DescribeMessage, it only includes
+// the number of entries and responses, and the index and term of a snapshot.
+// If an EntryFormatter is given, the entries are also described with it, with
+// any newlines escaped to keep the description on a single line.
+func DescribeMessageCompact(m pb.Message, f EntryFormatter) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s->%s %v Term:%d Log:%d/%d",
+		describeTarget(m.From), describeTarget(m.To), m.Type, m.Term, m.LogTerm, m.Index)
+	if m.Reject {
+		fmt.Fprintf(&buf, " Rejected (Hint: %d)", m.RejectHint)
+	}
+	if m.Commit != 0 {
+		fmt.Fprintf(&buf, " Commit:%d", m.Commit)
+	}
+	if m.Vote != 0 {
+		fmt.Fprintf(&buf, " Vote:%d", m.Vote)
+	}
+	if len(m.Entries) > 0 {
+		fmt.Fprintf(&buf, " Entries:%d", len(m.Entries))
+		if f != nil {
+			buf.WriteString(" [")
+			for i, e := range m.Entries {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				buf.WriteString(strings.ReplaceAll(DescribeEntry(e, f), "\n", `\n`))
+			}
+			buf.WriteString("]")
+		}
+	}
+	if s := m.Snapshot; s != nil && !IsEmptySnap(*s) {
+		fmt.Fprintf(&buf, " Snapshot:%d/%d", s.Metadata.Term, s.Metadata.Index)
+	}
+	if len(m.Responses) > 0 {
+		fmt.Fprintf(&buf, " Responses:%d", len(m.Responses))
+	}
+	return buf.String()
+}
+
 func describeTarget(id uint64) string {
 	switch id {
 	case None:
@@ -201,23 +584,71 @@ func describeTarget(id uint64) string {
 	}
 }
 
+// DescribeAppendConflict describes where the entries of the MsgApp m diverge
+// from local, which is a contiguous tail of the local log. It names the first
+// index at which the terms differ, including the index preceding the appended
+// entries, or the end of local if it is shorter than the message. Indexes not
+// covered by local are assumed to match.
+func DescribeAppendConflict(local []pb.Entry, m pb.Message) string {
+	var last uint64
+	if len(local) > 0 {
+		last = local[len(local)-1].Index
+	}
+	term := func(index uint64) (uint64, bool) {
+		if len(local) == 0 || index < local[0].Index || index > last {
+			return 0, false
+		}
+		return local[index-local[0].Index].Term, true
+	}
+
+	if m.Index > last {
+		return fmt.Sprintf("local log is shorter: last index %d, message prev index %d", last, m.Index)
+	}
+	if t, ok := term(m.Index); ok && t != m.LogTerm {
+		return fmt.Sprintf("diverge at prev index %d: local term %d, message term %d", m.Index, t, m.LogTerm)
+	}
+	for _, e := range m.Entries {
+		if e.Index > last {
+			return fmt.Sprintf("no conflict: local log ends at index %d, message appends up to index %d",
+				last, m.Entries[len(m.Entries)-1].Index)
+		}
+		if t, ok := term(e.Index); ok && t != e.Term {
+			return fmt.Sprintf("diverge at index %d: local term %d, message term %d", e.Index, t, e.Term)
+		}
+	}
+	return fmt.Sprintf("no conflict: message matches local log up to index %d", m.Index+uint64(len(m.Entries)))
+}
+
 // DescribeEntry returns a concise human-readable description of an
 // Entry for debugging.
 func DescribeEntry(e pb.Entry, f EntryFormatter) string {
+	return DescribeEntryWithFormatterV2(e, f.v2())
+}
+
+// DescribeEntryWithFormatterV2 is like DescribeEntry, but uses an
+// EntryFormatterV2, which also gets to format the Context of conf changes.
+func DescribeEntryWithFormatterV2(e pb.Entry, f EntryFormatterV2) string {
 	if f == nil {
-		f = func(data []byte) string { return fmt.Sprintf("%q", data) }
+		f = func(typ pb.EntryType, data []byte) string {
+			if typ != pb.EntryNormal {
+				return ""
+			}
+			return fmt.Sprintf("%q", data)
+		}
 	}
 
 	formatConfChange := func(cc pb.ConfChangeI) string {
-		// TODO(tbg): give the EntryFormatter a type argument so that it gets
-		// a chance to expose the Context.
-		return pb.ConfChangesToString(cc.AsV2().Changes)
+		s := pb.ConfChangesToString(cc.AsV2().Changes)
+		if ctx := f(e.Type, cc.AsV2().Context); ctx != "" {
+			s += " " + ctx
+		}
+		return s
 	}
 
 	var formatted string
 	switch e.Type {
 	case pb.EntryNormal:
-		formatted = f(e.Data)
+		formatted = f(e.Type, e.Data)
 	case pb.EntryConfChange:
 		var cc pb.ConfChange
 		if err := cc.Unmarshal(e.Data); err != nil {
@@ -242,13 +673,60 @@ func DescribeEntry(e pb.Entry, f EntryFormatter) string {
 // DescribeEntries calls DescribeEntry for each Entry, adding a newline to
 // each.
 func DescribeEntries(ents []pb.Entry, f EntryFormatter) string {
+	return DescribeEntriesWithFormatterV2(ents, f.v2())
+}
+
+// DescribeEntriesWithFormatterV2 is like DescribeEntries, but uses an
+// EntryFormatterV2.
+func DescribeEntriesWithFormatterV2(ents []pb.Entry, f EntryFormatterV2) string {
 	var buf bytes.Buffer
 	for _, e := range ents {
-		_, _ = buf.WriteString(DescribeEntry(e, f) + "\n")
+		_, _ = buf.WriteString(DescribeEntryWithFormatterV2(e, f) + "\n")
 	}
 	return buf.String()
 }
 
+// DescribeEntriesElided is like DescribeEntries, but only describes the first
+// head and the last tail entries. The entries in between are replaced by a
+// single line with their count and index range. All entries are described if
+// there are no more than head+tail of them.
+func DescribeEntriesElided(ents []pb.Entry, f EntryFormatter, head, tail int) string {
+	head, tail = max(head, 0), max(tail, 0)
+	if len(ents) <= head+tail {
+		return DescribeEntries(ents, f)
+	}
+	elided := ents[head : len(ents)-tail]
+	return DescribeEntries(ents[:head], f) +
+		fmt.Sprintf("... %d entries elided [%d, %d] ...\n",
+			len(elided), elided[0].Index, elided[len(elided)-1].Index) +
+		DescribeEntries(ents[len(ents)-tail:], f)
+}
+
+// entriesFootprint returns an estimate of the number of bytes used by the
+// given entries.
+func entriesFootprint(ents []pb.Entry) uint64 {
+	n := uint64(cap(ents)) * uint64(unsafe.Sizeof(pb.Entry{}))
+	for i := range ents {
+		n += uint64(len(ents[i].Data))
+	}
+	return n
+}
+
+// messagesFootprint returns an estimate of the number of bytes used by the
+// given messages. Entry and snapshot data shared with the log is counted
+// again.
+func messagesFootprint(msgs []pb.Message) uint64 {
+	n := uint64(cap(msgs)) * uint64(unsafe.Sizeof(pb.Message{}))
+	for i := range msgs {
+		m := &msgs[i]
+		n += entriesFootprint(m.Entries) + uint64(len(m.Context))
+		if m.Snapshot != nil {
+			n += uint64(unsafe.Sizeof(*m.Snapshot)) + uint64(len(m.Snapshot.Data))
+		}
+	}
+	return n
+}
+
 // entryEncodingSize represents the protocol buffer encoding size of one or more
 // entries.
 type entryEncodingSize uint64
@@ -279,6 +757,21 @@ func limitSize(ents []pb.Entry, maxSize entryEncodingSize) []pb.Entry {
 	return ents
 }
 
+// LimitEntriesBySize returns the longest prefix of the given entries slice,
+// such that its total protocol buffer encoding size does not exceed maxSize.
+// As an exception, if the size of the first entry exceeds maxSize, a slice
+// with just this entry is returned. Raft applies the same limit to the entries
+// in the messages it sends.
+func LimitEntriesBySize(ents []pb.Entry, maxSize uint64) []pb.Entry {
+	return limitSize(ents, entryEncodingSize(maxSize))
+}
+
+// EntriesEncodingSize returns the total protocol buffer encoding size of the
+// given entries, as used by LimitEntriesBySize.
+func EntriesEncodingSize(ents []pb.Entry) uint64 {
+	return uint64(entsSize(ents))
+}
+
 // entryPayloadSize represents the size of one or more entries' payloads.
 // Notably, it does not depend on its Index or Term. Entries with empty
 // payloads, like those proposed after a leadership change, are considered
@@ -299,12 +792,22 @@ func payloadsSize(ents []pb.Entry) entryPayloadSize {
 	return s
 }
 
-func assertConfStatesEquivalent(l Logger, cs1, cs2 pb.ConfState) {
+// ConfStatesAgree returns true if the two ConfStates describe the same
+// configuration, irrespective of the order in which the IDs are listed. It is
+// a boolean form of (pb.ConfState).Equivalent.
+func ConfStatesAgree(a, b pb.ConfState) bool {
+	return a.Equivalent(b) == nil
+}
+
+// assertConfStatesEquivalent panics if the two ConfStates are not equivalent.
+// If nonFatal is set, the mismatch is returned instead, and the caller is
+// responsible for reporting it.
+func assertConfStatesEquivalent(l Logger, cs1, cs2 pb.ConfState, nonFatal bool) error {
 	err := cs1.Equivalent(cs2)
-	if err == nil {
-		return
+	if err != nil && !nonFatal {
+		l.Panic(err)
 	}
-	l.Panic(err)
+	return err
 }
 
 // extend appends vals to the given dst slice. It differs from the standard
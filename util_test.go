@@ -15,6 +15,8 @@
 package raft
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"math"
 	"strings"
@@ -41,6 +43,231 @@ func TestDescribeEntry(t *testing.T) {
 	require.Equal(t, "1/2 EntryNormal HELLO\x00WORLD", DescribeEntry(entry, testFormatter))
 }
 
+func TestDescribeEntryWithFormatterV2(t *testing.T) {
+	cc := pb.ConfChange{Type: pb.ConfChangeAddNode, NodeID: 2, Context: []byte("ctx")}
+	ccData, err := cc.Marshal()
+	require.NoError(t, err)
+	normal := pb.Entry{Term: 1, Index: 2, Data: []byte("hello")}
+	confChange := pb.Entry{Term: 1, Index: 3, Type: pb.EntryConfChange, Data: ccData}
+
+	f := func(typ pb.EntryType, data []byte) string {
+		return fmt.Sprintf("%s(%s)", typ, strings.ToUpper(string(data)))
+	}
+	require.Equal(t, `1/2 EntryNormal EntryNormal(HELLO)`, DescribeEntryWithFormatterV2(normal, f))
+	require.Equal(t, `1/3 EntryConfChange v2 EntryConfChange(CTX)`, DescribeEntryWithFormatterV2(confChange, f))
+
+	// A nil formatter falls back to the default format, which matches that of
+	// DescribeEntry.
+	for _, e := range []pb.Entry{normal, confChange} {
+		require.Equal(t, DescribeEntry(e, nil), DescribeEntryWithFormatterV2(e, nil))
+	}
+	require.Equal(t, `1/2 EntryNormal "hello"`, DescribeEntryWithFormatterV2(normal, nil))
+	require.Equal(t, `1/3 EntryConfChange v2`, DescribeEntryWithFormatterV2(confChange, nil))
+
+	m := pb.Message{From: 1, To: 2, Type: pb.MsgApp, Entries: []pb.Entry{normal}}
+	require.Equal(t, `1->2 MsgApp Term:0 Log:0/0 Entries:[1/2 EntryNormal EntryNormal(HELLO)]`,
+		DescribeMessageWithFormatterV2(m, f))
+	require.Equal(t, "1/2 EntryNormal EntryNormal(HELLO)\n1/3 EntryConfChange v2 EntryConfChange(CTX)\n",
+		DescribeEntriesWithFormatterV2([]pb.Entry{normal, confChange}, f))
+	require.Equal(t, "Ready MustSync=false:\nEntries:\n1/2 EntryNormal EntryNormal(HELLO)\n",
+		DescribeReadyWithFormatterV2(Ready{Entries: []pb.Entry{normal}}, f))
+}
+
+func TestDescribeMessageCompact(t *testing.T) {
+	for _, tt := range []struct {
+		m    pb.Message
+		want string
+	}{
+		{pb.Message{From: 1, To: 2, Type: pb.MsgHeartbeat, Term: 3, Commit: 5},
+			"1->2 MsgHeartbeat Term:3 Log:0/0 Commit:5"},
+		{pb.Message{From: 1, To: 2, Type: pb.MsgApp, Term: 3, LogTerm: 2, Index: 4, Commit: 4,
+			Entries: []pb.Entry{{Data: []byte("a\nb")}, {}}},
+			"1->2 MsgApp Term:3 Log:2/4 Commit:4 Entries:2"},
+		{pb.Message{From: 2, To: 1, Type: pb.MsgAppResp, Term: 3, Index: 4, Reject: true, RejectHint: 2},
+			"2->1 MsgAppResp Term:3 Log:0/4 Rejected (Hint: 2)"},
+		{pb.Message{From: 1, To: 2, Type: pb.MsgSnap, Term: 3,
+			Snapshot: &pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 10, Term: 2}}},
+			"1->2 MsgSnap Term:3 Log:0/0 Snapshot:2/10"},
+		{pb.Message{From: 1, To: LocalAppendThread, Type: pb.MsgStorageAppend, Vote: 1,
+			Responses: []pb.Message{{From: 1, To: 2}, {From: 1, To: 3}}},
+			"1->AppendThread MsgStorageAppend Term:0 Log:0/0 Vote:1 Responses:2"},
+	} {
+		got := DescribeMessageCompact(tt.m, nil)
+		require.Equal(t, tt.want, got)
+		require.NotContains(t, got, "\n")
+	}
+
+	m := pb.Message{From: 1, To: 2, Type: pb.MsgApp, Term: 3, LogTerm: 2, Index: 4,
+		Entries: []pb.Entry{{Term: 3, Index: 5, Data: []byte("a\nb")}, {Term: 3, Index: 6}}}
+	f := func(data []byte) string { return string(data) }
+	require.Equal(t, `1->2 MsgApp Term:3 Log:2/4 Entries:2 [3/5 EntryNormal a\nb, 3/6 EntryNormal]`,
+		DescribeMessageCompact(m, f))
+}
+
+func TestDescribeAppendConflict(t *testing.T) {
+	local := index(3).terms(1, 2, 2, 3) // entries 3..6
+	app := func(prevIndex, prevTerm uint64, terms ...uint64) pb.Message {
+		return pb.Message{Type: pb.MsgApp, Index: prevIndex, LogTerm: prevTerm,
+			Entries: index(prevIndex + 1).terms(terms...)}
+	}
+	for _, tt := range []struct {
+		local []pb.Entry
+		m     pb.Message
+		want  string
+	}{
+		// Prefix match.
+		{local, app(4, 2, 2, 3), "no conflict: message matches local log up to index 6"},
+		{local, app(3, 1, 2), "no conflict: message matches local log up to index 4"},
+		{local, app(6, 3), "no conflict: message matches local log up to index 6"},
+		{local, app(1, 1, 1, 1, 2), "no conflict: message matches local log up to index 4"},
+		{nil, app(0, 0), "no conflict: message matches local log up to index 0"},
+		// Divergence.
+		{local, app(4, 2, 2, 4, 4), "diverge at index 6: local term 3, message term 4"},
+		{local, app(4, 3, 3, 3), "diverge at prev index 4: local term 2, message term 3"},
+		{local, app(2, 1, 4, 4, 4, 4), "diverge at index 3: local term 1, message term 4"},
+		// Local log is shorter.
+		{local, app(7, 3, 3), "local log is shorter: last index 6, message prev index 7"},
+		{nil, app(2, 1, 1), "local log is shorter: last index 0, message prev index 2"},
+		{local, app(5, 2, 3, 3, 3), "no conflict: local log ends at index 6, message appends up to index 8"},
+	} {
+		t.Run("", func(t *testing.T) {
+			require.Equal(t, tt.want, DescribeAppendConflict(tt.local, tt.m))
+		})
+	}
+}
+
+func TestDescribeSnapshotVerbose(t *testing.T) {
+	snap := pb.Snapshot{Metadata: pb.SnapshotMetadata{
+		Index: 10, Term: 2, ConfState: pb.ConfState{Voters: []uint64{1, 2, 3}},
+	}}
+	require.Equal(t, DescribeSnapshot(snap), DescribeSnapshotVerbose(snap))
+
+	snap.Data = []byte("hello")
+	require.Equal(t, DescribeSnapshot(snap)+" Data:5B Digest:2cf24dba", DescribeSnapshotVerbose(snap))
+	snap.Data = []byte("hellp")
+	require.NotEqual(t, DescribeSnapshot(snap)+" Data:5B Digest:2cf24dba", DescribeSnapshotVerbose(snap))
+}
+
+func TestDescribeEntriesElided(t *testing.T) {
+	ents := index(5).terms(1, 1, 2, 2, 2, 3)
+	require.Equal(t, DescribeEntries(ents, nil), DescribeEntriesElided(ents, nil, 3, 3))
+	require.Equal(t, DescribeEntries(ents, nil), DescribeEntriesElided(ents, nil, 10, 0))
+	require.Equal(t, `1/5 EntryNormal ""
+... 4 entries elided [6, 9] ...
+3/10 EntryNormal ""
+`, DescribeEntriesElided(ents, nil, 1, 1))
+	require.Equal(t, `... 5 entries elided [5, 9] ...
+3/10 EntryNormal ""
+`, DescribeEntriesElided(ents, nil, 0, 1))
+	require.Equal(t, `1/5 EntryNormal ""
+1/6 EntryNormal ""
+... 4 entries elided [7, 10] ...
+`, DescribeEntriesElided(ents, nil, 2, -1))
+	require.Empty(t, DescribeEntriesElided(nil, nil, 0, 0))
+}
+
+func TestDescribeReadySections(t *testing.T) {
+	rd := Ready{
+		SoftState:        &SoftState{Lead: 1, RaftState: StateLeader},
+		HardState:        pb.HardState{Term: 2, Commit: 3},
+		Entries:          index(2).terms(2),
+		CommittedEntries: index(2).terms(2),
+		Messages:         []pb.Message{{From: 1, To: 2, Type: pb.MsgApp, Term: 2}},
+	}
+	require.Equal(t, DescribeReady(rd, nil), DescribeReadySections(rd, nil, ReadyAllSections))
+	require.Equal(t, `Ready MustSync=false:
+Messages:
+1->2 MsgApp Term:2 Log:0/0
+`, DescribeReadySections(rd, nil, ReadyMessages))
+	require.Equal(t, `Ready MustSync=false:
+HardState Term:2 Commit:3
+CommittedEntries:
+2/2 EntryNormal ""
+`, DescribeReadySections(rd, nil, ReadyHardState|ReadyCommittedEntries))
+	require.Equal(t, "<empty Ready>", DescribeReadySections(rd, nil, ReadySnapshot|ReadyReadStates))
+	require.Equal(t, "<empty Ready>", DescribeReadySections(rd, nil, 0))
+}
+
+func TestReadySummary(t *testing.T) {
+	require.Equal(t, "<empty Ready>", ReadySummary(Ready{}))
+	require.Equal(t, "entries=0 committed=0 msgs=0 snap=false hs=false",
+		ReadySummary(Ready{SoftState: &SoftState{Lead: 1}}))
+
+	rd := Ready{
+		HardState:        pb.HardState{Term: 2, Commit: 3},
+		Entries:          index(2).terms(2, 2, 2),
+		CommittedEntries: index(2).terms(2, 2),
+		Messages: []pb.Message{
+			{Type: pb.MsgApp}, {Type: pb.MsgVote}, {Type: pb.MsgAppResp},
+			{Type: pb.MsgPreVoteResp}, {Type: pb.MsgApp},
+		},
+	}
+	require.Equal(t, "entries=3 committed=2 msgs=5(app=3,vote=2) snap=false hs=true", ReadySummary(rd))
+
+	rd = Ready{
+		Snapshot: pb.Snapshot{Metadata: pb.SnapshotMetadata{Index: 5, Term: 1}},
+		Messages: []pb.Message{
+			{Type: pb.MsgHeartbeat}, {Type: pb.MsgSnap}, {Type: pb.MsgReadIndexResp}, {Type: pb.MsgHeartbeatResp},
+		},
+	}
+	require.Equal(t, "entries=0 committed=0 msgs=4(heartbeat=2,snap=1,other=1) snap=true hs=false", ReadySummary(rd))
+}
+
+func TestReadyToJSON(t *testing.T) {
+	cc := pb.ConfChangeV2{Changes: []pb.ConfChangeSingle{{Type: pb.ConfChangeAddLearnerNode, NodeID: 3}}}
+	ccData, err := cc.Marshal()
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		rd   Ready
+		want string
+	}{
+		{Ready{}, `{"mustSync":false}`},
+		{
+			Ready{
+				SoftState: &SoftState{Lead: 1, RaftState: StateLeader},
+				HardState: pb.HardState{Term: 2, Vote: 1, Commit: 3},
+				Entries: []pb.Entry{
+					{Term: 2, Index: 4, Data: []byte("foo")},
+					{Term: 2, Index: 5, Type: pb.EntryConfChangeV2, Data: ccData},
+				},
+				CommittedEntries: []pb.Entry{{Term: 2, Index: 3}},
+				Messages: []pb.Message{
+					{Type: pb.MsgApp, From: 1, To: 2, Term: 2, LogTerm: 2, Index: 3, Commit: 3,
+						Entries: []pb.Entry{{Term: 2, Index: 4, Data: []byte("foo")}}},
+				},
+				MustSync: true,
+			},
+			`{"softState":{"lead":1,"raftState":"StateLeader"},` +
+				`"hardState":{"term":2,"vote":1,"commit":3},` +
+				`"entries":[{"index":4,"term":2,"type":"EntryNormal","data":"Zm9v"},` +
+				`{"index":5,"term":2,"type":"EntryConfChangeV2","data":"` + base64.StdEncoding.EncodeToString(ccData) + `","confChange":"l3"}],` +
+				`"committedEntries":[{"index":3,"term":2,"type":"EntryNormal"}],` +
+				`"messages":[{"type":"MsgApp","from":1,"to":2,"term":2,"logTerm":2,"index":3,"commit":3,` +
+				`"entries":[{"index":4,"term":2,"type":"EntryNormal","data":"Zm9v"}]}],` +
+				`"mustSync":true}`,
+		},
+		{
+			Ready{Snapshot: pb.Snapshot{Metadata: pb.SnapshotMetadata{
+				Index: 10, Term: 3, ConfState: pb.ConfState{Voters: []uint64{1, 2}},
+			}}},
+			`{"snapshot":{"index":10,"term":3,"confState":{"voters":[1,2],"auto_leave":false}},"mustSync":false}`,
+		},
+		{
+			Ready{ReadStates: []ReadState{{Index: 7, RequestCtx: []byte("ctx")}, {Index: 8, Rejected: true}}},
+			`{"readStates":[{"index":7,"requestCtx":"Y3R4"},{"index":8,"requestCtx":null}],"mustSync":false}`,
+		},
+	} {
+		b, err := ReadyToJSON(tt.rd)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, string(b))
+
+		b, err = json.Marshal(tt.rd)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, string(b))
+	}
+}
+
 func TestLimitSize(t *testing.T) {
 	ents := []pb.Entry{{Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 6}}
 	prefix := func(size int) []pb.Entry {
@@ -65,6 +292,9 @@ func TestLimitSize(t *testing.T) {
 			require.Equal(t, tt.want, got)
 			size := entsSize(got)
 			require.True(t, len(got) == 1 || size <= entryEncodingSize(tt.maxSize))
+
+			require.Equal(t, got, LimitEntriesBySize(ents, tt.maxSize))
+			require.Equal(t, uint64(size), EntriesEncodingSize(got))
 		})
 	}
 }
@@ -142,6 +372,142 @@ func TestIsResponseMsg(t *testing.T) {
 	}
 }
 
+func TestIsVoteMsg(t *testing.T) {
+	for typ := range pb.MessageType_name {
+		msgt := pb.MessageType(typ)
+		t.Run(fmt.Sprint(msgt), func(t *testing.T) {
+			assert.Equal(t, msgt == pb.MsgVote || msgt == pb.MsgPreVote, IsVoteMsg(msgt))
+			assert.Equal(t, msgt == pb.MsgVoteResp || msgt == pb.MsgPreVoteResp, IsVoteRespMsg(msgt))
+			if IsVoteMsg(msgt) {
+				assert.True(t, IsVoteRespMsg(voteRespMsgType(msgt)))
+			}
+		})
+	}
+	// Out-of-range types are not vote messages.
+	assert.False(t, IsVoteMsg(pb.MessageType(1000)))
+	assert.False(t, IsVoteRespMsg(pb.MessageType(1000)))
+}
+
+// errorRecordingLogger records the messages logged through Error and Errorf.
+type errorRecordingLogger struct {
+	*DefaultLogger
+	errors []string
+}
+
+func (l *errorRecordingLogger) Error(v ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprint(v...))
+}
+
+func (l *errorRecordingLogger) Errorf(format string, v ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+}
+
+func TestAssertConfStatesEquivalent(t *testing.T) {
+	l := &errorRecordingLogger{DefaultLogger: discardLogger}
+	cs1 := pb.ConfState{Voters: []uint64{1, 2, 3}}
+	cs2 := pb.ConfState{Voters: []uint64{3, 2, 1}}
+	require.NoError(t, assertConfStatesEquivalent(l, cs1, cs2, false))
+	require.NoError(t, assertConfStatesEquivalent(l, cs1, cs2, true))
+	require.Empty(t, l.errors)
+
+	cs2 = pb.ConfState{Voters: []uint64{1, 2}, Learners: []uint64{3}}
+	require.Panics(t, func() { _ = assertConfStatesEquivalent(l, cs1, cs2, false) })
+	require.Error(t, assertConfStatesEquivalent(l, cs1, cs2, true))
+	// Reporting a non-fatal mismatch is left to the caller.
+	require.Empty(t, l.errors)
+}
+
+func TestDiffConfState(t *testing.T) {
+	for _, tt := range []struct {
+		from, to pb.ConfState
+
+		addedVoters, removedVoters, addedLearners, removedLearners []uint64
+	}{
+		{},
+		{
+			from: pb.ConfState{Voters: []uint64{3, 1, 2}, Learners: []uint64{4}},
+			to:   pb.ConfState{Voters: []uint64{2, 3, 1}, Learners: []uint64{4}},
+		},
+		{
+			from:        pb.ConfState{Voters: []uint64{1, 2}},
+			to:          pb.ConfState{Voters: []uint64{5, 1, 2, 4}, Learners: []uint64{3}},
+			addedVoters: []uint64{4, 5}, addedLearners: []uint64{3},
+		},
+		{
+			from:          pb.ConfState{Voters: []uint64{1, 2, 3}, Learners: []uint64{4}},
+			to:            pb.ConfState{Voters: []uint64{1, 4}, Learners: []uint64{3}},
+			addedVoters:   []uint64{4},
+			removedVoters: []uint64{2, 3},
+			addedLearners: []uint64{3}, removedLearners: []uint64{4},
+		},
+		// Entering a joint configuration which replaces 3 with 4, and demotes 2.
+		{
+			from: pb.ConfState{Voters: []uint64{1, 2, 3}},
+			to: pb.ConfState{Voters: []uint64{1, 4}, VotersOutgoing: []uint64{1, 2, 3},
+				LearnersNext: []uint64{2}},
+			addedVoters: []uint64{4}, addedLearners: []uint64{2},
+		},
+		// Leaving it.
+		{
+			from: pb.ConfState{Voters: []uint64{1, 4}, VotersOutgoing: []uint64{1, 2, 3},
+				LearnersNext: []uint64{2}},
+			to:            pb.ConfState{Voters: []uint64{1, 4}, Learners: []uint64{2}},
+			removedVoters: []uint64{2, 3},
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			from, to := DescribeConfState(tt.from), DescribeConfState(tt.to)
+			addedVoters, removedVoters, addedLearners, removedLearners := DiffConfState(tt.from, tt.to)
+			assert.Equal(t, tt.addedVoters, addedVoters)
+			assert.Equal(t, tt.removedVoters, removedVoters)
+			assert.Equal(t, tt.addedLearners, addedLearners)
+			assert.Equal(t, tt.removedLearners, removedLearners)
+			// The inputs are not modified.
+			assert.Equal(t, from, DescribeConfState(tt.from))
+			assert.Equal(t, to, DescribeConfState(tt.to))
+		})
+	}
+}
+
+func TestConfStatesAgree(t *testing.T) {
+	for _, tt := range []struct {
+		a, b pb.ConfState
+		want bool
+	}{
+		{pb.ConfState{}, pb.ConfState{}, true},
+		{
+			pb.ConfState{Voters: []uint64{1, 2, 3}, Learners: []uint64{4, 5}},
+			pb.ConfState{Voters: []uint64{3, 1, 2}, Learners: []uint64{5, 4}},
+			true,
+		},
+		{
+			pb.ConfState{Voters: []uint64{1, 2}, VotersOutgoing: []uint64{1, 2, 3}, LearnersNext: []uint64{3}},
+			pb.ConfState{Voters: []uint64{2, 1}, VotersOutgoing: []uint64{3, 2, 1}, LearnersNext: []uint64{3}},
+			true,
+		},
+		{
+			pb.ConfState{Voters: []uint64{1, 2, 3}},
+			pb.ConfState{Voters: []uint64{1, 2}},
+			false,
+		},
+		{
+			pb.ConfState{Voters: []uint64{1, 2}, Learners: []uint64{3}},
+			pb.ConfState{Voters: []uint64{1, 2, 3}},
+			false,
+		},
+		{
+			pb.ConfState{Voters: []uint64{1}, VotersOutgoing: []uint64{1}, AutoLeave: true},
+			pb.ConfState{Voters: []uint64{1}, VotersOutgoing: []uint64{1}},
+			false,
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			require.Equal(t, tt.want, ConfStatesAgree(tt.a, tt.b))
+			require.Equal(t, tt.want, ConfStatesAgree(tt.b, tt.a))
+		})
+	}
+}
+
 // TestPayloadSizeOfEmptyEntry ensures that payloadSize of empty entry is always zero.
 // This property is important because new leaders append an empty entry to their log,
 // and we don't want this to count towards the uncommitted log quota.